@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// requestTimeout bounds each request made to the admin API.
+const requestTimeout = 10 * time.Second
+
+// adminClient talks to the proxy's admin API over either mTLS or a local Unix socket.
+type adminClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+// newAdminClient returns a client for the Unix socket if one is given, otherwise for the mTLS admin address.
+func newAdminClient(addr string, socket string, ca string, cert string, key string) (*adminClient, error) {
+	if socket != "" {
+		return &adminClient{
+			baseURL: "http://proxy",
+			http: &http.Client{
+				Timeout: requestTimeout,
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+					},
+				},
+			},
+		}, nil
+	}
+
+	pool := x509.NewCertPool()
+	caData, err := os.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+	pool.AppendCertsFromPEM(caData)
+
+	tlsCert, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &adminClient{
+		baseURL: "https://" + addr,
+		http: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:      pool,
+					Certificates: []tls.Certificate{tlsCert},
+					MinVersion:   tls.VersionTLS13,
+				},
+			},
+		},
+	}, nil
+}
+
+// do performs a request against the admin API, decoding a JSON response into out if it is not nil. If out is a
+// *[]byte, the raw response is stored instead.
+func (c *adminClient) do(method string, path string, query url.Values, out any) error {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw = body
+		return nil
+	}
+
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joshbranham/tcp-proxy/pkg/tcpproxy"
+)
+
+const usage = `proxyctl operates a running tcp-proxy through its admin API.
+
+Usage:
+  proxyctl [flags] <command> [arguments]
+
+Commands:
+  status                         show the state of the proxy and its upstreams
+  sessions [-user U] [-upstream A]
+                                 list live sessions
+  kill <session-id>              terminate a session
+  kill -user U                   terminate all sessions of a user
+  upstreams                      list upstreams
+  upstreams add <address> [-weight N]
+                                 add an upstream
+  upstreams remove <address>     remove an upstream, existing sessions continue
+  upstreams weight <address> <N> change the weight of an upstream
+  drain <address>                stop routing new connections to an upstream
+  undrain <address>              resume routing new connections to an upstream
+  reload                         reload TLS material from disk
+  ratelimit show <user>          show a user's rate limit
+  ratelimit reset <user>         reset a user's rate limit
+  config                         dump the effective configuration
+  captures                       list traffic captures
+  capture start [-user U] [-group G] [-upstream A] [-max-bytes N] [-duration D]
+                                 capture the decrypted traffic of new matching sessions
+  capture stop <id>              stop a capture, keeping its file
+  udp flows                      list UDP flows
+  debug state                    dump the internal state of the load balancer and rate limiters
+  debug goroutines               dump all goroutines, labelled with the session they serve
+  audit verify <path>            verify an audit log file has not been tampered with,
+                                 without contacting the proxy
+
+Flags:
+`
+
+func main() {
+	flags := flag.NewFlagSet("proxyctl", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:5001", "address of the admin API")
+	socket := flags.String("socket", "", "path to the admin Unix socket, used instead of -addr if set")
+	ca := flags.String("ca", "certificates/ca.pem", "CA certificate used to verify the admin API")
+	cert := flags.String("cert", "certificates/user2.pem", "client certificate for the admin API")
+	key := flags.String("key", "certificates/user2.key", "client private key for the admin API")
+	output := flags.String("o", "table", "output format, either table or json")
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		os.Exit(2)
+	}
+
+	// Verifying the audit log only reads a local file, so it does not need the admin API.
+	if flags.Arg(0) == "audit" {
+		if err := verifyAudit(flags.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	client, err := newAdminClient(*addr, *socket, *ca, *cert, *key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	p := &printer{out: os.Stdout, asJSON: *output == "json"}
+
+	if err = run(client, p, flags.Arg(0), flags.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run dispatches a single command.
+func run(client *adminClient, p *printer, command string, args []string) error {
+	switch command {
+	case "status":
+		return status(client, p)
+	case "sessions":
+		return sessions(client, p, args)
+	case "kill":
+		return kill(client, p, args)
+	case "upstreams":
+		return upstreams(client, p, args)
+	case "drain", "undrain":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: proxyctl %s <address>", command)
+		}
+		var result map[string]bool
+		query := url.Values{"address": []string{args[0]}}
+		if err := client.do(http.MethodPost, "/upstreams/"+command, query, &result); err != nil {
+			return err
+		}
+		return p.table(result, []string{"UPSTREAM", "DRAINING"}, [][]string{
+			{args[0], strconv.FormatBool(result["draining"])},
+		})
+	case "reload":
+		var result map[string]bool
+		if err := client.do(http.MethodPost, "/reload", nil, &result); err != nil {
+			return err
+		}
+		return p.table(result, []string{"RELOADED"}, [][]string{{strconv.FormatBool(result["reloaded"])}})
+	case "ratelimit":
+		return rateLimit(client, p, args)
+	case "captures":
+		return captures(client, p, http.MethodGet, "/captures", nil)
+	case "capture":
+		return capture(client, p, args)
+	case "udp":
+		return udpFlows(client, p, args)
+	case "debug":
+		return debug(client, p, args)
+	case "config":
+		var config map[string]any
+		if err := client.do(http.MethodGet, "/config", nil, &config); err != nil {
+			return err
+		}
+		// The configuration is nested, so it is always shown as JSON.
+		return p.json(config)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func status(client *adminClient, p *printer) error {
+	var status tcpproxy.ProxyStatus
+	if err := client.do(http.MethodGet, "/status", nil, &status); err != nil {
+		return err
+	}
+
+	return p.table(status, []string{"ADDRESS", "SERVING", "READY", "UPTIME", "SESSIONS", "UPSTREAMS"}, [][]string{{
+		status.Address,
+		strconv.FormatBool(status.Serving),
+		strconv.FormatBool(status.Ready),
+		time.Since(status.StartTime).Round(time.Second).String(),
+		strconv.Itoa(status.Sessions),
+		strconv.Itoa(len(status.Upstreams)),
+	}})
+}
+
+func sessions(client *adminClient, p *printer, args []string) error {
+	flags := flag.NewFlagSet("sessions", flag.ContinueOnError)
+	user := flags.String("user", "", "only show sessions of this user")
+	upstream := flags.String("upstream", "", "only show sessions to this upstream")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *user != "" {
+		query.Set("user", *user)
+	}
+	if *upstream != "" {
+		query.Set("upstream", *upstream)
+	}
+
+	var sessions []tcpproxy.SessionInfo
+	if err := client.do(http.MethodGet, "/sessions", query, &sessions); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(sessions))
+	for _, s := range sessions {
+		rows = append(rows, []string{
+			s.ID,
+			s.User,
+			s.Group,
+			s.ClientAddress,
+			s.Upstream,
+			time.Since(s.StartTime).Round(time.Second).String(),
+			strconv.FormatInt(s.BytesIn, 10),
+			strconv.FormatInt(s.BytesOut, 10),
+		})
+	}
+
+	return p.table(
+		sessions,
+		[]string{"ID", "USER", "GROUP", "CLIENT", "UPSTREAM", "AGE", "BYTES IN", "BYTES OUT"},
+		rows,
+	)
+}
+
+func kill(client *adminClient, p *printer, args []string) error {
+	flags := flag.NewFlagSet("kill", flag.ContinueOnError)
+	user := flags.String("user", "", "terminate all sessions of this user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var result map[string]int
+	switch {
+	case *user != "" && flags.NArg() == 0:
+		query := url.Values{"user": []string{*user}}
+		if err := client.do(http.MethodDelete, "/sessions", query, &result); err != nil {
+			return err
+		}
+	case *user == "" && flags.NArg() == 1:
+		if err := client.do(http.MethodDelete, "/sessions/"+url.PathEscape(flags.Arg(0)), nil, &result); err != nil {
+			return err
+		}
+	default:
+		return errors.New("usage: proxyctl kill <session-id> | proxyctl kill -user <user>")
+	}
+
+	return p.table(result, []string{"TERMINATED"}, [][]string{{strconv.Itoa(result["terminated"])}})
+}
+
+func upstreams(client *adminClient, p *printer, args []string) error {
+	if len(args) > 0 {
+		return changeUpstream(client, p, args)
+	}
+
+	var upstreams []tcpproxy.UpstreamStatus
+	if err := client.do(http.MethodGet, "/upstreams", nil, &upstreams); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(upstreams))
+	for _, u := range upstreams {
+		rows = append(rows, []string{
+			u.Route,
+			u.Address,
+			strconv.Itoa(u.Connections),
+			strconv.Itoa(u.Weight),
+			strconv.FormatBool(u.Draining),
+			strconv.Itoa(u.IdleConnections),
+		})
+	}
+
+	return p.table(upstreams, []string{"ROUTE", "ADDRESS", "CONNECTIONS", "WEIGHT", "DRAINING", "IDLE"}, rows)
+}
+
+// changeUpstream adds, removes or reweights an upstream.
+func changeUpstream(client *adminClient, p *printer, args []string) error {
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("upstreams add", flag.ContinueOnError)
+		weight := flags.Int("weight", 1, "relative share of new connections")
+		if len(args) < 2 {
+			return errors.New("usage: proxyctl upstreams add <address> [-weight N]")
+		}
+		if err := flags.Parse(args[2:]); err != nil {
+			return err
+		}
+		query := url.Values{"address": []string{args[1]}, "weight": []string{strconv.Itoa(*weight)}}
+		var result map[string]bool
+		if err := client.do(http.MethodPost, "/upstreams", query, &result); err != nil {
+			return err
+		}
+		return p.table(result, []string{"UPSTREAM", "ADDED"}, [][]string{{args[1], strconv.FormatBool(result["added"])}})
+	case "remove":
+		if len(args) != 2 {
+			return errors.New("usage: proxyctl upstreams remove <address>")
+		}
+		var result map[string]bool
+		query := url.Values{"address": []string{args[1]}}
+		if err := client.do(http.MethodDelete, "/upstreams", query, &result); err != nil {
+			return err
+		}
+		return p.table(result, []string{"UPSTREAM", "REMOVED"}, [][]string{{args[1], strconv.FormatBool(result["removed"])}})
+	case "weight":
+		if len(args) != 3 {
+			return errors.New("usage: proxyctl upstreams weight <address> <weight>")
+		}
+		query := url.Values{"address": []string{args[1]}, "weight": []string{args[2]}}
+		var result map[string]int
+		if err := client.do(http.MethodPost, "/upstreams/weight", query, &result); err != nil {
+			return err
+		}
+		return p.table(result, []string{"UPSTREAM", "WEIGHT"}, [][]string{{args[1], strconv.Itoa(result["weight"])}})
+	default:
+		return fmt.Errorf("unknown upstreams command %q", args[0])
+	}
+}
+
+func rateLimit(client *adminClient, p *printer, args []string) error {
+	if len(args) != 2 || (args[0] != "show" && args[0] != "reset") {
+		return errors.New("usage: proxyctl ratelimit show|reset <user>")
+	}
+	path := "/ratelimits/" + url.PathEscape(args[1])
+
+	if args[0] == "reset" {
+		var result map[string]bool
+		if err := client.do(http.MethodDelete, path, nil, &result); err != nil {
+			return err
+		}
+		return p.table(result, []string{"USER", "RESET"}, [][]string{{args[1], strconv.FormatBool(result["reset"])}})
+	}
+
+	var state tcpproxy.RateLimitState
+	if err := client.do(http.MethodGet, path, nil, &state); err != nil {
+		return err
+	}
+
+	return p.table(state, []string{"USER", "ALGORITHM", "CAPACITY", "REMAINING", "RETRY AFTER"}, [][]string{{
+		state.Client,
+		string(state.Algorithm),
+		strconv.Itoa(state.Capacity),
+		strconv.Itoa(state.Remaining),
+		state.RetryAfter.String(),
+	}})
+}
+
+func capture(client *adminClient, p *printer, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: proxyctl capture start|stop")
+	}
+
+	switch args[0] {
+	case "start":
+		flags := flag.NewFlagSet("capture start", flag.ContinueOnError)
+		user := flags.String("user", "", "only capture sessions of this user")
+		group := flags.String("group", "", "only capture sessions of this group")
+		upstream := flags.String("upstream", "", "only capture sessions to this upstream")
+		maxBytes := flags.Int64("max-bytes", 0, "stop once the capture file reaches this size")
+		duration := flags.Duration("duration", 0, "stop after this long")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		query := url.Values{}
+		for key, value := range map[string]string{"user": *user, "group": *group, "upstream": *upstream} {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+		if *maxBytes > 0 {
+			query.Set("max_bytes", strconv.FormatInt(*maxBytes, 10))
+		}
+		if *duration > 0 {
+			query.Set("duration", duration.String())
+		}
+		return captures(client, p, http.MethodPost, "/captures", query)
+	case "stop":
+		if len(args) != 2 {
+			return errors.New("usage: proxyctl capture stop <id>")
+		}
+		return captures(client, p, http.MethodDelete, "/captures/"+url.PathEscape(args[1]), nil)
+	default:
+		return fmt.Errorf("unknown capture command %q", args[0])
+	}
+}
+
+// captures performs a capture request, showing the captures in the response as a table.
+func captures(client *adminClient, p *printer, method string, path string, query url.Values) error {
+	var infos []tcpproxy.CaptureInfo
+	if method == http.MethodGet {
+		if err := client.do(method, path, query, &infos); err != nil {
+			return err
+		}
+	} else {
+		var info tcpproxy.CaptureInfo
+		if err := client.do(method, path, query, &info); err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+
+	rows := make([][]string, 0, len(infos))
+	for _, info := range infos {
+		status := "active"
+		if !info.Active {
+			status = info.StopReason
+		}
+		rows = append(rows, []string{
+			info.ID,
+			info.Filter.User,
+			info.Filter.Group,
+			info.Filter.Upstream,
+			strconv.Itoa(info.Sessions),
+			strconv.FormatInt(info.Bytes, 10),
+			status,
+			info.Path,
+		})
+	}
+
+	return p.table(infos, []string{"ID", "USER", "GROUP", "UPSTREAM", "SESSIONS", "BYTES", "STATUS", "PATH"}, rows)
+}
+
+func udpFlows(client *adminClient, p *printer, args []string) error {
+	if len(args) != 1 || args[0] != "flows" {
+		return errors.New("usage: proxyctl udp flows")
+	}
+
+	var flows []tcpproxy.UDPFlowInfo
+	if err := client.do(http.MethodGet, "/udp/flows", nil, &flows); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(flows))
+	for _, flow := range flows {
+		rows = append(rows, []string{
+			flow.Client,
+			flow.Upstream,
+			strconv.FormatInt(flow.PacketsIn, 10),
+			strconv.FormatInt(flow.PacketsOut, 10),
+			strconv.FormatInt(flow.BytesIn, 10),
+			strconv.FormatInt(flow.BytesOut, 10),
+			time.Since(flow.LastActive).Round(time.Second).String(),
+		})
+	}
+
+	return p.table(flows, []string{"CLIENT", "UPSTREAM", "PACKETS IN", "PACKETS OUT", "BYTES IN", "BYTES OUT", "IDLE"},
+		rows)
+}
+
+func debug(client *adminClient, p *printer, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: proxyctl debug state|goroutines")
+	}
+
+	switch args[0] {
+	case "state":
+		var state tcpproxy.DebugState
+		if err := client.do(http.MethodGet, "/debug/state", nil, &state); err != nil {
+			return err
+		}
+		// The state is nested, so it is always shown as JSON.
+		return p.json(state)
+	case "goroutines":
+		var dump []byte
+		query := url.Values{"debug": {"1"}}
+		if err := client.do(http.MethodGet, "/debug/pprof/goroutine", query, &dump); err != nil {
+			return err
+		}
+		_, err := p.out.Write(dump)
+		return err
+	default:
+		return fmt.Errorf("unknown debug command %q", args[0])
+	}
+}
+
+func verifyAudit(args []string) error {
+	if len(args) != 2 || args[0] != "verify" {
+		return errors.New("usage: proxyctl audit verify <path>")
+	}
+
+	entries, err := tcpproxy.VerifyAuditLog(args[1])
+	if err != nil {
+		return fmt.Errorf("audit log %s failed verification: %w", args[1], err)
+	}
+	fmt.Printf("audit log %s verified, %d entries\n", args[1], entries)
+
+	return nil
+}
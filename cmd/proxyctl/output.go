@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// printer renders command results as either tables or JSON.
+type printer struct {
+	out    io.Writer
+	asJSON bool
+}
+
+// table writes rows under headers, or value as JSON when JSON output is selected.
+func (p *printer) table(value any, headers []string, rows [][]string) error {
+	if p.asJSON {
+		return p.json(value)
+	}
+
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		_, _ = fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+
+	return w.Flush()
+}
+
+// json writes value as indented JSON.
+func (p *printer) json(value any) error {
+	encoder := json.NewEncoder(p.out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(value)
+}
@@ -38,11 +38,31 @@ func main() {
 			Capacity: 10,
 			FillRate: 5 * time.Second,
 		},
+		AdminConfig: &tcpproxy.AdminConfig{
+			ListenerAddr:     "localhost:5001",
+			SocketPath:       "proxy-admin.sock",
+			AuthorizedGroups: []string{"administrators"},
+		},
+		AccessLogConfig: &tcpproxy.AccessLogConfig{
+			Output: tcpproxy.AccessLogOutputStdout,
+		},
+		AuditLogConfig: &tcpproxy.AuditLogConfig{
+			Path: "audit.log",
+		},
+		CaptureConfig: &tcpproxy.CaptureConfig{
+			Directory: "captures",
+		},
+		HealthConfig: &tcpproxy.HealthConfig{
+			ListenerAddr: "localhost:5002",
+			DrainDelay:   5 * time.Second,
+		},
 		Logger: slog.Default(),
 	}
 
 	sigC := make(chan os.Signal, 1)
 	signal.Notify(sigC, syscall.SIGINT, syscall.SIGTERM)
+	hupC := make(chan os.Signal, 1)
+	signal.Notify(hupC, syscall.SIGHUP)
 
 	proxy, err := tcpproxy.New(config)
 	if err != nil {
@@ -61,7 +81,15 @@ func main() {
 		wg.Done()
 	}()
 
+	// Reload TLS material on SIGHUP, until we are asked to shut down.
+	go func() {
+		for range hupC {
+			_ = proxy.Reload()
+		}
+	}()
+
 	<-sigC
+	signal.Stop(hupC)
 	logger.Info("shutting down proxy...")
 	_ = proxy.Close()
 	wg.Wait()
@@ -0,0 +1,301 @@
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAccessLogMaxSize is the size an access log file may grow to before it is rotated.
+	defaultAccessLogMaxSize = 100 << 20
+	// defaultAccessLogMaxBackups is how many rotated access log files are kept.
+	defaultAccessLogMaxBackups = 5
+	// defaultAccessLogSyslogTag is the tag access log records are sent to syslog with.
+	defaultAccessLogSyslogTag = "tcp-proxy"
+)
+
+// AccessLogOutput selects where access log records are written.
+type AccessLogOutput string
+
+const (
+	// AccessLogOutputStdout writes one JSON record per line to stdout. This is the default.
+	AccessLogOutputStdout AccessLogOutput = "stdout"
+	// AccessLogOutputFile writes one JSON record per line to a file, rotating it once it reaches MaxSize.
+	AccessLogOutputFile AccessLogOutput = "file"
+	// AccessLogOutputSyslog sends each JSON record as a syslog message.
+	AccessLogOutputSyslog AccessLogOutput = "syslog"
+)
+
+// CloseReason is a stable code identifying why a session ended.
+type CloseReason string
+
+const (
+	// CloseReasonClientClosed is used when the client finished sending first.
+	CloseReasonClientClosed CloseReason = "client_closed"
+	// CloseReasonUpstreamClosed is used when the upstream finished sending first.
+	CloseReasonUpstreamClosed CloseReason = "upstream_closed"
+	// CloseReasonTerminated is used when the session was terminated through the admin API.
+	CloseReasonTerminated CloseReason = "terminated"
+	// CloseReasonError is used when copying data failed with an error other than a clean close.
+	CloseReasonError CloseReason = "error"
+	// CloseReasonNoUpstream is used when every upstream was draining.
+	CloseReasonNoUpstream CloseReason = "no_upstream"
+	// CloseReasonDialFailed is used when the upstream could not be connected to.
+	CloseReasonDialFailed CloseReason = "dial_failed"
+)
+
+// AccessLogConfig is the configuration for the access log, which records one entry per session when it closes.
+type AccessLogConfig struct {
+	// Output selects where records are written. Defaults to AccessLogOutputStdout.
+	Output AccessLogOutput
+
+	// Path is the file records are written to with AccessLogOutputFile.
+	Path string
+	// MaxSize is the size in bytes the file may reach before it is rotated. Defaults to 100MiB.
+	MaxSize int64
+	// MaxBackups is how many rotated files are kept, named Path.1 (newest) to Path.N. Defaults to 5.
+	MaxBackups int
+
+	// SyslogNetwork and SyslogAddress select the syslog daemon for AccessLogOutputSyslog, for example "udp" and
+	// "localhost:514". If both are empty, the local syslog daemon is used.
+	SyslogNetwork string
+	SyslogAddress string
+	// SyslogTag is the tag records are sent with. Defaults to "tcp-proxy".
+	SyslogTag string
+
+	// Sink optionally overrides Output with a custom destination for records.
+	Sink AccessLogSink `json:"-"`
+}
+
+func (c *AccessLogConfig) validate() error {
+	if c.Sink != nil {
+		return nil
+	}
+
+	switch c.Output {
+	case "", AccessLogOutputStdout, AccessLogOutputSyslog:
+	case AccessLogOutputFile:
+		if c.Path == "" {
+			return errors.New("access log output \"file\" requires a Path")
+		}
+	default:
+		return fmt.Errorf("unknown access log output %q", c.Output)
+	}
+	if c.MaxSize < 0 {
+		return errors.New("access log MaxSize cannot be negative")
+	}
+	if c.MaxBackups < 0 {
+		return errors.New("access log MaxBackups cannot be negative")
+	}
+
+	return nil
+}
+
+// AccessLogRecord describes a single session, written once the session closes.
+type AccessLogRecord struct {
+	Time          time.Time `json:"time"`
+	SessionID     string    `json:"session_id"`
+	User          string    `json:"user"`
+	Group         string    `json:"group"`
+	ClientAddress string    `json:"client_address"`
+	SNI           string    `json:"sni,omitempty"`
+	TLSVersion    string    `json:"tls_version"`
+	CipherSuite   string    `json:"cipher_suite"`
+	Upstream      string    `json:"upstream,omitempty"`
+	// DialLatency is how long connecting to the upstream took, in milliseconds.
+	DialLatency float64 `json:"dial_latency_ms"`
+	// BytesIn is the count of bytes copied from the client to the upstream.
+	BytesIn int64 `json:"bytes_in"`
+	// BytesOut is the count of bytes copied from the upstream to the client.
+	BytesOut int64 `json:"bytes_out"`
+	// Duration is how long the session lasted, in milliseconds.
+	Duration    float64     `json:"duration_ms"`
+	CloseReason CloseReason `json:"close_reason"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// newAccessLogRecord fills in the parts of an AccessLogRecord known once a connection is authorized.
+func newAccessLogRecord(id string, user string, group string, conn net.Conn) AccessLogRecord {
+	record := AccessLogRecord{
+		SessionID:     id,
+		User:          user,
+		Group:         group,
+		ClientAddress: conn.RemoteAddr().String(),
+	}
+	switch conn := conn.(type) {
+	case *tls.Conn:
+		state := conn.ConnectionState()
+		record.SNI = state.ServerName
+		record.TLSVersion = tls.VersionName(state.Version)
+		record.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	case *passthroughConn:
+		record.SNI = conn.hello.serverName
+	}
+
+	return record
+}
+
+// AccessLogSink is a destination for access log records. Log may be called concurrently.
+type AccessLogSink interface {
+	Log(record AccessLogRecord) error
+	Close() error
+}
+
+// NewAccessLogSink constructs the AccessLogSink selected by the AccessLogConfig Output.
+func NewAccessLogSink(conf *AccessLogConfig) (AccessLogSink, error) {
+	if conf.Sink != nil {
+		return conf.Sink, nil
+	}
+
+	switch conf.Output {
+	case "", AccessLogOutputStdout:
+		return &jsonAccessLogSink{writer: nopCloser{os.Stdout}}, nil
+	case AccessLogOutputFile:
+		maxSize, maxBackups := conf.MaxSize, conf.MaxBackups
+		if maxSize == 0 {
+			maxSize = defaultAccessLogMaxSize
+		}
+		if maxBackups == 0 {
+			maxBackups = defaultAccessLogMaxBackups
+		}
+		file, err := openRotatingFile(conf.Path, maxSize, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonAccessLogSink{writer: file}, nil
+	case AccessLogOutputSyslog:
+		tag := conf.SyslogTag
+		if tag == "" {
+			tag = defaultAccessLogSyslogTag
+		}
+		writer, err := dialSyslog(conf.SyslogNetwork, conf.SyslogAddress, tag)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonAccessLogSink{writer: writer}, nil
+	default:
+		return nil, fmt.Errorf("unknown access log output %q", conf.Output)
+	}
+}
+
+// jsonAccessLogSink writes each record as a single JSON document, terminated by a newline.
+type jsonAccessLogSink struct {
+	writer io.WriteCloser
+	mutex  sync.Mutex
+}
+
+func (s *jsonAccessLogSink) Log(record AccessLogRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	// Write each record in a single call, so that records are never interleaved and syslog gets one per message.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.writer.Write(b)
+
+	return err
+}
+
+func (s *jsonAccessLogSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.writer.Close()
+}
+
+// nopCloser wraps a writer that must not be closed, such as os.Stdout.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// rotatingFile is an append-only file that is renamed to path.1 once it would grow beyond maxSize, shifting older
+// files up and removing any beyond maxBackups. It is not safe for concurrent use.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	var rotateErr error
+	if r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		// If rotation fails, keep appending to the current file so that records are not lost, and retry next time.
+		if rotateErr = r.rotate(); rotateErr != nil {
+			rotateErr = fmt.Errorf("rotating %s: %w", r.path, rotateErr)
+		}
+	}
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+
+	return n, errors.Join(rotateErr, err)
+}
+
+// rotate shifts the current file and older backups up by one, and opens a new, empty file. The current file is only
+// closed once the new one is open, so it is still written to if any step fails.
+func (r *rotatingFile) rotate() error {
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(r.backupPath(i), r.backupPath(i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.backupPath(1)); err != nil {
+		return err
+	}
+
+	previous := r.file
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	return previous.Close()
+}
+
+func (r *rotatingFile) backupPath(n int) string {
+	return r.path + "." + strconv.Itoa(n)
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package tcpproxy
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to a syslog daemon, or the local one if network and address are empty. Records are sent with
+// the informational priority on the daemon facility.
+func dialSyslog(network string, address string, tag string) (io.WriteCloser, error) {
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package tcpproxy
+
+import (
+	"errors"
+	"io"
+)
+
+// dialSyslog is unsupported, as log/syslog is not available on this platform.
+func dialSyslog(string, string, string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog access log output is not supported on this platform")
+}
@@ -0,0 +1,215 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink is an AccessLogSink keeping records in memory.
+type recordingSink struct {
+	records chan AccessLogRecord
+	closed  bool
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{records: make(chan AccessLogRecord, 10)}
+}
+
+func (r *recordingSink) Log(record AccessLogRecord) error {
+	r.records <- record
+	return nil
+}
+
+func (r *recordingSink) Close() error {
+	r.closed = true
+	return nil
+}
+
+func Test_ProxyWritesAccessLog(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	sink := newRecordingSink()
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.AccessLogConfig = &AccessLogConfig{Sink: sink}
+	proxy := startTestProxy(t, config)
+
+	tlsConfig := clientTlsConfig(t, "user1")
+	tlsConfig.ServerName = "localhost"
+	conn, err := tls.Dial("tcp", proxy.Address(), tlsConfig)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	require.Len(t, proxy.Sessions("", ""), 1)
+	session := proxy.Sessions("", "")[0]
+	assert.Equal(t, 1, proxy.TerminateUserSessions("user1"))
+
+	select {
+	case record := <-sink.records:
+		assert.Equal(t, session.ID, record.SessionID)
+		assert.Equal(t, "user1", record.User)
+		assert.Equal(t, "engineering", record.Group)
+		assert.Equal(t, conn.LocalAddr().String(), record.ClientAddress)
+		assert.Equal(t, "localhost", record.SNI)
+		assert.Equal(t, "TLS 1.3", record.TLSVersion)
+		assert.NotEmpty(t, record.CipherSuite)
+		assert.Equal(t, echoSrv.listener.Addr().String(), record.Upstream)
+		assert.Equal(t, int64(12), record.BytesIn)
+		assert.Equal(t, int64(12), record.BytesOut)
+		assert.Equal(t, CloseReasonTerminated, record.CloseReason)
+		assert.Positive(t, record.Duration)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no access log record written")
+	}
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+	assert.True(t, sink.closed)
+}
+
+func Test_ProxyAccessLogsDialFailures(t *testing.T) {
+	// Reserve an address, then close it so that dialing it fails.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	target := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	sink := newRecordingSink()
+	config := testProxyConfig(t, target, "engineering")
+	config.AccessLogConfig = &AccessLogConfig{Sink: sink}
+	proxy := startTestProxy(t, config)
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+
+	select {
+	case record := <-sink.records:
+		assert.Equal(t, target, record.Upstream)
+		assert.Equal(t, CloseReasonDialFailed, record.CloseReason)
+		assert.NotEmpty(t, record.Error)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no access log record written")
+	}
+	// The failure is remembered for the readiness check.
+	assert.Error(t, config.LoadBalancer.FetchUpstreams()[0].DialError())
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+}
+
+func TestJSONAccessLogSink(t *testing.T) {
+	var builder strings.Builder
+	sink := &jsonAccessLogSink{writer: nopCloser{&builder}}
+
+	require.NoError(t, sink.Log(AccessLogRecord{SessionID: "abc", User: "user1", CloseReason: CloseReasonTerminated}))
+	require.NoError(t, sink.Log(AccessLogRecord{SessionID: "def", User: "user2"}))
+	require.NoError(t, sink.Close())
+
+	lines := strings.Split(strings.TrimSuffix(builder.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "abc", record["session_id"])
+	assert.Equal(t, "user1", record["user"])
+	assert.Equal(t, "terminated", record["close_reason"])
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := openRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err = file.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.NoError(t, file.Close())
+
+	// Each write would exceed 10 bytes, so every line is rotated into its own file and the oldest is dropped.
+	for name, expected := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		b, err := os.ReadFile(path + name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(b))
+	}
+	_, err = os.Stat(path + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Reopening appends to the existing file, taking its size into account.
+	file, err = openRotatingFile(path, 100, 2)
+	require.NoError(t, err)
+	_, err = file.Write([]byte("fifth\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "fourth\nfifth\n", string(b))
+}
+
+func TestRotatingFile_RotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := openRotatingFile(path, 10, 1)
+	require.NoError(t, err)
+	defer func() { _ = file.Close() }()
+	_, err = file.Write([]byte("first\n"))
+	require.NoError(t, err)
+
+	// A non-empty directory in place of the backup makes rotation fail, but the record is still written.
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o750))
+	n, err := file.Write([]byte("second\n"))
+	assert.ErrorContains(t, err, "rotating")
+	assert.Equal(t, len("second\n"), n)
+
+	// Once the obstacle is gone, rotation succeeds and writes carry on in a new file.
+	require.NoError(t, os.RemoveAll(path+".1"))
+	_, err = file.Write([]byte("third\n"))
+	require.NoError(t, err)
+	for name, expected := range map[string]string{"": "third\n", ".1": "first\nsecond\n"} {
+		b, err := os.ReadFile(path + name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(b))
+	}
+}
+
+func TestNewAccessLogSink_Syslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sink, err := NewAccessLogSink(&AccessLogConfig{
+		Output:        AccessLogOutputSyslog,
+		SyslogNetwork: "udp",
+		SyslogAddress: conn.LocalAddr().String(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, sink.Log(AccessLogRecord{SessionID: "abc"}))
+	require.NoError(t, sink.Close())
+
+	b := make([]byte, 1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(b)
+	require.NoError(t, err)
+	message := string(b[:n])
+	// LOG_INFO|LOG_DAEMON is priority 30.
+	assert.True(t, strings.HasPrefix(message, "<30>"), message)
+	assert.Contains(t, message, "tcp-proxy")
+	assert.Contains(t, message, `"session_id":"abc"`)
+}
+
+func TestAccessLogConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&AccessLogConfig{}).validate())
+	assert.NoError(t, (&AccessLogConfig{Output: AccessLogOutputFile, Path: "access.log"}).validate())
+	assert.Error(t, (&AccessLogConfig{Output: AccessLogOutputFile}).validate())
+	assert.Error(t, (&AccessLogConfig{Output: "kafka"}).validate())
+	assert.Error(t, (&AccessLogConfig{MaxBackups: -1}).validate())
+}
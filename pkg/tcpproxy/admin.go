@@ -0,0 +1,449 @@
+package tcpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// adminReadHeaderTimeout bounds how long the admin listener waits for request headers.
+const adminReadHeaderTimeout = 5 * time.Second
+
+// adminServer serves the admin HTTP API on listeners separate from the proxied traffic: a TCP listener requiring
+// mTLS, and optionally a local Unix socket protected by file permissions.
+type adminServer struct {
+	proxy            *Proxy
+	authorizedGroups []string
+	listener         net.Listener
+	socketListener   net.Listener
+	server           *http.Server
+	mux              *http.ServeMux
+	tlsConfig        atomic.Pointer[tls.Config]
+}
+
+// adminSocketKey marks requests received over the admin Unix socket in their context.
+type adminSocketKey struct{}
+
+// newAdminServer starts listening on the configured admin addresses. Requests are only served once serve is called.
+func newAdminServer(proxy *Proxy, conf *Config) (*adminServer, error) {
+	a := &adminServer{
+		proxy:            proxy,
+		authorizedGroups: conf.AdminConfig.AuthorizedGroups,
+		mux:              http.NewServeMux(),
+	}
+
+	var err error
+	if conf.AdminConfig.ListenerAddr != "" {
+		if err = a.loadTLSConfig(conf); err != nil {
+			return nil, err
+		}
+		// Resolve the TLS configuration per connection, so that Reload applies to the admin listener too.
+		tlsConfig := &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return a.tlsConfig.Load(), nil
+			},
+		}
+		if a.listener, err = tls.Listen("tcp", conf.AdminConfig.ListenerAddr, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.AdminConfig.SocketPath != "" {
+		if a.socketListener, err = listenAdminSocket(conf.AdminConfig.SocketPath); err != nil {
+			if a.listener != nil {
+				_ = a.listener.Close()
+			}
+			return nil, err
+		}
+	}
+
+	a.registerRoutes()
+	a.server = &http.Server{
+		Handler:           a.authorize(a.mux),
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+		ErrorLog:          slog.NewLogLogger(proxy.logger.Handler(), slog.LevelWarn),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if _, ok := c.(*net.UnixConn); ok {
+				return context.WithValue(ctx, adminSocketKey{}, true)
+			}
+			return ctx
+		},
+	}
+
+	return a, nil
+}
+
+// listenAdminSocket listens on a Unix socket only accessible to the owner of the proxy process. A stale socket
+// left behind by a previous process is replaced.
+func listenAdminSocket(path string) (net.Listener, error) {
+	return listenPrivateUnix(path, func(path string) error {
+		return os.Chmod(path, 0o600)
+	})
+}
+
+func (a *adminServer) registerRoutes() {
+	a.mux.HandleFunc("/status", a.handleStatus)
+	a.mux.HandleFunc("/config", a.handleConfig)
+	a.mux.HandleFunc("/reload", a.handleReload)
+	a.mux.HandleFunc("/sessions", a.handleSessions)
+	a.mux.HandleFunc("/sessions/", a.handleSession)
+	a.mux.HandleFunc("/upstreams", a.handleUpstreams)
+	a.mux.HandleFunc("/upstreams/", a.handleUpstream)
+	a.mux.HandleFunc("/ratelimits/", a.handleRateLimit)
+	a.mux.HandleFunc("/drain", a.handleDrain)
+	a.mux.HandleFunc("/captures", a.handleCaptures)
+	a.mux.HandleFunc("/captures/", a.handleCapture)
+	a.mux.HandleFunc("/udp/flows", a.handleUDPFlows)
+	registerHealthRoutes(a.mux, a.proxy)
+	a.registerDebugRoutes()
+}
+
+// loadTLSConfig loads the admin listener's TLS material and swaps it in for new connections.
+func (a *adminServer) loadTLSConfig(conf *Config) error {
+	if conf.AdminConfig.ListenerAddr == "" {
+		return nil
+	}
+	tlsConfig, err := conf.AdminTLSConfig()
+	if err != nil {
+		return err
+	}
+	a.tlsConfig.Store(tlsConfig)
+
+	return nil
+}
+
+// serve serves the admin API on all listeners until close is called.
+func (a *adminServer) serve() {
+	for _, listener := range []net.Listener{a.listener, a.socketListener} {
+		if listener == nil {
+			continue
+		}
+		go func(listener net.Listener) {
+			if err := a.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				a.proxy.logger.Error("admin server stopped", slog.String("error", err.Error()))
+			}
+		}(listener)
+	}
+}
+
+// close stops the admin API. Listeners that were never served are closed directly.
+func (a *adminServer) close() error {
+	err := a.server.Close()
+	for _, listener := range []net.Listener{a.listener, a.socketListener} {
+		if listener != nil {
+			_ = listener.Close()
+		}
+	}
+
+	return err
+}
+
+// address returns the address the admin API is listening on, preferring the TCP listener.
+func (a *adminServer) address() string {
+	if a.listener != nil {
+		return a.listener.Addr().String()
+	}
+
+	return a.socketListener.Addr().String()
+}
+
+// authorize only allows clients whose certificate group is in the admin AuthorizedGroups. Requests over the Unix
+// socket are trusted, as access to it is restricted by file permissions.
+func (a *adminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(adminSocketKey{}) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			writeJSONError(w, http.StatusUnauthorized, "client certificate required")
+			return
+		}
+		_, group, ok := identityFromCertificate(r.TLS.PeerCertificates[0])
+		if !ok || !slices.Contains(a.authorizedGroups, group) {
+			writeJSONError(w, http.StatusForbidden, "not authorized for the admin API")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleSessions lists sessions with GET, or terminates all sessions of a user with DELETE. Both accept the
+// "user" query parameter, and GET also accepts "upstream".
+func (a *adminServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.proxy.Sessions(user, r.URL.Query().Get("upstream")))
+	case http.MethodDelete:
+		if user == "" {
+			writeJSONError(w, http.StatusBadRequest, "user is required to terminate sessions")
+			return
+		}
+		terminated := a.proxy.TerminateUserSessions(user)
+		writeJSON(w, http.StatusOK, map[string]int{"terminated": terminated})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleSession terminates a single session with DELETE /sessions/{id}.
+func (a *adminServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if err := a.proxy.TerminateSession(id); err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"terminated": 1})
+}
+
+// handleStatus reports the state of the proxy with GET /status.
+func (a *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.Status())
+}
+
+// handleConfig dumps the effective configuration with GET /config.
+func (a *adminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.EffectiveConfig())
+}
+
+// handleReload reloads TLS material with POST /reload.
+func (a *adminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := a.proxy.Reload(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+// handleDrain marks the proxy as not ready with POST /drain, so traffic shifts away before it is closed.
+func (a *adminServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	a.proxy.Drain()
+	writeJSON(w, http.StatusOK, map[string]bool{"draining": true})
+}
+
+// handleUpstreams lists upstreams with GET /upstreams, adds one with POST /upstreams?address=&weight=, or removes
+// one with DELETE /upstreams?address=. The weight defaults to 1.
+func (a *adminServer) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.proxy.Upstreams())
+	case http.MethodPost:
+		weight, err := weightFromQuery(r, 1)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err = a.proxy.loadBalancer.AddUpstream(r.URL.Query().Get("address"), weight); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"added": true})
+	case http.MethodDelete:
+		if err := a.proxy.loadBalancer.RemoveUpstream(r.URL.Query().Get("address")); err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"removed": true})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleUpstream changes how new connections are routed to a single upstream with
+// POST /upstreams/drain?address=, /upstreams/undrain?address= and /upstreams/weight?address=&weight=. The address is
+// a query parameter rather than part of the path, as paths are cleaned, which would mangle unix:// addresses.
+func (a *adminServer) handleUpstream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	address := r.URL.Query().Get("address")
+	action := strings.TrimPrefix(r.URL.Path, "/upstreams/")
+	var err error
+	switch action {
+	case "drain":
+		err = a.proxy.loadBalancer.Drain(address)
+	case "undrain":
+		err = a.proxy.loadBalancer.Undrain(address)
+	case "weight":
+		var weight int
+		if weight, err = weightFromQuery(r, 0); err != nil || weight == 0 {
+			writeJSONError(w, http.StatusBadRequest, "a weight of at least 1 is required")
+			return
+		}
+		if err = a.proxy.loadBalancer.SetWeight(address, weight); err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"weight": weight})
+		return
+	default:
+		writeJSONError(w, http.StatusNotFound, "unknown upstream action")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"draining": action == "drain"})
+}
+
+// handleCaptures lists captures with GET /captures, or starts one with
+// POST /captures?user=&group=&upstream=&max_bytes=&duration=. Omitted filters match every session, and omitted
+// limits use the configured defaults.
+func (a *adminServer) handleCaptures(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.proxy.Captures())
+	case http.MethodPost:
+		query := r.URL.Query()
+		var maxBytes int64
+		var duration time.Duration
+		var err error
+		if value := query.Get("max_bytes"); value != "" {
+			if maxBytes, err = strconv.ParseInt(value, 10, 64); err != nil || maxBytes < 1 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid max_bytes %q", value))
+				return
+			}
+		}
+		if value := query.Get("duration"); value != "" {
+			if duration, err = time.ParseDuration(value); err != nil || duration <= 0 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid duration %q", value))
+				return
+			}
+		}
+
+		filter := CaptureFilter{User: query.Get("user"), Group: query.Get("group"), Upstream: query.Get("upstream")}
+		info, err := a.proxy.StartCapture(filter, maxBytes, duration)
+		if errors.Is(err, ErrCapturesNotConfigured) {
+			writeJSONError(w, http.StatusNotImplemented, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleCapture stops a capture with DELETE /captures/{id}. Its file is kept.
+func (a *adminServer) handleCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	info, err := a.proxy.StopCapture(strings.TrimPrefix(r.URL.Path, "/captures/"))
+	switch {
+	case errors.Is(err, ErrCapturesNotConfigured):
+		writeJSONError(w, http.StatusNotImplemented, err.Error())
+	case err != nil:
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+// handleUDPFlows lists UDP flows with GET /udp/flows.
+func (a *adminServer) handleUDPFlows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.UDPFlows())
+}
+
+// weightFromQuery parses the "weight" query parameter, returning fallback if it is absent.
+func weightFromQuery(r *http.Request, fallback int) (int, error) {
+	value := r.URL.Query().Get("weight")
+	if value == "" {
+		return fallback, nil
+	}
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < 1 {
+		return 0, fmt.Errorf("invalid weight %q", value)
+	}
+
+	return weight, nil
+}
+
+// handleRateLimit shows a client's rate limit with GET /ratelimits/{client}, or resets it with DELETE.
+func (a *adminServer) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	manager, ok := a.proxy.rateLimitStore.(*RateLimitManager)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, "not supported by the configured rate limit store")
+		return
+	}
+	client := strings.TrimPrefix(r.URL.Path, "/ratelimits/")
+	if client == "" {
+		writeJSONError(w, http.StatusBadRequest, "client is required")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		state, _ := manager.State(client)
+		writeJSON(w, http.StatusOK, state)
+	case http.MethodDelete:
+		writeJSON(w, http.StatusOK, map[string]bool{"reset": manager.Reset(client)})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// AdminAddress returns the address the admin API is serving on, or an empty string if it is not configured.
+func (p *Proxy) AdminAddress() string {
+	if p.admin == nil {
+		return ""
+	}
+
+	return p.admin.address()
+}
@@ -0,0 +1,244 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAdminServer returns an adminServer without a listener, for exercising its handlers directly.
+func newTestAdminServer() (*adminServer, *Proxy) {
+	loadBalancer, _ := NewLeastConnectionBalancer([]string{"10.0.0.1:80", "10.0.0.2:80"})
+	proxy := &Proxy{
+		loadBalancer:   loadBalancer,
+		pool:           &upstreamPool{loadBalancer: loadBalancer},
+		logger:         slog.Default(),
+		rateLimitStore: NewRateLimitManager(2, time.Minute, slog.Default()),
+		sessions:       newSessionRegistry(),
+	}
+	a := &adminServer{proxy: proxy, authorizedGroups: []string{"administrators"}, mux: http.NewServeMux()}
+	a.registerRoutes()
+
+	return a, proxy
+}
+
+// adminRequest performs a request against the admin API as a client with the given certificate CN.
+func adminRequest(a *adminServer, method string, target string, cn string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}},
+	}
+	recorder := httptest.NewRecorder()
+	a.authorize(a.mux).ServeHTTP(recorder, req)
+
+	return recorder
+}
+
+func TestAdminServer_RequiresAdminGroup(t *testing.T) {
+	a, _ := newTestAdminServer()
+
+	assert.Equal(t, http.StatusForbidden, adminRequest(a, http.MethodGet, "/sessions", "user1@engineering").Code)
+	assert.Equal(t, http.StatusOK, adminRequest(a, http.MethodGet, "/sessions", "user2@administrators").Code)
+
+	recorder := httptest.NewRecorder()
+	a.authorize(a.mux).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestAdminServer_Sessions(t *testing.T) {
+	a, proxy := newTestAdminServer()
+
+	for _, user := range []string{"user1", "user1", "user3"} {
+		clientConn, _ := net.Pipe()
+		targetConn, _ := net.Pipe()
+		proxy.sessions.add(newSession(newSessionID(), user, "engineering", clientConn, targetConn, "10.0.0.1:80"))
+	}
+
+	recorder := adminRequest(a, http.MethodGet, "/sessions?user=user1", "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var sessions []SessionInfo
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 2)
+	assert.Equal(t, "user1", sessions[0].User)
+
+	recorder = adminRequest(a, http.MethodDelete, "/sessions/"+sessions[0].ID, "admin@administrators")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	recorder = adminRequest(a, http.MethodDelete, "/sessions/missing", "admin@administrators")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = adminRequest(a, http.MethodDelete, "/sessions?user=user1", "admin@administrators")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"terminated": 2}`, recorder.Body.String())
+
+	recorder = adminRequest(a, http.MethodDelete, "/sessions", "admin@administrators")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func Test_AdminAPIListsLiveSessions(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.AdminConfig = &AdminConfig{ListenerAddr: "127.0.0.1:0", AuthorizedGroups: []string{"administrators"}}
+	proxy := startTestProxy(t, config)
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTlsConfig(t, "user2")}}
+	resp, err := client.Get("https://" + proxy.AdminAddress() + "/sessions")
+	require.NoError(t, err)
+	var sessions []SessionInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&sessions))
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "user1", sessions[0].User)
+	assert.Equal(t, "engineering", sessions[0].Group)
+	assert.Equal(t, int64(12), sessions[0].BytesIn)
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
+
+func TestAdminServer_Upstreams(t *testing.T) {
+	a, proxy := newTestAdminServer()
+
+	recorder := adminRequest(a, http.MethodPost, "/upstreams/drain?address=10.0.0.1:80", "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, proxy.loadBalancer.FetchUpstreams()[0].Draining())
+
+	var upstreams []UpstreamStatus
+	recorder = adminRequest(a, http.MethodGet, "/upstreams", "admin@administrators")
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &upstreams))
+	assert.Equal(t, []UpstreamStatus{
+		{Address: "10.0.0.1:80", Weight: 1, Draining: true},
+		{Address: "10.0.0.2:80", Weight: 1},
+	}, upstreams)
+
+	recorder = adminRequest(a, http.MethodPost, "/upstreams/undrain?address=10.0.0.1:80", "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.False(t, proxy.loadBalancer.FetchUpstreams()[0].Draining())
+
+	recorder = adminRequest(a, http.MethodPost, "/upstreams/drain?address=10.0.0.9:80", "admin@administrators")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	recorder = adminRequest(a, http.MethodPost, "/upstreams/explode?address=10.0.0.1:80", "admin@administrators")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestAdminServer_ManagesUpstreams(t *testing.T) {
+	a, proxy := newTestAdminServer()
+
+	recorder := adminRequest(a, http.MethodPost, "/upstreams?address=10.0.0.3:80&weight=3", "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	recorder = adminRequest(a, http.MethodPost, "/upstreams?address=10.0.0.3:80", "admin@administrators")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = adminRequest(a, http.MethodPost, "/upstreams/weight?address=10.0.0.2:80&weight=2", "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	recorder = adminRequest(a, http.MethodPost, "/upstreams/weight?address=10.0.0.2:80&weight=0", "admin@administrators")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = adminRequest(a, http.MethodDelete, "/upstreams?address=10.0.0.1:80", "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	recorder = adminRequest(a, http.MethodDelete, "/upstreams?address=10.0.0.1:80", "admin@administrators")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	assert.Equal(t, []UpstreamStatus{
+		{Address: "10.0.0.2:80", Weight: 2},
+		{Address: "10.0.0.3:80", Weight: 3},
+	}, proxy.Upstreams())
+}
+
+func TestAdminServer_ManagesUnixUpstreams(t *testing.T) {
+	a, proxy := newTestAdminServer()
+	query := url.Values{"address": []string{"unix:///run/app.sock"}}
+
+	recorder := adminRequest(a, http.MethodPost, "/upstreams?"+query.Encode(), "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	recorder = adminRequest(a, http.MethodPost, "/upstreams/drain?"+query.Encode(), "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, proxy.loadBalancer.FetchUpstreams()[2].Draining())
+
+	query.Set("weight", "4")
+	recorder = adminRequest(a, http.MethodPost, "/upstreams/weight?"+query.Encode(), "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []UpstreamStatus{
+		{Address: "10.0.0.1:80", Weight: 1},
+		{Address: "10.0.0.2:80", Weight: 1},
+		{Address: "unix:///run/app.sock", Weight: 4, Draining: true},
+	}, proxy.Upstreams())
+
+	query.Del("weight")
+	recorder = adminRequest(a, http.MethodDelete, "/upstreams?"+query.Encode(), "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, proxy.Upstreams(), 2)
+}
+
+func TestAdminServer_RateLimits(t *testing.T) {
+	a, proxy := newTestAdminServer()
+	allowed, _ := proxy.rateLimitStore.ConnectionAllowed("user1")
+	require.True(t, allowed)
+
+	var state RateLimitState
+	recorder := adminRequest(a, http.MethodGet, "/ratelimits/user1", "admin@administrators")
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &state))
+	assert.Equal(t, RateLimitState{Client: "user1", Algorithm: RateLimitAlgorithmTokenBucket, Capacity: 2, Remaining: 1}, state)
+
+	recorder = adminRequest(a, http.MethodDelete, "/ratelimits/user1", "admin@administrators")
+	assert.JSONEq(t, `{"reset": true}`, recorder.Body.String())
+	recorder = adminRequest(a, http.MethodGet, "/ratelimits/user1", "admin@administrators")
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &state))
+	assert.Equal(t, 2, state.Remaining)
+}
+
+func Test_AdminAPIOverUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "admin.sock")
+	config := testProxyConfig(t, "localhost:0", "engineering")
+	config.AdminConfig = &AdminConfig{SocketPath: socketPath}
+	proxy := startTestProxy(t, config)
+	assert.Equal(t, socketPath, proxy.AdminAddress())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://proxy/status")
+	require.NoError(t, err)
+	var status ProxyStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, proxy.Address(), status.Address)
+	assert.Len(t, status.Upstreams, 1)
+
+	resp, err = client.Post("http://proxy/reload", "application/json", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = client.Get("http://proxy/config")
+	require.NoError(t, err)
+	var effective map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&effective))
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "*tcpproxy.RateLimitManager", effective["rate_limit_store"])
+
+	assert.NoError(t, proxy.Close())
+}
@@ -0,0 +1,429 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditGenesisHash is the previous hash of the first entry in an audit log.
+var auditGenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// AuditDecision is the outcome of authorizing a connection.
+type AuditDecision string
+
+const (
+	// AuditDecisionAllowed is recorded when a connection is authorized.
+	AuditDecisionAllowed AuditDecision = "allowed"
+	// AuditDecisionDeniedIdentity is recorded when the certificate CN is not in the format "user@group".
+	AuditDecisionDeniedIdentity AuditDecision = "denied_identity"
+	// AuditDecisionDeniedGroup is recorded when the client's group is not in the AuthorizedGroups.
+	AuditDecisionDeniedGroup AuditDecision = "denied_group"
+	// AuditDecisionDeniedRateLimit is recorded when the client has exceeded its rate limit.
+	AuditDecisionDeniedRateLimit AuditDecision = "denied_rate_limit"
+	// AuditDecisionDeniedSource is recorded when a passthrough client is not in the route's AllowedSources.
+	AuditDecisionDeniedSource AuditDecision = "denied_source"
+	// AuditDecisionDeniedObserver is recorded when the Observer refused the connection in OnAuthorize.
+	AuditDecisionDeniedObserver AuditDecision = "denied_observer"
+	// AuditDecisionHandshakeFailure is recorded when the TLS handshake fails, for example because the client
+	// certificate was not signed by the CA.
+	AuditDecisionHandshakeFailure AuditDecision = "handshake_failure"
+)
+
+// AuditLogConfig is the configuration for the audit log, an append-only record of every authorization decision.
+type AuditLogConfig struct {
+	// Path is the file entries are appended to. The hash of the latest entry is kept next to it, in Path.head, so
+	// that truncation can be detected.
+	Path string
+}
+
+// AuditEntry is a single authorization decision. Each entry includes the hash of the previous entry, so that
+// modifying or removing an entry breaks the chain.
+type AuditEntry struct {
+	Sequence      uint64        `json:"seq"`
+	Time          time.Time     `json:"time"`
+	Decision      AuditDecision `json:"decision"`
+	User          string        `json:"user,omitempty"`
+	Group         string        `json:"group,omitempty"`
+	ClientAddress string        `json:"client_address"`
+	// CertificateSerial is the client certificate's serial number in hex.
+	CertificateSerial string `json:"certificate_serial,omitempty"`
+	// CertificateFingerprint is the SHA-256 of the client certificate in hex.
+	CertificateFingerprint string `json:"certificate_fingerprint,omitempty"`
+	Error                  string `json:"error,omitempty"`
+	PrevHash               string `json:"prev_hash"`
+	Hash                   string `json:"hash"`
+}
+
+// computeHash returns the SHA-256 of the entry's JSON encoding with an empty Hash, in hex.
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditHead is the latest entry of an audit log, stored in the head file.
+type auditHead struct {
+	Sequence uint64 `json:"seq"`
+	Hash     string `json:"hash"`
+}
+
+const (
+	// auditLogQueueSize is how many entries may wait for the audit log writer before recording blocks.
+	auditLogQueueSize = 1024
+	// auditLogMaxBatch is the most entries written to disk with a single sync.
+	auditLogMaxBatch = 256
+)
+
+// auditFile is the file an audit log is appended to.
+type auditFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+// auditLog appends hash-chained entries to a file. Entries are queued for a writer goroutine, which writes them in
+// batches with a single sync, and updates the head file once per batch, so that recording does not wait on disk.
+type auditLog struct {
+	path   string
+	file   auditFile
+	size   int64
+	next   uint64
+	hash   string
+	logger *slog.Logger
+	// failed is set once a batch could not be written or undone, after which no more entries are accepted, so that
+	// nothing is appended after a partial entry.
+	failed error
+
+	entries chan AuditEntry
+	done    chan struct{}
+	closed  bool
+	mutex   sync.RWMutex
+}
+
+// openAuditLog opens an audit log for appending. An existing log must pass verification, so that new entries never
+// extend a chain that has already been tampered with. Errors writing entries are logged to logger.
+func openAuditLog(path string, logger *slog.Logger) (*auditLog, error) {
+	a := &auditLog{
+		path:    path,
+		hash:    auditGenesisHash,
+		logger:  logger,
+		entries: make(chan AuditEntry, auditLogQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		entries, head, err := verifyAuditLog(path)
+		if err != nil {
+			return nil, fmt.Errorf("audit log %s failed verification: %w", path, err)
+		}
+		if entries > 0 {
+			a.next, a.hash = head.Sequence+1, head.Hash
+			// The head file may be behind the log if the proxy stopped before updating it, so roll it forward.
+			if err = a.writeHead(head); err != nil {
+				return nil, err
+			}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	a.file, a.size = file, info.Size()
+	go a.write()
+
+	return a, nil
+}
+
+// record queues an entry to be appended, stamped with the current time. Its sequence and hashes are filled in when
+// it is written. It only blocks if the queue is full.
+func (a *auditLog) record(entry AuditEntry) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.closed {
+		return errors.New("audit log is closed")
+	}
+	if a.failed != nil {
+		return fmt.Errorf("audit log has failed: %w", a.failed)
+	}
+
+	entry.Time = time.Now().UTC()
+	a.entries <- entry
+
+	return nil
+}
+
+// write appends queued entries until the queue is closed, taking all that are waiting, up to auditLogMaxBatch, at a
+// time.
+func (a *auditLog) write() {
+	defer close(a.done)
+
+	batch := make([]AuditEntry, 0, auditLogMaxBatch)
+	for entry := range a.entries {
+		batch = append(batch[:0], entry)
+	fill:
+		for len(batch) < auditLogMaxBatch {
+			select {
+			case entry, ok := <-a.entries:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, entry)
+			default:
+				break fill
+			}
+		}
+
+		if err := a.writeBatch(batch); err != nil {
+			a.logger.Error("writing audit log, entries were lost", slog.String("error", err.Error()),
+				slog.Int("entries", len(batch)))
+		}
+	}
+}
+
+// writeBatch chains entries onto the log, syncs them to disk and then updates the head file. The chain only
+// advances once the entries are synced. If writing fails, the log is truncated back to before the batch, and if
+// that fails too, the log is marked as failed.
+func (a *auditLog) writeBatch(entries []AuditEntry) error {
+	a.mutex.RLock()
+	failed := a.failed
+	a.mutex.RUnlock()
+	if failed != nil {
+		return fmt.Errorf("audit log has failed: %w", failed)
+	}
+
+	next, hash := a.next, a.hash
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		entry.Sequence = next
+		entry.PrevHash = hash
+		entryHash, err := entry.computeHash()
+		if err != nil {
+			return err
+		}
+		entry.Hash = entryHash
+
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buffer.Write(append(b, '\n'))
+		next, hash = entry.Sequence+1, entry.Hash
+	}
+
+	_, err := a.file.Write(buffer.Bytes())
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		if truncateErr := a.file.Truncate(a.size); truncateErr != nil {
+			err = errors.Join(err, fmt.Errorf("undoing partial write: %w", truncateErr))
+			a.mutex.Lock()
+			a.failed = err
+			a.mutex.Unlock()
+		}
+		return err
+	}
+	a.size += int64(buffer.Len())
+	a.next, a.hash = next, hash
+
+	return a.writeHead(auditHead{Sequence: next - 1, Hash: hash})
+}
+
+// writeHead records the latest entry of the log in the head file.
+func (a *auditLog) writeHead(head auditHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(a.headPath(), data)
+}
+
+func (a *auditLog) headPath() string {
+	return a.path + ".head"
+}
+
+// close writes any queued entries, then closes the file.
+func (a *auditLog) close() error {
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return errors.New("audit log is already closed")
+	}
+	a.closed = true
+	close(a.entries)
+	a.mutex.Unlock()
+
+	<-a.done
+
+	return a.file.Close()
+}
+
+// VerifyAuditLog checks that every entry of the audit log at path is intact and chained to the previous one, and
+// that the log has not been truncated, returning the number of entries verified.
+func VerifyAuditLog(path string) (int, error) {
+	entries, _, err := verifyAuditLog(path)
+
+	return entries, err
+}
+
+func verifyAuditLog(path string) (int, auditHead, error) {
+	// Entries can be removed from the end without breaking the chain, so the log is compared against the head
+	// file too. The log may be up to a batch of entries ahead of the head, or have no head file yet, if the proxy
+	// stopped between syncing a batch and updating the head.
+	var head *auditHead
+	data, err := os.ReadFile(path + ".head")
+	if err == nil {
+		head = &auditHead{}
+		if err = json.Unmarshal(data, head); err != nil {
+			return 0, auditHead{}, fmt.Errorf("head file is malformed: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return 0, auditHead{}, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, auditHead{}, err
+	}
+	defer file.Close()
+
+	last := auditHead{Hash: auditGenesisHash}
+	entries := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&entry); err != nil {
+			return entries, last, fmt.Errorf("entry %d is malformed: %w", entries, err)
+		}
+
+		if entry.Sequence != uint64(entries) {
+			return entries, last, fmt.Errorf("entry %d has sequence %d, entries are missing", entries, entry.Sequence)
+		}
+		if entry.PrevHash != last.Hash {
+			return entries, last, fmt.Errorf("entry %d is not chained to the previous entry", entries)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return entries, last, err
+		}
+		if hash != entry.Hash {
+			return entries, last, fmt.Errorf("entry %d has been modified", entries)
+		}
+		if head != nil && head.Sequence == entry.Sequence && head.Hash != entry.Hash {
+			return entries, last, fmt.Errorf("entry %d does not match the head file", entries)
+		}
+
+		last = auditHead{Sequence: entry.Sequence, Hash: entry.Hash}
+		entries++
+	}
+	if err = scanner.Err(); err != nil {
+		return entries, last, err
+	}
+
+	switch {
+	case head == nil && entries > auditLogMaxBatch:
+		return entries, last, errors.New("head file is missing")
+	case head != nil && (entries == 0 || head.Sequence > last.Sequence):
+		return entries, last, fmt.Errorf("log ends before entry %d recorded in the head file, it has been truncated",
+			head.Sequence)
+	case head != nil && last.Sequence > head.Sequence+auditLogMaxBatch:
+		return entries, last, fmt.Errorf("log continues past entry %d recorded in the head file", head.Sequence)
+	}
+
+	return entries, last, nil
+}
+
+// certificateFingerprint returns the serial number and SHA-256 fingerprint of a certificate in hex.
+func certificateFingerprint(cert *x509.Certificate) (serial string, fingerprint string) {
+	sum := sha256.Sum256(cert.Raw)
+
+	return cert.SerialNumber.Text(16), hex.EncodeToString(sum[:])
+}
+
+// auditDecision records an authorization decision for conn in the audit log, if one is configured. err describes
+// a handshake failure.
+func (p *Proxy) auditDecision(conn net.Conn, decision AuditDecision, user string, group string, err error) {
+	if p.auditLog == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Decision:      decision,
+		User:          user,
+		Group:         group,
+		ClientAddress: conn.RemoteAddr().String(),
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			entry.CertificateSerial, entry.CertificateFingerprint = certificateFingerprint(certs[0])
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if err = p.auditLog.record(entry); err != nil {
+		p.logger.Error("writing audit log", slog.String("error", err.Error()))
+	}
+}
+
+// auditHandshakeFailure records a failed handshake in the audit log. Clients refused by verifyConnection are
+// recorded with the decision for their RejectionReason, rather than as a handshake failure.
+func (p *Proxy) auditHandshakeFailure(conn *tls.Conn, err error) {
+	var rejection *rejectionError
+	if errors.As(err, &rejection) {
+		p.auditDecision(conn, auditDecisionFor(rejection.reason), rejection.user, rejection.group, nil)
+		return
+	}
+
+	p.auditDecision(conn, AuditDecisionHandshakeFailure, "", "", err)
+}
+
+// auditDecisionFor maps the outcome of connectionAuthorized to an AuditDecision.
+func auditDecisionFor(reason RejectionReason) AuditDecision {
+	switch reason {
+	case "":
+		return AuditDecisionAllowed
+	case RejectionReasonInvalidIdentity:
+		return AuditDecisionDeniedIdentity
+	case RejectionReasonUnauthorized:
+		return AuditDecisionDeniedGroup
+	case RejectionReasonVetoed:
+		return AuditDecisionDeniedObserver
+	case RejectionReasonSourceNotAllowed:
+		return AuditDecisionDeniedSource
+	default:
+		return AuditDecisionDeniedRateLimit
+	}
+}
@@ -0,0 +1,332 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeAuditLog records one entry per user to a new audit log, returning its path.
+func writeAuditLog(t *testing.T, users ...string) string {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := openAuditLog(path, slog.Default())
+	require.NoError(t, err)
+	for _, user := range users {
+		require.NoError(t, log.record(AuditEntry{Decision: AuditDecisionAllowed, User: user, ClientAddress: "10.0.0.1:1234"}))
+	}
+	require.NoError(t, log.close())
+
+	return path
+}
+
+// auditLogLines returns the lines of the audit log at path.
+func auditLogLines(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	return strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func writeAuditLogLines(t *testing.T, path string, lines []string) {
+	content := strings.Join(lines, "")
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestAuditLog_Verify(t *testing.T) {
+	path := writeAuditLog(t, "user1", "user2", "user3")
+
+	entries, err := VerifyAuditLog(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, entries)
+
+	// Reopening continues the existing chain.
+	log, err := openAuditLog(path, slog.Default())
+	require.NoError(t, err)
+	require.NoError(t, log.record(AuditEntry{Decision: AuditDecisionDeniedGroup, User: "user4"}))
+	require.NoError(t, log.close())
+	entries, err = VerifyAuditLog(path)
+	require.NoError(t, err)
+	assert.Equal(t, 4, entries)
+
+	// An empty log is valid.
+	entries, err = VerifyAuditLog(writeAuditLog(t))
+	require.NoError(t, err)
+	assert.Equal(t, 0, entries)
+}
+
+func TestAuditLog_DetectsTampering(t *testing.T) {
+	tests := map[string]struct {
+		tamper   func(lines []string) []string
+		expected string
+	}{
+		"modified entry": {
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `"user":"user2"`, `"user":"admin"`, 1)
+				return lines
+			},
+			expected: "entry 1 has been modified",
+		},
+		"removed entry": {
+			tamper: func(lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			expected: "entries are missing",
+		},
+		"removed first entry": {
+			tamper: func(lines []string) []string {
+				return lines[1:]
+			},
+			expected: "entries are missing",
+		},
+		"truncated": {
+			tamper: func(lines []string) []string {
+				return lines[:2]
+			},
+			expected: "truncated",
+		},
+		"reordered": {
+			tamper: func(lines []string) []string {
+				lines[0], lines[1] = lines[1], lines[0]
+				return lines
+			},
+			expected: "entries are missing",
+		},
+		"partial entry": {
+			tamper: func(lines []string) []string {
+				lines[2] = lines[2][:20]
+				return lines
+			},
+			expected: "entry 2 is malformed",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := writeAuditLog(t, "user1", "user2", "user3")
+			writeAuditLogLines(t, path, test.tamper(auditLogLines(t, path)))
+
+			_, err := VerifyAuditLog(path)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.expected)
+
+			// New entries are never appended to a tampered log.
+			_, err = openAuditLog(path, slog.Default())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAuditLog_DetectsMissingHead(t *testing.T) {
+	// More entries than a single batch could have written before the head file is created.
+	users := make([]string, auditLogMaxBatch+1)
+	for i := range users {
+		users[i] = fmt.Sprintf("user%d", i)
+	}
+	path := writeAuditLog(t, users...)
+	require.NoError(t, os.Remove(path+".head"))
+
+	_, err := VerifyAuditLog(path)
+	assert.ErrorContains(t, err, "head file is missing")
+}
+
+func TestAuditLog_RecoversHeadBehindLog(t *testing.T) {
+	tests := map[string]func(t *testing.T, path string, head []byte){
+		// The proxy stopped after syncing the first batch, before the head file was created.
+		"missing head": func(t *testing.T, path string, _ []byte) {
+			require.NoError(t, os.Remove(path+".head"))
+		},
+		// The proxy stopped after syncing a later batch, before the head file was updated.
+		"stale head": func(t *testing.T, path string, head []byte) {
+			require.NoError(t, os.WriteFile(path+".head", head, 0o600))
+		},
+	}
+
+	for name, rollBack := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := writeAuditLog(t, "user1")
+			head, err := os.ReadFile(path + ".head")
+			require.NoError(t, err)
+
+			log, err := openAuditLog(path, slog.Default())
+			require.NoError(t, err)
+			require.NoError(t, log.writeBatch([]AuditEntry{
+				{Decision: AuditDecisionAllowed, User: "user2"},
+				{Decision: AuditDecisionAllowed, User: "user3"},
+				{Decision: AuditDecisionAllowed, User: "user4"},
+			}))
+			require.NoError(t, log.close())
+			rollBack(t, path, head)
+
+			entries, err := VerifyAuditLog(path)
+			require.NoError(t, err)
+			assert.Equal(t, 4, entries)
+
+			// Reopening rolls the head file forward and continues the chain.
+			log, err = openAuditLog(path, slog.Default())
+			require.NoError(t, err)
+			require.NoError(t, log.record(AuditEntry{Decision: AuditDecisionAllowed, User: "user5"}))
+			require.NoError(t, log.close())
+
+			var recorded auditHead
+			data, err := os.ReadFile(path + ".head")
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(data, &recorded))
+			assert.Equal(t, uint64(4), recorded.Sequence)
+			entries, err = VerifyAuditLog(path)
+			require.NoError(t, err)
+			assert.Equal(t, 5, entries)
+		})
+	}
+}
+
+// failingAuditFile writes part of each write to file and then fails, and fails to truncate if truncateErr is set.
+type failingAuditFile struct {
+	*os.File
+	truncateErr error
+}
+
+func (f *failingAuditFile) Write(b []byte) (int, error) {
+	n, _ := f.File.Write(b[:len(b)/2])
+
+	return n, errors.New("no space left on device")
+}
+
+func (f *failingAuditFile) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+
+	return f.File.Truncate(size)
+}
+
+func TestAuditLog_UndoesPartialWrites(t *testing.T) {
+	path := writeAuditLog(t, "user1")
+	log, err := openAuditLog(path, slog.Default())
+	require.NoError(t, err)
+
+	file := log.file.(*os.File)
+	log.file = &failingAuditFile{File: file}
+	assert.Error(t, log.writeBatch([]AuditEntry{{Decision: AuditDecisionAllowed, User: "user2"}}))
+
+	// The partial entry is removed, so the chain continues from the last complete entry.
+	log.file = file
+	require.NoError(t, log.record(AuditEntry{Decision: AuditDecisionAllowed, User: "user3"}))
+	require.NoError(t, log.close())
+	entries, err := VerifyAuditLog(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, entries)
+	assert.Contains(t, auditLogLines(t, path)[1], `"user":"user3"`)
+}
+
+func TestAuditLog_FailsWhenPartialWriteCannotBeUndone(t *testing.T) {
+	path := writeAuditLog(t, "user1")
+	log, err := openAuditLog(path, slog.Default())
+	require.NoError(t, err)
+
+	file := log.file.(*os.File)
+	log.file = &failingAuditFile{File: file, truncateErr: errors.New("input/output error")}
+	assert.Error(t, log.writeBatch([]AuditEntry{{Decision: AuditDecisionAllowed, User: "user2"}}))
+
+	// Nothing more is appended after the partial entry.
+	log.file = file
+	assert.ErrorContains(t, log.record(AuditEntry{Decision: AuditDecisionAllowed, User: "user3"}), "audit log has failed")
+	assert.ErrorContains(t, log.writeBatch([]AuditEntry{{Decision: AuditDecisionAllowed, User: "user3"}}),
+		"audit log has failed")
+	require.NoError(t, log.close())
+
+	lines := auditLogLines(t, path)
+	assert.Len(t, lines, 2)
+	assert.NotContains(t, lines[1], "user3")
+}
+
+func Test_ProxyAuditsAuthorizationDecisions(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.AuditLogConfig = &AuditLogConfig{Path: path}
+	proxy := startTestProxy(t, config)
+
+	// user1 is in engineering, while user2 is an administrator and is denied.
+	for _, user := range []string{"user1", "user2"} {
+		conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, user))
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("hello world\n"))
+		require.NoError(t, err)
+		_, _ = bufio.NewReader(conn).ReadBytes('\n')
+		require.NoError(t, conn.Close())
+	}
+
+	// A client without a certificate fails the handshake.
+	conn, err := tls.Dial("tcp", proxy.Address(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		_, _ = conn.Read(make([]byte, 1))
+		_ = conn.Close()
+	}
+
+	require.Eventually(t, func() bool {
+		entries, err := VerifyAuditLog(path)
+		return err == nil && entries == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	lines := auditLogLines(t, path)
+	assert.Contains(t, lines[0], `"decision":"allowed","user":"user1","group":"engineering"`)
+	assert.Contains(t, lines[0], `"certificate_fingerprint":"`)
+	assert.Contains(t, lines[1], `"decision":"denied_group","user":"user2","group":"administrators"`)
+	assert.Contains(t, lines[2], `"decision":"handshake_failure"`)
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
+
+func Test_ProxyAuditsTLSAlertRejections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	config := testProxyConfig(t, "localhost:0", "administrators")
+	config.ListenerConfig.RejectionMode = RejectionModeTLSAlert
+	config.AuditLogConfig = &AuditLogConfig{Path: path}
+	proxy := startTestProxy(t, config)
+
+	// user1 is refused during the handshake, which is still recorded as a group denial.
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	_, _ = conn.Read(make([]byte, 1))
+	_ = conn.Close()
+
+	require.Eventually(t, func() bool {
+		entries, err := VerifyAuditLog(path)
+		return err == nil && entries == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, auditLogLines(t, path)[0], `"decision":"denied_group","user":"user1","group":"engineering"`)
+
+	assert.NoError(t, proxy.Close())
+}
+
+func TestAuditLog_BatchesEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := openAuditLog(path, slog.Default())
+	require.NoError(t, err)
+
+	// Entries queued faster than they are written are chained in order across batches.
+	for i := 0; i < auditLogMaxBatch*2; i++ {
+		require.NoError(t, log.record(AuditEntry{Decision: AuditDecisionAllowed, ClientAddress: "10.0.0.1:1234"}))
+	}
+	require.NoError(t, log.close())
+	assert.Error(t, log.record(AuditEntry{Decision: AuditDecisionAllowed}))
+
+	entries, err := VerifyAuditLog(path)
+	require.NoError(t, err)
+	assert.Equal(t, auditLogMaxBatch*2, entries)
+}
@@ -0,0 +1,398 @@
+package tcpproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCaptureMaxBytes is the size a capture file may grow to before the capture stops.
+	defaultCaptureMaxBytes = 100 * 1024 * 1024
+	// defaultCaptureMaxDuration is how long a capture runs before it stops.
+	defaultCaptureMaxDuration = 10 * time.Minute
+)
+
+var (
+	// ErrCaptureNotFound is returned when stopping a capture that does not exist.
+	ErrCaptureNotFound = errors.New("capture not found")
+	// ErrCapturesNotConfigured is returned when managing captures of a Proxy without a CaptureConfig.
+	ErrCapturesNotConfigured = errors.New("captures are not configured")
+)
+
+// CaptureConfig is the configuration for capturing the decrypted traffic of selected sessions to pcapng files,
+// which can be opened with Wireshark. Each session is written as a TCP connection between the client and upstream,
+// with synthesized TCP headers. Captures are started with the admin API, or on startup if a Filter is set.
+//
+// Captured files contain the plaintext of every matching session, so they are only readable by the proxy's user.
+type CaptureConfig struct {
+	// Directory is where capture files are written.
+	Directory string
+	// Filter optionally starts a capture of matching sessions on startup.
+	Filter *CaptureFilter
+	// MaxBytes is the size a capture file may grow to before the capture stops. Defaults to 100 MiB.
+	MaxBytes int64
+	// MaxDuration is how long a capture runs before it stops. Defaults to 10 minutes.
+	MaxDuration time.Duration
+}
+
+func (c *CaptureConfig) validate() error {
+	if c.Directory == "" {
+		return errors.New("capture config does not contain a Directory")
+	}
+	if c.MaxBytes < 0 {
+		return errors.New("capture MaxBytes cannot be negative")
+	}
+	if c.MaxDuration < 0 {
+		return errors.New("capture MaxDuration cannot be negative")
+	}
+
+	return nil
+}
+
+// CaptureFilter selects which sessions a capture records. Sessions must match every field that is set, and an empty
+// filter matches every session.
+type CaptureFilter struct {
+	User     string `json:"user,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+}
+
+func (f CaptureFilter) matches(user string, group string, upstream string) bool {
+	return (f.User == "" || f.User == user) &&
+		(f.Group == "" || f.Group == group) &&
+		(f.Upstream == "" || f.Upstream == upstream)
+}
+
+// CaptureInfo is a point-in-time view of a capture.
+type CaptureInfo struct {
+	ID        string        `json:"id"`
+	Filter    CaptureFilter `json:"filter"`
+	Path      string        `json:"path"`
+	StartTime time.Time     `json:"start_time"`
+	// Deadline is when the capture stops, unless it reaches MaxBytes or is stopped first.
+	Deadline time.Time `json:"deadline"`
+	MaxBytes int64     `json:"max_bytes"`
+	// Bytes is the size of the capture file.
+	Bytes    int64 `json:"bytes"`
+	Sessions int   `json:"sessions"`
+	Active   bool  `json:"active"`
+	// StopReason is why the capture stopped, if it is no longer active.
+	StopReason string `json:"stop_reason,omitempty"`
+}
+
+// capture writes the sessions matching its filter to a single pcapng file, until it is stopped.
+type capture struct {
+	info   CaptureInfo
+	file   *os.File
+	writer *pcapngWriter
+	timer  *time.Timer
+	logger *slog.Logger
+	mutex  sync.Mutex
+}
+
+// write appends packets to the capture file, stopping the capture if it would exceed MaxBytes.
+func (c *capture) write(packets [][]byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.info.Active {
+		return
+	}
+
+	now := time.Now()
+	for _, packet := range packets {
+		if c.info.Bytes+int64(enhancedPacketBlockSize(len(packet))) > c.info.MaxBytes {
+			c.stopLocked("size limit reached")
+			return
+		}
+		_, err := c.writer.writePacket(now, packet)
+		c.info.Bytes = c.writer.written
+		if err != nil {
+			c.stopLocked(fmt.Sprintf("write failed: %v", err))
+			return
+		}
+	}
+}
+
+func (c *capture) stop(reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stopLocked(reason)
+}
+
+// stopLocked closes the capture file. The mutex must be held.
+func (c *capture) stopLocked(reason string) {
+	if !c.info.Active {
+		return
+	}
+	c.info.Active, c.info.StopReason = false, reason
+	c.timer.Stop()
+	if err := c.file.Close(); err != nil {
+		c.logger.Error("closing capture", slog.String("path", c.info.Path), slog.String("error", err.Error()))
+	}
+	c.logger.Info(
+		"capture stopped",
+		slog.String("id", c.info.ID),
+		slog.String("reason", reason),
+		slog.Int64("bytes", c.info.Bytes),
+	)
+}
+
+func (c *capture) snapshot() CaptureInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.info
+}
+
+// captureManager tracks the captures of a Proxy. A nil *captureManager captures nothing, so call sites do not need
+// to check whether captures are configured.
+type captureManager struct {
+	config   CaptureConfig
+	logger   *slog.Logger
+	captures map[string]*capture
+	mutex    sync.Mutex
+}
+
+func newCaptureManager(conf *CaptureConfig, logger *slog.Logger) (*captureManager, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(conf.Directory, 0o700); err != nil {
+		return nil, err
+	}
+	m := &captureManager{config: *conf, logger: logger, captures: make(map[string]*capture)}
+	if m.config.MaxBytes == 0 {
+		m.config.MaxBytes = defaultCaptureMaxBytes
+	}
+	if m.config.MaxDuration == 0 {
+		m.config.MaxDuration = defaultCaptureMaxDuration
+	}
+	if conf.Filter != nil {
+		if _, err := m.start(*conf.Filter, 0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// start begins capturing sessions matching filter that start from now on. A zero maxBytes or maxDuration uses
+// the configured default.
+func (m *captureManager) start(filter CaptureFilter, maxBytes int64, maxDuration time.Duration) (CaptureInfo, error) {
+	if maxBytes <= 0 {
+		maxBytes = m.config.MaxBytes
+	}
+	if maxDuration <= 0 {
+		maxDuration = m.config.MaxDuration
+	}
+
+	id := newSessionID()
+	path := filepath.Join(m.config.Directory, "capture-"+id+".pcapng")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+	writer, err := newPcapngWriter(file)
+	if err != nil {
+		_ = file.Close()
+		return CaptureInfo{}, err
+	}
+
+	now := time.Now()
+	c := &capture{
+		info: CaptureInfo{
+			ID:        id,
+			Filter:    filter,
+			Path:      path,
+			StartTime: now,
+			Deadline:  now.Add(maxDuration),
+			MaxBytes:  maxBytes,
+			Bytes:     writer.written,
+			Active:    true,
+		},
+		file:   file,
+		writer: writer,
+		logger: m.logger,
+	}
+	c.mutex.Lock()
+	c.timer = time.AfterFunc(maxDuration, func() { c.stop("time limit reached") })
+	c.mutex.Unlock()
+
+	m.mutex.Lock()
+	m.captures[id] = c
+	m.mutex.Unlock()
+	m.logger.Info("capture started", slog.String("id", id), slog.String("path", path))
+
+	return c.snapshot(), nil
+}
+
+// stop ends a capture, keeping its file.
+func (m *captureManager) stop(id string) (CaptureInfo, error) {
+	m.mutex.Lock()
+	c, ok := m.captures[id]
+	m.mutex.Unlock()
+	if !ok {
+		return CaptureInfo{}, ErrCaptureNotFound
+	}
+	c.stop("stopped")
+
+	return c.snapshot(), nil
+}
+
+// list returns every capture started by the Proxy, oldest first.
+func (m *captureManager) list() []CaptureInfo {
+	m.mutex.Lock()
+	infos := make([]CaptureInfo, 0, len(m.captures))
+	for _, c := range m.captures {
+		infos = append(infos, c.snapshot())
+	}
+	m.mutex.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.Before(infos[j].StartTime)
+	})
+
+	return infos
+}
+
+// tap returns a sessionTap recording a new session to every active capture it matches, or nil if there are none.
+func (m *captureManager) tap(user string, group string, upstream string, client net.Addr, server net.Addr) *sessionTap {
+	if m == nil {
+		return nil
+	}
+	clientAddr, clientErr := netip.ParseAddrPort(client.String())
+	serverAddr, serverErr := netip.ParseAddrPort(server.String())
+	if clientErr != nil || serverErr != nil {
+		return nil
+	}
+
+	var captures []*capture
+	m.mutex.Lock()
+	for _, c := range m.captures {
+		c.mutex.Lock()
+		if c.info.Active && c.info.Filter.matches(user, group, upstream) {
+			c.info.Sessions++
+			captures = append(captures, c)
+		}
+		c.mutex.Unlock()
+	}
+	m.mutex.Unlock()
+	if len(captures) == 0 {
+		return nil
+	}
+
+	t := &sessionTap{flow: newTCPFlow(clientAddr, serverAddr), captures: captures}
+	t.record(t.flow.handshake)
+
+	return t
+}
+
+// close stops all active captures.
+func (m *captureManager) close() {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, c := range m.captures {
+		c.stop("proxy closed")
+	}
+}
+
+// sessionTap records the traffic of a single session as a synthesized TCP connection. A nil *sessionTap records
+// nothing.
+type sessionTap struct {
+	flow     *tcpFlow
+	captures []*capture
+	mutex    sync.Mutex
+}
+
+// writer returns w, recording every byte written through it as sent by the client if fromClient is true,
+// otherwise by the upstream.
+func (t *sessionTap) writer(w io.Writer, fromClient bool) io.Writer {
+	if t == nil {
+		return w
+	}
+
+	return &tapWriter{writer: w, tap: t, fromClient: fromClient}
+}
+
+// close records both sides closing the connection.
+func (t *sessionTap) close() {
+	if t == nil {
+		return
+	}
+
+	t.record(func() [][]byte {
+		return [][]byte{t.flow.fin(true), t.flow.fin(false)}
+	})
+}
+
+// record builds packets and writes them to every capture. Both are done under the tap's mutex, so that packets
+// are written in the order their sequence numbers were assigned.
+func (t *sessionTap) record(build func() [][]byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	packets := build()
+	for _, c := range t.captures {
+		c.write(packets)
+	}
+}
+
+// tapWriter records the bytes successfully written to its writer with a sessionTap.
+type tapWriter struct {
+	writer     io.Writer
+	tap        *sessionTap
+	fromClient bool
+}
+
+func (w *tapWriter) Write(b []byte) (int, error) {
+	n, err := w.writer.Write(b)
+	if n > 0 {
+		w.tap.record(func() [][]byte {
+			return w.tap.flow.data(w.fromClient, b[:n])
+		})
+	}
+
+	return n, err
+}
+
+// StartCapture begins capturing the traffic of new sessions matching filter to a pcapng file. A zero maxBytes or
+// maxDuration uses the CaptureConfig default.
+func (p *Proxy) StartCapture(filter CaptureFilter, maxBytes int64, maxDuration time.Duration) (CaptureInfo, error) {
+	if p.captures == nil {
+		return CaptureInfo{}, ErrCapturesNotConfigured
+	}
+
+	return p.captures.start(filter, maxBytes, maxDuration)
+}
+
+// StopCapture stops a capture by ID, keeping its file. ErrCaptureNotFound is returned if no such capture exists.
+func (p *Proxy) StopCapture(id string) (CaptureInfo, error) {
+	if p.captures == nil {
+		return CaptureInfo{}, ErrCapturesNotConfigured
+	}
+
+	return p.captures.stop(id)
+}
+
+// Captures returns every capture started by the Proxy, including those that have stopped, oldest first.
+func (p *Proxy) Captures() []CaptureInfo {
+	if p.captures == nil {
+		return []CaptureInfo{}
+	}
+
+	return p.captures.list()
+}
@@ -0,0 +1,153 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoThroughProxy sends a line through the proxy as user, and waits for it to be echoed back.
+func echoThroughProxy(t *testing.T, proxy *Proxy, user string, line string) {
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, user))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(line))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	assert.Equal(t, 1, proxy.TerminateUserSessions(user))
+	assert.NoError(t, conn.Close())
+}
+
+func Test_ProxyCapturesSessions(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.CaptureConfig = &CaptureConfig{
+		Directory: filepath.Join(t.TempDir(), "captures"),
+		Filter:    &CaptureFilter{User: "user1"},
+	}
+	proxy := startTestProxy(t, config)
+
+	// A second capture only matches another upstream, so never records anything.
+	other, err := proxy.StartCapture(CaptureFilter{Upstream: "10.0.0.1:80"}, 0, 0)
+	require.NoError(t, err)
+
+	echoThroughProxy(t, proxy, "user1", "hello world\n")
+
+	captures := proxy.Captures()
+	require.Len(t, captures, 2)
+	capture := captures[0]
+	assert.Equal(t, CaptureFilter{User: "user1"}, capture.Filter)
+	assert.True(t, capture.Active)
+
+	// Once the session has closed, its FINs have been written.
+	require.Eventually(t, func() bool {
+		return proxy.sessions.count() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	stopped, err := proxy.StopCapture(capture.ID)
+	require.NoError(t, err)
+	assert.False(t, stopped.Active)
+	assert.Equal(t, "stopped", stopped.StopReason)
+	assert.Equal(t, 1, stopped.Sessions)
+
+	data, err := os.ReadFile(capture.Path)
+	require.NoError(t, err)
+	assert.Equal(t, stopped.Bytes, int64(len(data)))
+	packets := readPcapngPackets(t, data)
+	require.Len(t, packets, 7)
+	_, request := tcpPayload(packets[3])
+	assert.Equal(t, []byte("hello world\n"), request)
+	_, response := tcpPayload(packets[4])
+	assert.Equal(t, []byte("hello world\n"), response)
+
+	info, err := os.Stat(capture.Path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	assert.NoError(t, proxy.Close())
+	for _, capture := range proxy.Captures() {
+		assert.False(t, capture.Active)
+	}
+	assert.Equal(t, 0, proxy.Captures()[1].Sessions)
+	assert.Equal(t, other.ID, proxy.Captures()[1].ID)
+	assert.NoError(t, echoSrv.close())
+}
+
+func TestCaptureManager_Limits(t *testing.T) {
+	manager, err := newCaptureManager(&CaptureConfig{Directory: t.TempDir()}, slog.Default())
+	require.NoError(t, err)
+	defer manager.close()
+	client, server := tcpAddr("10.0.0.1:50000"), tcpAddr("10.0.0.2:80")
+
+	// The handshake fits within the size limit, but the data does not.
+	small, err := manager.start(CaptureFilter{}, 512, 0)
+	require.NoError(t, err)
+	tap := manager.tap("user1", "engineering", "10.0.0.2:80", client, server)
+	require.NotNil(t, tap)
+	_, err = tap.writer(&bytes.Buffer{}, true).Write(make([]byte, 1024))
+	require.NoError(t, err)
+	info, _ := manager.stop(small.ID)
+	assert.Equal(t, "size limit reached", info.StopReason)
+	assert.LessOrEqual(t, info.Bytes, int64(512))
+
+	short, err := manager.start(CaptureFilter{}, 0, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		infos := manager.list()
+		return infos[len(infos)-1].ID == short.ID && infos[len(infos)-1].StopReason == "time limit reached"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Stopped captures no longer match sessions.
+	assert.Nil(t, manager.tap("user1", "engineering", "10.0.0.2:80", client, server))
+	_, err = manager.stop("missing")
+	assert.ErrorIs(t, err, ErrCaptureNotFound)
+}
+
+func TestCaptureManager_Nil(t *testing.T) {
+	var manager *captureManager
+	tap := manager.tap("user1", "engineering", "10.0.0.2:80", tcpAddr("10.0.0.1:50000"), tcpAddr("10.0.0.2:80"))
+	assert.Nil(t, tap)
+
+	var buffer bytes.Buffer
+	assert.Equal(t, &buffer, tap.writer(&buffer, true))
+	tap.close()
+	manager.close()
+}
+
+func TestAdminServer_Captures(t *testing.T) {
+	a, proxy := newTestAdminServer()
+	assert.Equal(t, http.StatusNotImplemented, adminRequest(a, http.MethodPost, "/captures", "admin@administrators").Code)
+
+	var err error
+	proxy.captures, err = newCaptureManager(&CaptureConfig{Directory: t.TempDir()}, slog.Default())
+	require.NoError(t, err)
+	defer proxy.captures.close()
+
+	assert.Equal(t, http.StatusBadRequest,
+		adminRequest(a, http.MethodPost, "/captures?duration=soon", "admin@administrators").Code)
+	recorder := adminRequest(a, http.MethodPost, "/captures?user=user1&max_bytes=4096&duration=1m", "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var info CaptureInfo
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &info))
+	assert.Equal(t, "user1", info.Filter.User)
+	assert.Equal(t, int64(4096), info.MaxBytes)
+	assert.WithinDuration(t, info.StartTime.Add(time.Minute), info.Deadline, time.Second)
+
+	recorder = adminRequest(a, http.MethodGet, "/captures", "admin@administrators")
+	var infos []CaptureInfo
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &infos))
+	assert.Len(t, infos, 1)
+
+	assert.Equal(t, http.StatusOK, adminRequest(a, http.MethodDelete, "/captures/"+info.ID, "admin@administrators").Code)
+	assert.Equal(t, http.StatusNotFound,
+		adminRequest(a, http.MethodDelete, "/captures/missing", "admin@administrators").Code)
+}
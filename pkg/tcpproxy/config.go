@@ -4,8 +4,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"log/slog"
+	"net"
+	"net/netip"
 	"os"
+	"slices"
 	"time"
 )
 
@@ -19,6 +23,26 @@ type Config struct {
 	UpstreamConfig *UpstreamConfig
 	// RateLimitConfig defines how rate limiting should be configured for clients.
 	RateLimitConfig *RateLimitConfig
+	// ConnectionLimitConfig optionally limits the rate of accepted connections before any TLS work is done.
+	ConnectionLimitConfig *ConnectionLimitConfig
+	// AdminConfig optionally enables the admin HTTP API on a separate listener.
+	AdminConfig *AdminConfig
+	// AccessLogConfig optionally enables the access log, with one record per session.
+	AccessLogConfig *AccessLogConfig
+	// AuditLogConfig optionally enables the tamper-evident audit log of authorization decisions.
+	AuditLogConfig *AuditLogConfig
+	// TracingConfig optionally enables exporting OpenTelemetry traces of each connection.
+	TracingConfig *TracingConfig
+	// HooksConfig optionally notifies an Observer of connection events, and lets it veto connections.
+	HooksConfig *HooksConfig
+	// HealthConfig optionally serves liveness and readiness probes on a separate plain HTTP listener.
+	HealthConfig *HealthConfig
+	// CaptureConfig optionally enables capturing the decrypted traffic of selected sessions to pcapng files.
+	CaptureConfig *CaptureConfig
+	// PassthroughConfig optionally forwards connections for selected server names without terminating TLS.
+	PassthroughConfig *PassthroughConfig
+	// UDPConfig optionally proxies UDP datagrams on a separate listener.
+	UDPConfig *UDPConfig
 
 	// Logger is a slog.Logger used for logging proxy activities to stdout.
 	Logger *slog.Logger
@@ -33,26 +57,137 @@ type ListenerConfig struct {
 	CA          string
 	Certificate string
 	PrivateKey  string
+
+	// RejectionMode selects what refused clients are told before being closed. Defaults to RejectionModeSilent.
+	RejectionMode RejectionMode
+	// RejectionBanner is the template sent to refused clients in RejectionModeBanner, supporting the placeholders
+	// {code}, {reason} and {retry_after}. Defaults to DefaultRejectionBanner.
+	RejectionBanner string
+
+	// UnixSocket optionally accepts connections on a Unix socket as well, identifying clients by their peer
+	// credentials instead of a certificate.
+	UnixSocket *UnixSocketConfig
+
+	// TrustedProxies lists the CIDRs of load balancers in front of the proxy, for example "10.0.0.0/8". Connections
+	// from these sources must start with a PROXY protocol v1 or v2 header, and the client address it carries is
+	// used in place of the load balancer's for rate limits, logs and upstream PROXY protocol headers.
+	TrustedProxies []string
+
+	// HalfCloseTimeout is how long a session may keep sending in one direction after the other direction has
+	// finished, for example while an upstream answers a client that has shut down writes. Both connections are
+	// closed once it expires. Defaults to 1 minute.
+	HalfCloseTimeout time.Duration
+
+	// SocketOptions optionally tunes the TCP sockets of accepted connections.
+	SocketOptions *SocketOptions
 }
 
 // UpstreamConfig is the configuration for where to route proxied connections.
 type UpstreamConfig struct {
 	// Name is a label for the upstreams.
 	Name string
-	// Targets is a list of available upstream network addresses to proxy requests to.
+	// Targets is a list of available upstream network addresses to proxy requests to. Targets starting with
+	// "unix://" are Unix sockets, for example "unix:///run/app.sock".
 	Targets []string
 
 	// AuthorizedGroups defines who can proxy to the Targets. Maps to group value extracted from TSL certificate `cn`.
 	AuthorizedGroups []string
+
+	// ProxyProtocol optionally sends a PROXY protocol header as the first bytes of each upstream connection, so
+	// upstreams can see the client's address. Version 2 headers also carry the client's identity.
+	ProxyProtocol ProxyProtocolVersion
+
+	// TLS optionally encrypts connections to the Targets, verifying their certificates.
+	TLS *UpstreamTLSConfig
+
+	// SocketOptions optionally tunes the TCP sockets of connections to upstreams, including those of passthrough
+	// routes.
+	SocketOptions *SocketOptions
+
+	// Prewarm optionally keeps idle connections open to each of the Targets, handed to new sessions to save
+	// dialing. It cannot be combined with ProxyProtocol.
+	Prewarm *PrewarmConfig
 }
 
-// RateLimitConfig is the configuration for the built-in token bucket rate limiting implementation. These settings
-// are applied on a per-client basis.
+// RateLimitAlgorithm selects how per-client rate limits are enforced.
+type RateLimitAlgorithm string
+
+const (
+	// RateLimitAlgorithmTokenBucket allows bursts of Capacity, adding 1 token every FillRate. This is the default.
+	RateLimitAlgorithmTokenBucket RateLimitAlgorithm = "token_bucket"
+	// RateLimitAlgorithmSlidingWindowLog allows exactly Capacity connections per rolling Window.
+	RateLimitAlgorithmSlidingWindowLog RateLimitAlgorithm = "sliding_window_log"
+	// RateLimitAlgorithmSlidingWindowCounter approximates Capacity connections per rolling Window in constant memory.
+	RateLimitAlgorithmSlidingWindowCounter RateLimitAlgorithm = "sliding_window_counter"
+	// RateLimitAlgorithmGCRA allows bursts of Capacity, with 1 connection replenished every FillRate.
+	RateLimitAlgorithmGCRA RateLimitAlgorithm = "gcra"
+)
+
+// RateLimitConfig is the configuration for the built-in rate limiting implementations. These settings are applied
+// on a per-client basis for the upstream pool.
 type RateLimitConfig struct {
-	// Capacity is the maximum tokens the bucket can have.
+	// Algorithm selects the rate limiting algorithm. Defaults to RateLimitAlgorithmTokenBucket.
+	Algorithm RateLimitAlgorithm
+	// Capacity is the maximum tokens the bucket can have, or the connections allowed per Window.
 	Capacity int
 	// FillRate is how often 1 token is added to the bucket
 	FillRate time.Duration
+	// Window is the rolling window used by the sliding window algorithms, for example, 1 * time.Minute.
+	Window time.Duration
+
+	// StatePath, if set, is a local file that per-client state is saved to periodically and on shutdown, and
+	// restored from on startup. This stops restarts from refilling every client's limit.
+	StatePath string
+	// StateInterval is how often state is saved to StatePath. Defaults to 1 minute.
+	StateInterval time.Duration
+
+	// Store optionally overrides where token buckets are kept, for example a RedisRateLimitStore shared between
+	// replicas. Defaults to an in-memory RateLimitManager using Algorithm. Algorithm is ignored when a Store is set.
+	Store RateLimitStore `json:"-"`
+	// FailOpen allows connections when the Store cannot be reached. By default, connections are refused.
+	FailOpen bool
+}
+
+// ConnectionLimitConfig is the configuration for pre-authentication connection rate limiting. These limits are
+// evaluated directly after a connection is accepted, so unauthenticated floods do not cost a TLS handshake each.
+// Connections from TrustedProxies are evaluated once their PROXY protocol header has been read, against the client
+// address it carries. A zero capacity disables the corresponding limit.
+type ConnectionLimitConfig struct {
+	// GlobalCapacity is the maximum burst of connections accepted across all sources.
+	GlobalCapacity int
+	// GlobalFillRate is how often 1 connection is added back to the global budget.
+	GlobalFillRate time.Duration
+
+	// SourceCapacity is the maximum burst of connections accepted from a single source network.
+	SourceCapacity int
+	// SourceFillRate is how often 1 connection is added back to each source's budget.
+	SourceFillRate time.Duration
+	// IPv4PrefixLength and IPv6PrefixLength group sources into networks that share a budget. They default to
+	// 32 and 128, limiting each address individually.
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+
+	// BanDuration, if set, refuses all connections from a source network for this long once it exceeds its limit.
+	BanDuration time.Duration
+}
+
+// AdminConfig is the configuration for the admin HTTP API, used to inspect and manage a running Proxy. The API
+// requires mTLS, and only clients in the AuthorizedGroups may use it.
+type AdminConfig struct {
+	// ListenerAddr is the address the admin API listens on with mTLS, for example, "localhost:5001".
+	ListenerAddr string
+	// SocketPath optionally serves the admin API on a local Unix socket as well. Access is restricted to the user
+	// running the proxy by file permissions, so requests over the socket are not authenticated further.
+	SocketPath string
+
+	// TLS configuration for the admin listener, as paths to certificates in PEM format. Any left empty default to
+	// the corresponding ListenerConfig value.
+	CA          string
+	Certificate string
+	PrivateKey  string
+
+	// AuthorizedGroups defines who can use the admin API. Maps to group value extracted from TLS certificate `cn`.
+	AuthorizedGroups []string
 }
 
 // Validate confirms a given Config has all required fields set.
@@ -66,28 +201,188 @@ func (c *Config) Validate() error {
 	if c.UpstreamConfig == nil {
 		return errors.New("config does not contain a UpstreamConfig")
 	}
+	if c.ListenerConfig.UnixSocket != nil {
+		if err := c.ListenerConfig.UnixSocket.validate(); err != nil {
+			return err
+		}
+	}
+	if c.ListenerConfig.HalfCloseTimeout < 0 {
+		return errors.New("HalfCloseTimeout cannot be negative")
+	}
+	for _, options := range []*SocketOptions{c.ListenerConfig.SocketOptions, c.UpstreamConfig.SocketOptions} {
+		if options == nil {
+			continue
+		}
+		if err := options.validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := parseCIDRs(c.ListenerConfig.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid TrustedProxies: %w", err)
+	}
+	switch c.UpstreamConfig.ProxyProtocol {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q", c.UpstreamConfig.ProxyProtocol)
+	}
+	if c.UpstreamConfig.Prewarm != nil {
+		if err := c.UpstreamConfig.Prewarm.validate(); err != nil {
+			return err
+		}
+		if c.UpstreamConfig.ProxyProtocol != "" {
+			return errors.New("prewarm cannot be combined with ProxyProtocol")
+		}
+	}
+	if c.UpstreamConfig.TLS != nil {
+		if err := c.UpstreamConfig.TLS.validate(); err != nil {
+			return err
+		}
+	}
+	switch c.ListenerConfig.RejectionMode {
+	case "", RejectionModeSilent, RejectionModeTLSAlert, RejectionModeBanner:
+	default:
+		return fmt.Errorf("unknown rejection mode %q", c.ListenerConfig.RejectionMode)
+	}
 	if c.RateLimitConfig == nil {
 		return errors.New("config does not contain a RateLimitConfig")
 	}
+	if c.RateLimitConfig.Store == nil {
+		if err := c.RateLimitConfig.validate(); err != nil {
+			return err
+		}
+	}
 	if c.Logger == nil {
 		return errors.New("config does not contain a Logger")
 	}
+	if c.AdminConfig != nil {
+		if c.AdminConfig.ListenerAddr == "" && c.AdminConfig.SocketPath == "" {
+			return errors.New("admin config does not contain a ListenerAddr or SocketPath")
+		}
+		if c.AdminConfig.ListenerAddr != "" && len(c.AdminConfig.AuthorizedGroups) == 0 {
+			return errors.New("admin config does not contain any AuthorizedGroups")
+		}
+	}
+	if c.ConnectionLimitConfig != nil {
+		if err := c.ConnectionLimitConfig.validate(); err != nil {
+			return err
+		}
+	}
+	if c.AccessLogConfig != nil {
+		if err := c.AccessLogConfig.validate(); err != nil {
+			return err
+		}
+	}
+	if c.AuditLogConfig != nil && c.AuditLogConfig.Path == "" {
+		return errors.New("audit log config does not contain a Path")
+	}
+	if c.TracingConfig != nil {
+		if err := c.TracingConfig.validate(); err != nil {
+			return err
+		}
+	}
+	if c.HooksConfig != nil {
+		if err := c.HooksConfig.validate(); err != nil {
+			return err
+		}
+	}
+	if c.HealthConfig != nil {
+		if err := c.HealthConfig.validate(); err != nil {
+			return err
+		}
+	}
+	if c.CaptureConfig != nil {
+		if err := c.CaptureConfig.validate(); err != nil {
+			return err
+		}
+	}
+	if c.PassthroughConfig != nil {
+		if err := c.PassthroughConfig.validate(); err != nil {
+			return err
+		}
+	}
+	if c.UDPConfig != nil {
+		if err := c.UDPConfig.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *RateLimitConfig) validate() error {
+	if c.Capacity <= 0 {
+		return errors.New("rate limit Capacity must be positive")
+	}
+
+	switch c.Algorithm {
+	case "", RateLimitAlgorithmTokenBucket, RateLimitAlgorithmGCRA:
+		if c.FillRate <= 0 {
+			return fmt.Errorf("rate limit algorithm %q requires a positive FillRate", c.Algorithm)
+		}
+	case RateLimitAlgorithmSlidingWindowLog, RateLimitAlgorithmSlidingWindowCounter:
+		if c.Window <= 0 {
+			return fmt.Errorf("rate limit algorithm %q requires a positive Window", c.Algorithm)
+		}
+	default:
+		return fmt.Errorf("unknown rate limit algorithm %q", c.Algorithm)
+	}
+	if c.StateInterval < 0 {
+		return errors.New("rate limit StateInterval cannot be negative")
+	}
 
 	return nil
 }
 
+func (c *ConnectionLimitConfig) validate() error {
+	if c.GlobalCapacity > 0 && c.GlobalFillRate <= 0 {
+		return errors.New("connection limit GlobalFillRate must be positive")
+	}
+	if c.SourceCapacity > 0 && c.SourceFillRate <= 0 {
+		return errors.New("connection limit SourceFillRate must be positive")
+	}
+	if c.IPv4PrefixLength < 0 || c.IPv4PrefixLength > 32 {
+		return errors.New("connection limit IPv4PrefixLength must be between 0 and 32")
+	}
+	if c.IPv6PrefixLength < 0 || c.IPv6PrefixLength > 128 {
+		return errors.New("connection limit IPv6PrefixLength must be between 0 and 128")
+	}
+
+	return nil
+}
+
+// TLSConfig loads the TLS configuration for the proxy listener.
 func (c *Config) TLSConfig() (*tls.Config, error) {
+	return serverTLSConfig(c.ListenerConfig.CA, c.ListenerConfig.Certificate, c.ListenerConfig.PrivateKey)
+}
+
+// AdminTLSConfig loads the TLS configuration for the admin listener, falling back to the ListenerConfig for any
+// paths that are not set.
+func (c *Config) AdminTLSConfig() (*tls.Config, error) {
+	ca, certificate, privateKey := c.AdminConfig.CA, c.AdminConfig.Certificate, c.AdminConfig.PrivateKey
+	if ca == "" {
+		ca = c.ListenerConfig.CA
+	}
+	if certificate == "" {
+		certificate = c.ListenerConfig.Certificate
+	}
+	if privateKey == "" {
+		privateKey = c.ListenerConfig.PrivateKey
+	}
+
+	return serverTLSConfig(ca, certificate, privateKey)
+}
+
+// serverTLSConfig loads a CA and key pair from PEM files, returning a configuration requiring verified client
+// certificates signed by the CA.
+func serverTLSConfig(ca string, certificate string, privateKey string) (*tls.Config, error) {
 	pool := x509.NewCertPool()
-	caData, err := os.ReadFile(c.ListenerConfig.CA)
+	caData, err := os.ReadFile(ca)
 	if err != nil {
 		return nil, err
 	}
 	pool.AppendCertsFromPEM(caData)
 
-	cert, err := tls.LoadX509KeyPair(
-		c.ListenerConfig.Certificate,
-		c.ListenerConfig.PrivateKey,
-	)
+	cert, err := tls.LoadX509KeyPair(certificate, privateKey)
 	if err != nil {
 		return nil, err
 	}
@@ -101,3 +396,29 @@ func (c *Config) TLSConfig() (*tls.Config, error) {
 		MinVersion:         tls.VersionTLS13,
 	}, nil
 }
+
+// parseCIDRs parses a list of CIDRs, such as "10.0.0.0/8".
+func parseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// prefixesContain reports whether the IP address of addr is within any of prefixes.
+func prefixesContain(prefixes []netip.Prefix, addr net.Addr) bool {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	return slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addrPort.Addr().Unmap())
+	})
+}
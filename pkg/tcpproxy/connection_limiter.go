@@ -0,0 +1,145 @@
+package tcpproxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// connectionLimiterSweepInterval is how often idle per-source buckets are discarded.
+const connectionLimiterSweepInterval = 1 * time.Minute
+
+// connectionLimiter enforces ConnectionLimitConfig. It is consulted directly after Accept, so it is deliberately
+// cheap: buckets are refilled lazily when checked, and no goroutines are spawned per source.
+type connectionLimiter struct {
+	config ConnectionLimitConfig
+	now    func() time.Time
+
+	global    *connectionBucket
+	sources   map[netip.Prefix]*connectionBucket
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+// connectionBucket is a lazily refilled token bucket, optionally carrying a ban.
+type connectionBucket struct {
+	tokens      int
+	lastFill    time.Time
+	bannedUntil time.Time
+}
+
+func newConnectionLimiter(config ConnectionLimitConfig, now func() time.Time) *connectionLimiter {
+	if config.IPv4PrefixLength == 0 {
+		config.IPv4PrefixLength = 32
+	}
+	if config.IPv6PrefixLength == 0 {
+		config.IPv6PrefixLength = 128
+	}
+
+	c := &connectionLimiter{
+		config:    config,
+		now:       now,
+		sources:   make(map[netip.Prefix]*connectionBucket),
+		lastSweep: now(),
+	}
+	if config.GlobalCapacity > 0 {
+		c.global = &connectionBucket{tokens: config.GlobalCapacity, lastFill: now()}
+	}
+
+	return c
+}
+
+// allow reports whether a newly accepted connection from addr may proceed to the TLS handshake. Sources are
+// checked before the global limit, so a single offender cannot drain the global budget once it is limited.
+func (c *connectionLimiter) allow(addr net.Addr) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	c.sweep(now)
+
+	if c.config.SourceCapacity > 0 {
+		if prefix, ok := c.sourcePrefix(addr); ok {
+			bucket := c.sources[prefix]
+			if bucket == nil {
+				bucket = &connectionBucket{tokens: c.config.SourceCapacity, lastFill: now}
+				c.sources[prefix] = bucket
+			}
+			if now.Before(bucket.bannedUntil) {
+				return false
+			}
+			if !bucket.take(now, c.config.SourceCapacity, c.config.SourceFillRate) {
+				if c.config.BanDuration > 0 {
+					bucket.bannedUntil = now.Add(c.config.BanDuration)
+				}
+				return false
+			}
+		}
+	}
+
+	if c.global != nil {
+		return c.global.take(now, c.config.GlobalCapacity, c.config.GlobalFillRate)
+	}
+
+	return true
+}
+
+// sourcePrefix maps addr to the network it is limited under, according to the configured prefix lengths.
+func (c *connectionLimiter) sourcePrefix(addr net.Addr) (netip.Prefix, bool) {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	ip := addrPort.Addr().Unmap()
+
+	bits := c.config.IPv6PrefixLength
+	if ip.Is4() {
+		bits = c.config.IPv4PrefixLength
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	return prefix, true
+}
+
+// sweep discards per-source buckets that have refilled completely and are not banned, bounding memory under floods
+// from many sources.
+func (c *connectionLimiter) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < connectionLimiterSweepInterval {
+		return
+	}
+	c.lastSweep = now
+
+	for prefix, bucket := range c.sources {
+		bucket.refill(now, c.config.SourceCapacity, c.config.SourceFillRate)
+		if bucket.tokens >= c.config.SourceCapacity && !now.Before(bucket.bannedUntil) {
+			delete(c.sources, prefix)
+		}
+	}
+}
+
+func (b *connectionBucket) take(now time.Time, capacity int, fillRate time.Duration) bool {
+	b.refill(now, capacity, fillRate)
+	if b.tokens > 0 {
+		b.tokens--
+		return true
+	}
+
+	return false
+}
+
+func (b *connectionBucket) refill(now time.Time, capacity int, fillRate time.Duration) {
+	if fillRate <= 0 {
+		return
+	}
+	if added := int(now.Sub(b.lastFill) / fillRate); added > 0 {
+		b.tokens = min(capacity, b.tokens+added)
+		b.lastFill = b.lastFill.Add(time.Duration(added) * fillRate)
+	}
+	if b.tokens >= capacity {
+		b.lastFill = now
+	}
+}
@@ -0,0 +1,115 @@
+package tcpproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a manually advanced clock for deterministic rate limiting tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.now = f.now.Add(d)
+}
+
+func tcpAddr(address string) net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", address)
+	return addr
+}
+
+func TestConnectionLimiter_PerSource(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newConnectionLimiter(ConnectionLimitConfig{SourceCapacity: 2, SourceFillRate: time.Second}, clock.Now)
+
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.1:1000")))
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.1:1001")))
+	assert.False(t, limiter.allow(tcpAddr("10.0.0.1:1002")))
+
+	// Other sources are unaffected.
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.2:1000")))
+
+	// A token is added back after the FillRate.
+	clock.Advance(time.Second)
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.1:1003")))
+	assert.False(t, limiter.allow(tcpAddr("10.0.0.1:1004")))
+}
+
+func TestConnectionLimiter_PrefixAggregation(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newConnectionLimiter(ConnectionLimitConfig{
+		SourceCapacity:   1,
+		SourceFillRate:   time.Minute,
+		IPv4PrefixLength: 24,
+		IPv6PrefixLength: 64,
+	}, clock.Now)
+
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.1:1000")))
+	assert.False(t, limiter.allow(tcpAddr("10.0.0.200:1000")))
+	assert.True(t, limiter.allow(tcpAddr("10.0.1.1:1000")))
+
+	assert.True(t, limiter.allow(tcpAddr("[2001:db8::1]:1000")))
+	assert.False(t, limiter.allow(tcpAddr("[2001:db8::2]:1000")))
+}
+
+func TestConnectionLimiter_Ban(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newConnectionLimiter(ConnectionLimitConfig{
+		SourceCapacity: 1,
+		SourceFillRate: time.Second,
+		BanDuration:    time.Minute,
+	}, clock.Now)
+
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.1:1000")))
+	assert.False(t, limiter.allow(tcpAddr("10.0.0.1:1000")))
+
+	// Even though the bucket has refilled, the source remains banned.
+	clock.Advance(30 * time.Second)
+	assert.False(t, limiter.allow(tcpAddr("10.0.0.1:1000")))
+
+	clock.Advance(30 * time.Second)
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.1:1000")))
+}
+
+func TestConnectionLimiter_Global(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newConnectionLimiter(ConnectionLimitConfig{GlobalCapacity: 2, GlobalFillRate: time.Second}, clock.Now)
+
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.1:1000")))
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.2:1000")))
+	assert.False(t, limiter.allow(tcpAddr("10.0.0.3:1000")))
+
+	clock.Advance(time.Second)
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.3:1000")))
+}
+
+func TestConnectionLimiter_SweepsIdleSources(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newConnectionLimiter(ConnectionLimitConfig{SourceCapacity: 1, SourceFillRate: time.Second}, clock.Now)
+
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.1:1000")))
+	assert.Len(t, limiter.sources, 1)
+
+	clock.Advance(connectionLimiterSweepInterval)
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.2:1000")))
+	assert.Len(t, limiter.sources, 1)
+}
+
+func TestConnectionLimitConfig_Validate(t *testing.T) {
+	assert.Error(t, (&ConnectionLimitConfig{GlobalCapacity: 1}).validate())
+	assert.Error(t, (&ConnectionLimitConfig{SourceCapacity: 1}).validate())
+	assert.Error(t, (&ConnectionLimitConfig{IPv4PrefixLength: 33}).validate())
+	assert.NoError(t, (&ConnectionLimitConfig{SourceCapacity: 1, SourceFillRate: time.Second}).validate())
+}
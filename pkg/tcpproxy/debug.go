@@ -0,0 +1,115 @@
+package tcpproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+)
+
+// Profiler label keys set on the goroutines serving each session, so that goroutine dumps and profiles from
+// /debug/pprof can be attributed to sessions.
+const (
+	labelSession   = "session"
+	labelUpstream  = "upstream"
+	labelDirection = "direction"
+)
+
+// DebugState is a snapshot of the internal state of a Proxy, for diagnosing problems in production.
+type DebugState struct {
+	Time       time.Time        `json:"time"`
+	Goroutines int              `json:"goroutines"`
+	Ready      Readiness        `json:"ready"`
+	Sessions   []SessionInfo    `json:"sessions"`
+	Balancer   []UpstreamStatus `json:"balancer"`
+	// RateLimits is the state of every client's Limiter. It is only available with the built-in RateLimitManager.
+	RateLimits       []RateLimitState      `json:"rate_limits,omitempty"`
+	RateLimitStore   string                `json:"rate_limit_store"`
+	ConnectionLimits *ConnectionLimitState `json:"connection_limits,omitempty"`
+}
+
+// ConnectionLimitState is a point-in-time view of the pre-authentication connection limits.
+type ConnectionLimitState struct {
+	// GlobalTokens is how many connections could be accepted right now, or -1 if there is no global limit.
+	GlobalTokens int `json:"global_tokens"`
+	// Sources is how many source networks are being tracked.
+	Sources int `json:"sources"`
+	// Banned maps banned source networks to when their ban ends.
+	Banned map[string]time.Time `json:"banned,omitempty"`
+}
+
+// DebugState returns a snapshot of the internal state of the Proxy.
+func (p *Proxy) DebugState() DebugState {
+	state := DebugState{
+		Time:           time.Now(),
+		Goroutines:     runtime.NumGoroutine(),
+		Ready:          p.Readiness(),
+		Sessions:       p.sessions.list("", ""),
+		Balancer:       p.Upstreams(),
+		RateLimitStore: fmt.Sprintf("%T", p.rateLimitStore),
+	}
+	if manager, ok := p.rateLimitStore.(*RateLimitManager); ok {
+		state.RateLimits = manager.States()
+	}
+	if p.connectionLimiter != nil {
+		connectionLimits := p.connectionLimiter.state()
+		state.ConnectionLimits = &connectionLimits
+	}
+
+	return state
+}
+
+// state returns the current state of the connection limits.
+func (c *connectionLimiter) state() ConnectionLimitState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	state := ConnectionLimitState{GlobalTokens: -1, Sources: len(c.sources)}
+	if c.global != nil {
+		c.global.refill(now, c.config.GlobalCapacity, c.config.GlobalFillRate)
+		state.GlobalTokens = c.global.tokens
+	}
+	for prefix, bucket := range c.sources {
+		if now.Before(bucket.bannedUntil) {
+			if state.Banned == nil {
+				state.Banned = make(map[string]time.Time)
+			}
+			state.Banned[prefix.String()] = bucket.bannedUntil
+		}
+	}
+
+	return state
+}
+
+// registerDebugRoutes adds the Go runtime profiles under /debug/pprof/ and a snapshot of the proxy's internal state
+// at /debug/state. Goroutines serving sessions carry session and upstream labels, which are included in
+// /debug/pprof/goroutine?debug=1.
+func (a *adminServer) registerDebugRoutes() {
+	a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	a.mux.HandleFunc("/debug/state", a.handleDebugState)
+}
+
+// handleDebugState dumps the internal state of the proxy with GET /debug/state.
+func (a *adminServer) handleDebugState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.DebugState())
+}
+
+// withLabels adds profiler labels to ctx and to the calling goroutine. Goroutines started afterwards inherit them.
+func withLabels(ctx context.Context, labels ...string) context.Context {
+	ctx = runtimepprof.WithLabels(ctx, runtimepprof.Labels(labels...))
+	runtimepprof.SetGoroutineLabels(ctx)
+
+	return ctx
+}
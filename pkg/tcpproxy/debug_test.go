@@ -0,0 +1,79 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminServer_DebugState(t *testing.T) {
+	a, proxy := newTestAdminServer()
+	proxy.connectionLimiter = newConnectionLimiter(ConnectionLimitConfig{GlobalCapacity: 5, GlobalFillRate: time.Second},
+		time.Now)
+	allowed, _ := proxy.rateLimitStore.ConnectionAllowed("user1")
+	require.True(t, allowed)
+
+	assert.Equal(t, http.StatusForbidden, adminRequest(a, http.MethodGet, "/debug/state", "user1@engineering").Code)
+	recorder := adminRequest(a, http.MethodGet, "/debug/state", "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var state DebugState
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &state))
+	assert.Positive(t, state.Goroutines)
+	assert.Len(t, state.Balancer, 2)
+	require.Len(t, state.RateLimits, 1)
+	assert.Equal(t, RateLimitState{Client: "user1", Algorithm: RateLimitAlgorithmTokenBucket, Capacity: 2, Remaining: 1},
+		state.RateLimits[0])
+	require.NotNil(t, state.ConnectionLimits)
+	assert.Equal(t, 5, state.ConnectionLimits.GlobalTokens)
+}
+
+func TestConnectionLimiter_State(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newConnectionLimiter(ConnectionLimitConfig{
+		SourceCapacity: 1,
+		SourceFillRate: time.Second,
+		BanDuration:    time.Minute,
+	}, clock.Now)
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.1:1000")))
+	assert.False(t, limiter.allow(tcpAddr("10.0.0.1:1000")))
+	assert.True(t, limiter.allow(tcpAddr("10.0.0.2:1000")))
+
+	state := limiter.state()
+	assert.Equal(t, -1, state.GlobalTokens)
+	assert.Equal(t, 2, state.Sources)
+	assert.Equal(t, map[string]time.Time{"10.0.0.1/32": clock.Now().Add(time.Minute)}, state.Banned)
+}
+
+func Test_ProxyLabelsSessionGoroutines(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	proxy := startTestProxy(t, testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering"))
+	a := &adminServer{proxy: proxy, authorizedGroups: []string{"administrators"}, mux: http.NewServeMux()}
+	a.registerRoutes()
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+
+	sessions := proxy.Sessions("user1", "")
+	require.Len(t, sessions, 1)
+	recorder := adminRequest(a, http.MethodGet, "/debug/pprof/goroutine?debug=1", "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"session":"`+sessions[0].ID+`"`)
+	assert.Contains(t, recorder.Body.String(), `"upstream":"`+echoSrv.listener.Addr().String()+`"`)
+	assert.Contains(t, recorder.Body.String(), `"direction":"client_to_upstream"`)
+
+	assert.NoError(t, conn.Close())
+	assert.Equal(t, 1, proxy.TerminateUserSessions("user1"))
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
@@ -0,0 +1,76 @@
+package tcpproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// GCRALimiter implements the generic cell rate algorithm. Connections are allowed at a steady rate of one per
+// emissionInterval, with bursts of up to capacity. Unlike RateLimiter it needs no background goroutine, as it only
+// tracks a single theoretical arrival time.
+type GCRALimiter struct {
+	emissionInterval time.Duration
+	burstTolerance   time.Duration
+	now              func() time.Time
+
+	theoreticalArrival time.Time
+	mutex              sync.Mutex
+}
+
+// NewGCRALimiter returns a GCRALimiter allowing bursts of capacity connections, replenished at one per
+// emissionInterval.
+func NewGCRALimiter(capacity int, emissionInterval time.Duration) *GCRALimiter {
+	return newGCRALimiter(capacity, emissionInterval, time.Now)
+}
+
+func newGCRALimiter(capacity int, emissionInterval time.Duration, now func() time.Time) *GCRALimiter {
+	return &GCRALimiter{
+		emissionInterval: emissionInterval,
+		burstTolerance:   time.Duration(capacity-1) * emissionInterval,
+		now:              now,
+	}
+}
+
+// ConnectionAllowed returns true and advances the theoretical arrival time if the connection conforms.
+func (g *GCRALimiter) ConnectionAllowed() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := g.now()
+	arrival := g.theoreticalArrival
+	if arrival.Before(now) {
+		arrival = now
+	}
+	if arrival.Sub(now) > g.burstTolerance {
+		return false
+	}
+	g.theoreticalArrival = arrival.Add(g.emissionInterval)
+
+	return true
+}
+
+// remaining returns how many connections would conform if they arrived now.
+func (g *GCRALimiter) remaining() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	backlog := max(0, g.theoreticalArrival.Sub(g.now()))
+	if backlog > g.burstTolerance {
+		return 0
+	}
+
+	return int((g.burstTolerance-backlog)/g.emissionInterval) + 1
+}
+
+// retryAfter returns how long until the next connection would conform.
+func (g *GCRALimiter) retryAfter() time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return max(0, g.theoreticalArrival.Sub(g.now())-g.burstTolerance)
+}
+
+// Close is a no-op, as a GCRALimiter holds no background resources.
+func (g *GCRALimiter) Close() error {
+	return nil
+}
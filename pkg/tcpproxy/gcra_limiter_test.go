@@ -0,0 +1,34 @@
+package tcpproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCRALimiter_ConnectionAllowed(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newGCRALimiter(3, time.Second, clock.Now)
+
+	// A burst of capacity is allowed up front.
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.ConnectionAllowed())
+	}
+	assert.False(t, limiter.ConnectionAllowed())
+
+	// Connections are then replenished at one per emission interval.
+	clock.Advance(500 * time.Millisecond)
+	assert.False(t, limiter.ConnectionAllowed())
+	clock.Advance(500 * time.Millisecond)
+	assert.True(t, limiter.ConnectionAllowed())
+	assert.False(t, limiter.ConnectionAllowed())
+
+	// After idling, the burst never exceeds capacity.
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.ConnectionAllowed())
+	}
+	assert.False(t, limiter.ConnectionAllowed())
+	assert.NoError(t, limiter.Close())
+}
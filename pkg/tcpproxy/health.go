@@ -0,0 +1,246 @@
+package tcpproxy
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthConfig is the configuration for the liveness and readiness probes, served over plain HTTP on a listener
+// separate from the admin API so that orchestrators can reach them without a client certificate.
+type HealthConfig struct {
+	// ListenerAddr is the address the probes listen on, for example, "localhost:5002".
+	ListenerAddr string
+	// DrainDelay is how long Close reports the proxy as not ready before closing the listener, giving load
+	// balancers time to shift traffic away. Defaults to no delay.
+	DrainDelay time.Duration
+}
+
+func (c *HealthConfig) validate() error {
+	if c.ListenerAddr == "" {
+		return errors.New("health config does not contain a ListenerAddr")
+	}
+	if c.DrainDelay < 0 {
+		return errors.New("health DrainDelay cannot be negative")
+	}
+
+	return nil
+}
+
+// Readiness is the outcome of the readiness checks. Checks maps the name of each check to "ok", or the reason it
+// failed.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// upstreamRecheckInterval is how long after an upstream failed to connect it is dialed again in the background.
+const upstreamRecheckInterval = 10 * time.Second
+
+// Readiness reports whether the Proxy should receive traffic: it must be accepting connections and not draining,
+// its TLS certificate must be loaded and unexpired, and every pool of upstreams, including those of passthrough
+// routes, must have an upstream that is healthy.
+func (p *Proxy) Readiness() Readiness {
+	checks := map[string]string{
+		"listener":  p.checkListener(),
+		"tls":       p.checkTLS(time.Now()),
+		"upstreams": p.checkUpstreams(),
+	}
+	ready := true
+	for _, result := range checks {
+		ready = ready && result == "ok"
+	}
+
+	return Readiness{Ready: ready, Checks: checks}
+}
+
+func (p *Proxy) checkListener() string {
+	switch {
+	case p.draining.Load():
+		return "draining"
+	case !p.serving.Load():
+		return "not serving"
+	}
+
+	return "ok"
+}
+
+func (p *Proxy) checkTLS(now time.Time) string {
+	tlsConfig := p.tlsConfig.Load()
+	if tlsConfig == nil || len(tlsConfig.Certificates) == 0 || len(tlsConfig.Certificates[0].Certificate) == 0 {
+		return "no certificate loaded"
+	}
+	cert, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		return fmt.Sprintf("invalid certificate: %v", err)
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Sprintf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Sprintf("certificate is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	}
+
+	return "ok"
+}
+
+func (p *Proxy) checkUpstreams() string {
+	if result := p.checkPool(p.pool); result != "ok" {
+		return result
+	}
+	for _, route := range p.passthrough {
+		if result := p.checkPool(route.pool); result != "ok" {
+			return fmt.Sprintf("passthrough route %q: %s", route.name, result)
+		}
+	}
+
+	return "ok"
+}
+
+// checkPool reports whether pool has a healthy upstream: one that is not draining, and whose most recent connection
+// attempt succeeded, or that has not been tried yet. It only reads recorded attempts, which recheckUpstreams keeps
+// up to date for upstreams that failed.
+func (p *Proxy) checkPool(pool *upstreamPool) string {
+	var lastErr error
+	for _, upstream := range pool.loadBalancer.FetchUpstreams() {
+		if upstream.Draining() {
+			continue
+		}
+		_, err := upstream.lastDial()
+		if err == nil {
+			return "ok"
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		return "no upstream available, all upstreams are draining"
+	}
+
+	return fmt.Sprintf("no upstream reachable: %v", lastErr)
+}
+
+// recheckUpstreams calls recheckFailedUpstreams every upstreamRecheckInterval until the Proxy is closed.
+func (p *Proxy) recheckUpstreams() {
+	ticker := time.NewTicker(upstreamRecheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.shutdownC:
+			return
+		case <-ticker.C:
+			p.recheckFailedUpstreams()
+		}
+	}
+}
+
+// recheckFailedUpstreams dials every upstream whose last connection attempt failed over upstreamRecheckInterval
+// ago, the same way sessions do, since otherwise no new attempts may be made once traffic shifts away and the
+// upstream would never become healthy again. It waits for the dials to finish.
+func (p *Proxy) recheckFailedUpstreams() {
+	wg := &sync.WaitGroup{}
+	for _, pool := range p.pools() {
+		for _, upstream := range pool.loadBalancer.FetchUpstreams() {
+			dialTime, err := upstream.lastDial()
+			if err == nil || upstream.Draining() || time.Since(dialTime) < upstreamRecheckInterval {
+				continue
+			}
+
+			wg.Add(1)
+			go func(pool *upstreamPool, address string) {
+				defer wg.Done()
+				if conn, err := p.connectPool(pool, address); err == nil {
+					_ = conn.Close()
+				}
+			}(pool, upstream.Address)
+		}
+	}
+	wg.Wait()
+}
+
+// Drain marks the Proxy as not ready, so that load balancers shift traffic away, while it continues to accept
+// connections. Close drains the Proxy before closing the listener.
+func (p *Proxy) Drain() {
+	if !p.draining.Swap(true) {
+		p.logger.Info("draining, reporting not ready")
+	}
+}
+
+// waitForDrain drains the Proxy and waits for the configured DrainDelay before the listener is closed.
+func (p *Proxy) waitForDrain() {
+	p.Drain()
+	if p.config.HealthConfig != nil && p.config.HealthConfig.DrainDelay > 0 {
+		time.Sleep(p.config.HealthConfig.DrainDelay)
+	}
+}
+
+// healthServer serves the liveness and readiness probes.
+type healthServer struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// newHealthServer starts listening on the configured address. Requests are only served once serve is called.
+func newHealthServer(proxy *Proxy, conf *HealthConfig) (*healthServer, error) {
+	listener, err := net.Listen("tcp", conf.ListenerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	registerHealthRoutes(mux, proxy)
+
+	return &healthServer{
+		listener: listener,
+		server: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: adminReadHeaderTimeout,
+			ErrorLog:          slog.NewLogLogger(proxy.logger.Handler(), slog.LevelWarn),
+		},
+	}, nil
+}
+
+// registerHealthRoutes adds /healthz and /readyz to mux. /healthz always succeeds while the process can serve
+// HTTP, while /readyz fails with 503 Service Unavailable unless every readiness check passes.
+func registerHealthRoutes(mux *http.ServeMux, proxy *Proxy) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]bool{"alive": true})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readiness := proxy.Readiness()
+		status := http.StatusOK
+		if !readiness.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, readiness)
+	})
+}
+
+// serve serves the probes until close is called.
+func (h *healthServer) serve(logger *slog.Logger) {
+	if err := h.server.Serve(h.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("health server stopped", slog.String("error", err.Error()))
+	}
+}
+
+// close stops serving the probes.
+func (h *healthServer) close() error {
+	err := h.server.Close()
+	_ = h.listener.Close()
+
+	return err
+}
+
+// HealthAddress returns the address the health probes are serving on, or an empty string if they are not
+// configured.
+func (p *Proxy) HealthAddress() string {
+	if p.health == nil {
+		return ""
+	}
+
+	return p.health.listener.Addr().String()
+}
@@ -0,0 +1,190 @@
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getReadiness fetches /readyz from the proxy's health probes.
+func getReadiness(t *testing.T, proxy *Proxy) (int, Readiness) {
+	resp, err := http.Get("http://" + proxy.HealthAddress() + "/readyz")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	var readiness Readiness
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&readiness))
+
+	return resp.StatusCode, readiness
+}
+
+func Test_ProxyHealthProbes(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.HealthConfig = &HealthConfig{ListenerAddr: "127.0.0.1:0"}
+	proxy := startTestProxy(t, config)
+
+	resp, err := http.Get("http://" + proxy.HealthAddress() + "/healthz")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	require.Eventually(t, func() bool {
+		status, _ := getReadiness(t, proxy)
+		return status == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Draining every upstream leaves nowhere to send traffic.
+	require.NoError(t, config.LoadBalancer.Drain(echoSrv.listener.Addr().String()))
+	status, readiness := getReadiness(t, proxy)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.False(t, readiness.Ready)
+	assert.Equal(t, "ok", readiness.Checks["listener"])
+	assert.Equal(t, "ok", readiness.Checks["tls"])
+	assert.Contains(t, readiness.Checks["upstreams"], "all upstreams are draining")
+	require.NoError(t, config.LoadBalancer.Undrain(echoSrv.listener.Addr().String()))
+
+	// A drained proxy is not ready, but still accepts connections.
+	proxy.Drain()
+	status, readiness = getReadiness(t, proxy)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "draining", readiness.Checks["listener"])
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
+
+func Test_ProxyCloseReportsNotReadyBeforeClosingListener(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.HealthConfig = &HealthConfig{ListenerAddr: "127.0.0.1:0", DrainDelay: 500 * time.Millisecond}
+	proxy := startTestProxy(t, config)
+	require.Eventually(t, func() bool {
+		status, _ := getReadiness(t, proxy)
+		return status == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	closed := make(chan error)
+	go func() { closed <- proxy.Close() }()
+
+	// While Close waits for the DrainDelay, readiness fails but the listener is still open.
+	require.Eventually(t, func() bool {
+		status, _ := getReadiness(t, proxy)
+		return status == http.StatusServiceUnavailable
+	}, 5*time.Second, 10*time.Millisecond)
+	conn, err := net.Dial("tcp", proxy.Address())
+	require.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	assert.NoError(t, <-closed)
+	_, err = net.Dial("tcp", proxy.Address())
+	assert.Error(t, err)
+	assert.NoError(t, echoSrv.close())
+}
+
+func TestProxy_CheckTLS(t *testing.T) {
+	config := testProxyConfig(t, echoServerAddr, "engineering")
+	proxy := &Proxy{config: config, listenerConfig: config.ListenerConfig}
+	assert.Equal(t, "no certificate loaded", proxy.checkTLS(time.Now()))
+
+	require.NoError(t, proxy.loadTLSConfig())
+	assert.Equal(t, "ok", proxy.checkTLS(time.Now()))
+	assert.Contains(t, proxy.checkTLS(time.Now().AddDate(100, 0, 0)), "certificate expired")
+	assert.Contains(t, proxy.checkTLS(time.Time{}), "not valid until")
+}
+
+func TestProxy_CheckUpstreams(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	address := listener.Addr().String()
+
+	loadBalancer, err := NewLeastConnectionBalancer([]string{address})
+	require.NoError(t, err)
+	routeBalancer, err := NewLeastConnectionBalancer([]string{address})
+	require.NoError(t, err)
+	proxy := &Proxy{
+		upstreamConfig: &UpstreamConfig{},
+		pool:           &upstreamPool{loadBalancer: loadBalancer},
+		passthrough:    []*passthroughRoute{{name: "db", pool: &upstreamPool{loadBalancer: routeBalancer}}},
+	}
+	assert.Equal(t, "ok", proxy.checkUpstreams())
+
+	// Every pool needs an upstream, including those of passthrough routes.
+	require.NoError(t, routeBalancer.Drain(address))
+	assert.Equal(t, `passthrough route "db": no upstream available, all upstreams are draining`, proxy.checkUpstreams())
+	require.NoError(t, routeBalancer.Undrain(address))
+
+	// An upstream that just failed to connect is not healthy, and is not dialed again yet.
+	upstream := loadBalancer.FetchUpstreams()[0]
+	upstream.recordDial(errors.New("connection refused"))
+	proxy.recheckFailedUpstreams()
+	assert.Equal(t, "no upstream reachable: connection refused", proxy.checkUpstreams())
+
+	// Once it failed long enough ago, it is dialed again in the background.
+	upstream.mutex.Lock()
+	upstream.dialTime = time.Now().Add(-upstreamRecheckInterval)
+	upstream.mutex.Unlock()
+	assert.Equal(t, "no upstream reachable: connection refused", proxy.checkUpstreams())
+	proxy.recheckFailedUpstreams()
+	assert.Equal(t, "ok", proxy.checkUpstreams())
+	assert.NoError(t, upstream.DialError())
+
+	// A failed recheck is recorded.
+	require.NoError(t, listener.Close())
+	upstream.recordDial(errors.New("connection refused"))
+	upstream.mutex.Lock()
+	upstream.dialTime = time.Now().Add(-upstreamRecheckInterval)
+	upstream.mutex.Unlock()
+	proxy.recheckFailedUpstreams()
+	assert.Contains(t, proxy.checkUpstreams(), "no upstream reachable: dial tcp")
+	assert.Error(t, upstream.DialError())
+}
+
+func TestProxy_RecheckFailedUpstreamsOriginatesTLS(t *testing.T) {
+	// The upstream accepts TCP connections but does not speak TLS, so only a real dial finds it unhealthy.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	loadBalancer, err := NewLeastConnectionBalancer([]string{listener.Addr().String()})
+	require.NoError(t, err)
+	proxy := &Proxy{
+		upstreamConfig: &UpstreamConfig{},
+		pool:           &upstreamPool{loadBalancer: loadBalancer, originateTLS: true},
+	}
+	proxy.upstreamTLSConfig.Store(&tls.Config{MinVersion: tls.VersionTLS13})
+
+	upstream := loadBalancer.FetchUpstreams()[0]
+	upstream.recordDial(errors.New("connection refused"))
+	upstream.mutex.Lock()
+	upstream.dialTime = time.Now().Add(-upstreamRecheckInterval)
+	upstream.mutex.Unlock()
+	proxy.recheckFailedUpstreams()
+	assert.Contains(t, proxy.checkUpstreams(), "TLS handshake with upstream")
+}
+
+func TestHealthConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&HealthConfig{ListenerAddr: "localhost:5002"}).validate())
+	assert.Error(t, (&HealthConfig{}).validate())
+	assert.Error(t, (&HealthConfig{ListenerAddr: "localhost:5002", DrainDelay: -time.Second}).validate())
+}
@@ -0,0 +1,268 @@
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultHooksQueueSize is how many notifications may be waiting for the Observer before new ones are dropped.
+	defaultHooksQueueSize = 1024
+	// defaultHooksAuthorizeTimeout is how long OnAuthorize may take before the connection is refused.
+	defaultHooksAuthorizeTimeout = 1 * time.Second
+)
+
+// Observer receives events about the connections a Proxy handles. Embed NopObserver to only implement some
+// methods.
+//
+// OnAuthorize is called synchronously before a connection is proxied, and may veto it by returning an error. It is
+// bounded by HooksConfig.AuthorizeTimeout. All other methods are notifications delivered in order from a single
+// goroutine, so they never block the proxy; if the Observer falls behind, notifications are dropped.
+type Observer interface {
+	// OnAccept is called when a connection is accepted, before the TLS handshake.
+	OnAccept(event AcceptEvent)
+	// OnHandshake is called once the TLS handshake has completed or failed.
+	OnHandshake(event HandshakeEvent)
+	// OnAuthorize is called once a client has passed the AuthorizedGroups check, before its rate limit is checked.
+	// Returning an error refuses the connection.
+	OnAuthorize(event AuthorizeEvent) error
+	// OnRateLimited is called when a client is refused for exceeding its rate limit.
+	OnRateLimited(event RateLimitedEvent)
+	// OnUpstreamSelected is called once the load balancer has picked an upstream for a session.
+	OnUpstreamSelected(event UpstreamSelectedEvent)
+	// OnDialError is called when connecting to the selected upstream fails.
+	OnDialError(event DialErrorEvent)
+	// OnSessionEnd is called when a session closes, with the same statistics written to the access log.
+	OnSessionEnd(record AccessLogRecord)
+}
+
+// AcceptEvent describes a newly accepted connection.
+type AcceptEvent struct {
+	ClientAddress string
+	Time          time.Time
+}
+
+// HandshakeEvent describes the outcome of a TLS handshake. Error is set if the handshake failed.
+type HandshakeEvent struct {
+	ClientAddress string
+	TLSVersion    string
+	CipherSuite   string
+	SNI           string
+	Error         error
+}
+
+// AuthorizeEvent describes a client that has passed the built-in authorization checks. Clients of passthrough
+// routes have no Certificate, User or Group, only the ServerName they sent.
+type AuthorizeEvent struct {
+	ClientAddress string
+	User          string
+	Group         string
+	Certificate   *x509.Certificate
+	ServerName    string
+}
+
+// RateLimitedEvent describes a client refused for exceeding its rate limit. RetryAfter is zero if the
+// RateLimitStore cannot tell when the client may retry.
+type RateLimitedEvent struct {
+	ClientAddress string
+	User          string
+	Group         string
+	RetryAfter    time.Duration
+}
+
+// UpstreamSelectedEvent describes the upstream chosen for a session.
+type UpstreamSelectedEvent struct {
+	SessionID string
+	User      string
+	Group     string
+	Upstream  string
+}
+
+// DialErrorEvent describes a failure to connect to the upstream chosen for a session.
+type DialErrorEvent struct {
+	SessionID string
+	User      string
+	Upstream  string
+	Error     error
+}
+
+// NopObserver implements every Observer method by doing nothing, and allowing every connection.
+type NopObserver struct{}
+
+func (NopObserver) OnAccept(AcceptEvent)                     {}
+func (NopObserver) OnHandshake(HandshakeEvent)               {}
+func (NopObserver) OnAuthorize(AuthorizeEvent) error         { return nil }
+func (NopObserver) OnRateLimited(RateLimitedEvent)           {}
+func (NopObserver) OnUpstreamSelected(UpstreamSelectedEvent) {}
+func (NopObserver) OnDialError(DialErrorEvent)               {}
+func (NopObserver) OnSessionEnd(AccessLogRecord)             {}
+
+// HooksConfig is the configuration for notifying an Observer of connection events.
+type HooksConfig struct {
+	// Observer receives the events.
+	Observer Observer `json:"-"`
+	// AuthorizeTimeout is how long OnAuthorize may take before the connection is refused. Defaults to 1 second.
+	AuthorizeTimeout time.Duration
+	// QueueSize is how many notifications may wait for the Observer before new ones are dropped. Defaults to 1024.
+	QueueSize int
+}
+
+func (c *HooksConfig) validate() error {
+	if c.Observer == nil {
+		return errors.New("hooks config does not contain an Observer")
+	}
+	if c.AuthorizeTimeout < 0 {
+		return errors.New("hooks AuthorizeTimeout cannot be negative")
+	}
+	if c.QueueSize < 0 {
+		return errors.New("hooks QueueSize cannot be negative")
+	}
+
+	return nil
+}
+
+// hooks delivers events to an Observer without letting it block the proxy. A nil *hooks discards all events, so
+// call sites do not need to check whether hooks are configured.
+type hooks struct {
+	observer         Observer
+	authorizeTimeout time.Duration
+	logger           *slog.Logger
+	queue            chan func(Observer)
+	dropped          atomic.Int64
+	shutdownC        chan struct{}
+}
+
+func newHooks(conf *HooksConfig, logger *slog.Logger) *hooks {
+	if conf == nil {
+		return nil
+	}
+
+	timeout, size := conf.AuthorizeTimeout, conf.QueueSize
+	if timeout == 0 {
+		timeout = defaultHooksAuthorizeTimeout
+	}
+	if size == 0 {
+		size = defaultHooksQueueSize
+	}
+	h := &hooks{
+		observer:         conf.Observer,
+		authorizeTimeout: timeout,
+		logger:           logger,
+		queue:            make(chan func(Observer), size),
+		shutdownC:        make(chan struct{}),
+	}
+	go h.deliver()
+
+	return h
+}
+
+// deliver calls queued notifications in order until close is called.
+func (h *hooks) deliver() {
+	for {
+		select {
+		case notify := <-h.queue:
+			h.call(notify)
+		case <-h.shutdownC:
+			return
+		}
+	}
+}
+
+// call runs a notification, recovering from any panic in the Observer.
+func (h *hooks) call(notify func(Observer)) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.logger.Error("observer panicked", slog.String("panic", fmt.Sprint(r)))
+		}
+	}()
+	notify(h.observer)
+}
+
+// notify queues a notification, dropping it if the Observer has fallen behind.
+func (h *hooks) notify(notify func(Observer)) {
+	if h == nil {
+		return
+	}
+
+	select {
+	case h.queue <- notify:
+	default:
+		if h.dropped.Add(1) == 1 {
+			h.logger.Warn("observer is not keeping up, dropping notifications")
+		}
+	}
+}
+
+// authorize asks the Observer whether a connection is allowed. The connection is refused if the Observer returns
+// an error, panics or does not answer within the AuthorizeTimeout.
+func (h *hooks) authorize(event AuthorizeEvent) error {
+	if h == nil {
+		return nil
+	}
+
+	// Buffered, so the goroutine can always finish even once we have stopped waiting for it.
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				result <- fmt.Errorf("observer panicked: %v", r)
+			}
+		}()
+		result <- h.observer.OnAuthorize(event)
+	}()
+
+	timer := time.NewTimer(h.authorizeTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return errors.New("observer did not authorize the connection in time")
+	}
+}
+
+func (h *hooks) close() {
+	if h == nil {
+		return
+	}
+	close(h.shutdownC)
+}
+
+// notifyHandshake tells the Observer about the outcome of a TLS handshake.
+func (p *Proxy) notifyHandshake(conn *tls.Conn, err error) {
+	if p.hooks == nil {
+		return
+	}
+
+	event := HandshakeEvent{ClientAddress: conn.RemoteAddr().String(), Error: err}
+	if err == nil {
+		state := conn.ConnectionState()
+		event.TLSVersion = tls.VersionName(state.Version)
+		event.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		event.SNI = state.ServerName
+	}
+	p.hooks.notify(func(o Observer) {
+		o.OnHandshake(event)
+	})
+}
+
+// notifyRateLimited tells the Observer a client was refused for exceeding its rate limit.
+func (p *Proxy) notifyRateLimited(conn net.Conn, user string, group string) {
+	if p.hooks == nil {
+		return
+	}
+
+	event := RateLimitedEvent{ClientAddress: conn.RemoteAddr().String(), User: user, Group: group}
+	if store, ok := p.rateLimitStore.(retryAfterStore); ok {
+		event.RetryAfter = store.RetryAfter(user)
+	}
+	p.hooks.notify(func(o Observer) {
+		o.OnRateLimited(event)
+	})
+}
@@ -0,0 +1,182 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingObserver records the name of every event it receives, and vetoes connections from vetoUser.
+type recordingObserver struct {
+	NopObserver
+	vetoUser string
+	events   chan string
+	sessions chan AccessLogRecord
+}
+
+func newRecordingObserver(vetoUser string) *recordingObserver {
+	return &recordingObserver{
+		vetoUser: vetoUser,
+		events:   make(chan string, 20),
+		sessions: make(chan AccessLogRecord, 1),
+	}
+}
+
+func (r *recordingObserver) OnAccept(AcceptEvent) {
+	r.events <- "accept"
+}
+
+func (r *recordingObserver) OnHandshake(event HandshakeEvent) {
+	r.events <- "handshake " + event.TLSVersion
+}
+
+func (r *recordingObserver) OnAuthorize(event AuthorizeEvent) error {
+	r.events <- "authorize " + event.User
+	if event.User == r.vetoUser {
+		return errors.New("vetoed")
+	}
+	return nil
+}
+
+func (r *recordingObserver) OnUpstreamSelected(UpstreamSelectedEvent) {
+	r.events <- "upstream selected"
+}
+
+func (r *recordingObserver) OnSessionEnd(record AccessLogRecord) {
+	r.events <- "session end"
+	r.sessions <- record
+}
+
+// nextEvents reads n events, failing the test if they do not arrive.
+func (r *recordingObserver) nextEvents(t *testing.T, n int) []string {
+	var events []string
+	for i := 0; i < n; i++ {
+		select {
+		case event := <-r.events:
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only received events %v", events)
+		}
+	}
+
+	return events
+}
+
+func Test_ProxyNotifiesObserver(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	observer := newRecordingObserver("")
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.HooksConfig = &HooksConfig{Observer: observer}
+	proxy := startTestProxy(t, config)
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	assert.Equal(t, 1, proxy.TerminateUserSessions("user1"))
+
+	// OnAuthorize is called synchronously, so it may be received before notifications queued ahead of it.
+	assert.ElementsMatch(t, []string{
+		"accept", "handshake TLS 1.3", "authorize user1", "upstream selected", "session end",
+	}, observer.nextEvents(t, 5))
+	record := <-observer.sessions
+	assert.Equal(t, "user1", record.User)
+	assert.Equal(t, int64(12), record.BytesIn)
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
+
+func Test_ProxyObserverVetoesConnection(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	observer := newRecordingObserver("user1")
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.ListenerConfig.RejectionMode = RejectionModeBanner
+	config.HooksConfig = &HooksConfig{Observer: observer}
+	proxy := startTestProxy(t, config)
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	banner, _ := bufio.NewReader(conn).ReadString('\n')
+	assert.Equal(t, "ERROR vetoed connection refused by policy\n", banner)
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
+
+// blockingObserver blocks in every method until released.
+type blockingObserver struct {
+	NopObserver
+	release chan struct{}
+	calls   sync.WaitGroup
+}
+
+func (b *blockingObserver) OnAccept(AcceptEvent) {
+	b.calls.Done()
+	<-b.release
+}
+
+func (b *blockingObserver) OnAuthorize(AuthorizeEvent) error {
+	<-b.release
+	return nil
+}
+
+func TestHooks_NeverBlock(t *testing.T) {
+	observer := &blockingObserver{release: make(chan struct{})}
+	defer close(observer.release)
+	h := newHooks(&HooksConfig{Observer: observer, AuthorizeTimeout: 10 * time.Millisecond, QueueSize: 1}, slog.Default())
+	defer h.close()
+
+	// The first notification is being delivered and the second is queued, so the rest are dropped immediately.
+	observer.calls.Add(1)
+	h.notify(func(o Observer) { o.OnAccept(AcceptEvent{}) })
+	observer.calls.Wait()
+	for i := 0; i < 10; i++ {
+		h.notify(func(o Observer) { o.OnAccept(AcceptEvent{}) })
+	}
+	assert.Equal(t, int64(9), h.dropped.Load())
+
+	// An OnAuthorize that never answers refuses the connection once the timeout passes.
+	assert.ErrorContains(t, h.authorize(AuthorizeEvent{}), "in time")
+}
+
+// panickingObserver panics in every method.
+type panickingObserver struct {
+	NopObserver
+}
+
+func (panickingObserver) OnAccept(AcceptEvent) {
+	panic("accept")
+}
+
+func (panickingObserver) OnAuthorize(AuthorizeEvent) error {
+	panic("authorize")
+}
+
+func TestHooks_RecoverFromPanics(t *testing.T) {
+	h := newHooks(&HooksConfig{Observer: panickingObserver{}}, slog.Default())
+	defer h.close()
+
+	assert.NotPanics(t, func() {
+		h.call(func(o Observer) { o.OnAccept(AcceptEvent{}) })
+	})
+	assert.ErrorContains(t, h.authorize(AuthorizeEvent{}), "panicked")
+}
+
+func TestHooks_Nil(t *testing.T) {
+	var h *hooks
+	h.notify(func(o Observer) { t.Fatal("notified without hooks") })
+	assert.NoError(t, h.authorize(AuthorizeEvent{}))
+	h.close()
+}
@@ -0,0 +1,38 @@
+package tcpproxy
+
+import "time"
+
+// Limiter decides whether a single client may open another connection. RateLimiter, SlidingWindowLogLimiter,
+// SlidingWindowCounterLimiter and GCRALimiter are the built-in implementations, selected with
+// RateLimitConfig.Algorithm.
+type Limiter interface {
+	// ConnectionAllowed returns true and records the connection if the client is within its limit.
+	ConnectionAllowed() bool
+	// Close releases any resources held by the Limiter.
+	Close() error
+}
+
+// retryAfterLimiter is implemented by Limiters that can estimate how long until the next connection is allowed.
+type retryAfterLimiter interface {
+	retryAfter() time.Duration
+}
+
+// inspectableLimiter is implemented by Limiters that can report how many connections they would currently allow.
+type inspectableLimiter interface {
+	retryAfterLimiter
+	remaining() int
+}
+
+// newLimiter constructs the Limiter for a given algorithm. The RateLimitConfig is expected to be validated.
+func newLimiter(conf *RateLimitConfig) Limiter {
+	switch conf.Algorithm {
+	case RateLimitAlgorithmSlidingWindowLog:
+		return NewSlidingWindowLogLimiter(conf.Capacity, conf.Window)
+	case RateLimitAlgorithmSlidingWindowCounter:
+		return NewSlidingWindowCounterLimiter(conf.Capacity, conf.Window)
+	case RateLimitAlgorithmGCRA:
+		return NewGCRALimiter(conf.Capacity, conf.FillRate)
+	default:
+		return NewRateLimiter(int64(conf.Capacity), conf.FillRate)
+	}
+}
@@ -2,13 +2,19 @@ package tcpproxy
 
 import (
 	"errors"
+	"fmt"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // LeastConnectionBalancer is a load balancer implementation configured to favor
-// upstreams with the least amount of connections when opening new connections.
+// upstreams with the least amount of connections when opening new connections. Upstreams can be added, removed,
+// drained and reweighted while the balancer is in use.
 type LeastConnectionBalancer struct {
 	upstreams []*Upstream
+	mutex     sync.RWMutex
 }
 
 // NewLeastConnectionBalancer constructs a configured LeastConnectionBalancer.
@@ -18,25 +24,144 @@ func NewLeastConnectionBalancer(targets []string) (*LeastConnectionBalancer, err
 	}
 	var upstreams []*Upstream
 	for _, target := range targets {
-		upstreams = append(upstreams, &Upstream{Address: target})
+		upstreams = append(upstreams, &Upstream{Address: target, weight: 1})
 	}
 
 	return &LeastConnectionBalancer{upstreams: upstreams}, nil
 }
 
-// FetchUpstream provides a target Upstream with the least amount of connections.
+// FetchUpstream provides a target Upstream with the least amount of connections relative to its weight. Draining
+// upstreams are never returned, and nil is returned if every upstream is draining.
 func (l *LeastConnectionBalancer) FetchUpstream() *Upstream {
+	// Hold the write lock so that choosing and claiming an upstream is atomic, otherwise concurrent callers could
+	// all pick the same least active upstream.
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
 	upstream := l.leastActiveUpstream()
+	if upstream == nil {
+		return nil
+	}
 	upstream.mutex.Lock()
 	upstream.connections += 1
 	upstream.mutex.Unlock()
 
-	return l.leastActiveUpstream()
+	return upstream
 }
 
 // FetchUpstreams returns all upstreams the LeastConnectionBalancer is configured with.
 func (l *LeastConnectionBalancer) FetchUpstreams() []*Upstream {
-	return l.upstreams
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return slices.Clone(l.upstreams)
+}
+
+// AddUpstream adds a new upstream with the given weight, which becomes eligible for new connections immediately.
+func (l *LeastConnectionBalancer) AddUpstream(address string, weight int) error {
+	if address == "" {
+		return errors.New("upstream address cannot be empty")
+	}
+	if weight < 1 {
+		return errors.New("upstream weight must be at least 1")
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.find(address) != nil {
+		return fmt.Errorf("upstream %q already exists", address)
+	}
+	l.upstreams = append(l.upstreams, &Upstream{Address: address, weight: weight})
+
+	return nil
+}
+
+// RemoveUpstream removes an upstream so it receives no new connections. Existing connections are unaffected and
+// may still Release the removed Upstream. The last upstream cannot be removed.
+func (l *LeastConnectionBalancer) RemoveUpstream(address string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	index := slices.IndexFunc(l.upstreams, func(upstream *Upstream) bool {
+		return upstream.Address == address
+	})
+	if index == -1 {
+		return fmt.Errorf("unknown upstream %q", address)
+	}
+	if len(l.upstreams) == 1 {
+		return errors.New("cannot remove the last upstream")
+	}
+	l.upstreams = slices.Delete(l.upstreams, index, index+1)
+
+	return nil
+}
+
+// SetWeight changes the weight of an upstream. An upstream with weight 2 is given twice as many connections as an
+// upstream with weight 1.
+func (l *LeastConnectionBalancer) SetWeight(address string, weight int) error {
+	if weight < 1 {
+		return errors.New("upstream weight must be at least 1")
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	upstream := l.find(address)
+	if upstream == nil {
+		return fmt.Errorf("unknown upstream %q", address)
+	}
+	upstream.mutex.Lock()
+	upstream.weight = weight
+	upstream.mutex.Unlock()
+
+	return nil
+}
+
+// Drain stops new connections from being routed to the upstream with the given address. Existing connections
+// are unaffected.
+func (l *LeastConnectionBalancer) Drain(address string) error {
+	return l.setDraining(address, true)
+}
+
+// Undrain allows new connections to be routed to a previously drained upstream again.
+func (l *LeastConnectionBalancer) Undrain(address string) error {
+	return l.setDraining(address, false)
+}
+
+func (l *LeastConnectionBalancer) setDraining(address string, draining bool) error {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	upstream := l.find(address)
+	if upstream == nil {
+		return fmt.Errorf("unknown upstream %q", address)
+	}
+	upstream.draining.Store(draining)
+
+	return nil
+}
+
+// recordDial remembers the outcome of an attempt to connect to the upstream with the given address, if it is still
+// configured.
+func (l *LeastConnectionBalancer) recordDial(address string, err error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if upstream := l.find(address); upstream != nil {
+		upstream.recordDial(err)
+	}
+}
+
+// find returns the upstream with the given address, or nil. The caller must hold the mutex.
+func (l *LeastConnectionBalancer) find(address string) *Upstream {
+	for _, upstream := range l.upstreams {
+		if upstream.Address == address {
+			return upstream
+		}
+	}
+
+	return nil
 }
 
 // Upstream is a wrapper around an upstream Address that connections can use. Callers should use upstream.Release()
@@ -46,7 +171,12 @@ type Upstream struct {
 	Address string
 
 	connections int
-	mutex       sync.RWMutex
+	weight      int
+	draining    atomic.Bool
+	// dialErr is the outcome of the most recent attempt to connect, made at dialTime.
+	dialErr  error
+	dialTime time.Time
+	mutex    sync.RWMutex
 }
 
 // Release will decrement the count of current connections, used when a proxied request is complete.
@@ -70,16 +200,59 @@ func (u *Upstream) Connections() int {
 	return connections
 }
 
+// Weight will return the relative share of connections the upstream receives.
+func (u *Upstream) Weight() int {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return u.weight
+}
+
+// Draining reports whether the upstream is excluded from new connections.
+func (u *Upstream) Draining() bool {
+	return u.draining.Load()
+}
+
+// DialError returns the error of the most recent attempt to connect to the upstream, by a session or to pre-warm a
+// connection, or nil if it succeeded or no attempt has been made.
+func (u *Upstream) DialError() error {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return u.dialErr
+}
+
+// lastDial returns the outcome of the most recent attempt to connect to the upstream, and when it was made.
+func (u *Upstream) lastDial() (time.Time, error) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return u.dialTime, u.dialErr
+}
+
+func (u *Upstream) recordDial(err error) {
+	u.mutex.Lock()
+	u.dialErr, u.dialTime = err, time.Now()
+	u.mutex.Unlock()
+}
+
 // leastActiveUpstream will iterate upstreams until it finds one with either 0 or the least amount
-// of connections. This is a naive implementation that could be improved if performance was a concern.
+// of connections relative to its weight, skipping any that are draining. This is a naive implementation that could
+// be improved if performance was a concern. The caller must hold the mutex.
 func (l *LeastConnectionBalancer) leastActiveUpstream() *Upstream {
-	leastActiveUpstream := l.upstreams[0]
-	leastActiveConnections := -1
+	var leastActiveUpstream *Upstream
+	leastActiveConnections, leastActiveWeight := -1, 1
 	for _, upstream := range l.upstreams {
+		if upstream.Draining() {
+			continue
+		}
 		upstream.mutex.RLock()
 
-		if (upstream.connections < leastActiveConnections) || leastActiveConnections == -1 {
+		// Compare connections/weight without division: a/wa < b/wb is equivalent to a*wb < b*wa.
+		if leastActiveConnections == -1 ||
+			upstream.connections*leastActiveWeight < leastActiveConnections*upstream.weight {
 			leastActiveConnections = upstream.connections
+			leastActiveWeight = upstream.weight
 			leastActiveUpstream = upstream
 		}
 
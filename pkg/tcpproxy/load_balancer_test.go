@@ -1,6 +1,8 @@
 package tcpproxy
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -39,3 +41,66 @@ func Test_UpstreamConnectionsCannotBeNegative(t *testing.T) {
 	target.Release()
 	assert.Equal(t, 0, target.Connections())
 }
+
+func Test_LeastConnectionLoadBalancerWeights(t *testing.T) {
+	balancer, err := NewLeastConnectionBalancer([]string{":5000"})
+	require.NoError(t, err)
+	require.NoError(t, balancer.AddUpstream(":5001", 3))
+
+	// The heavier upstream should receive three connections for every one to the lighter upstream.
+	for i := 0; i < 8; i++ {
+		balancer.FetchUpstream()
+	}
+	upstreams := balancer.FetchUpstreams()
+	assert.Equal(t, 2, upstreams[0].Connections())
+	assert.Equal(t, 6, upstreams[1].Connections())
+
+	require.NoError(t, balancer.SetWeight(":5000", 3))
+	assert.Equal(t, ":5000", balancer.FetchUpstream().Address)
+
+	assert.Error(t, balancer.SetWeight(":5000", 0))
+	assert.Error(t, balancer.SetWeight(":5009", 1))
+	assert.Error(t, balancer.AddUpstream(":5001", 1))
+	assert.Error(t, balancer.AddUpstream(":5002", 0))
+}
+
+func Test_LeastConnectionLoadBalancerRemoveUpstream(t *testing.T) {
+	balancer, err := NewLeastConnectionBalancer([]string{":5000", ":5001"})
+	require.NoError(t, err)
+
+	// A removed upstream receives no new connections, but its existing connections can still be released.
+	target := balancer.FetchUpstream()
+	require.NoError(t, balancer.RemoveUpstream(target.Address))
+	for i := 0; i < 3; i++ {
+		assert.NotEqual(t, target.Address, balancer.FetchUpstream().Address)
+	}
+	target.Release()
+	assert.Equal(t, 0, target.Connections())
+
+	assert.Error(t, balancer.RemoveUpstream(target.Address))
+	assert.Error(t, balancer.RemoveUpstream(balancer.FetchUpstreams()[0].Address))
+}
+
+func Test_LeastConnectionLoadBalancerConcurrentChanges(t *testing.T) {
+	balancer, err := NewLeastConnectionBalancer([]string{":5000"})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		address := fmt.Sprintf(":%d", 6000+i)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, balancer.AddUpstream(address, 1))
+			assert.NoError(t, balancer.Drain(address))
+			assert.NoError(t, balancer.RemoveUpstream(address))
+		}()
+		go func() {
+			defer wg.Done()
+			balancer.FetchUpstream().Release()
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, balancer.FetchUpstreams(), 1)
+}
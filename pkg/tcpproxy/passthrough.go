@@ -0,0 +1,289 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// clientHelloReadTimeout bounds how long a client may take to send its ClientHello when passthrough routes are
+// configured.
+const clientHelloReadTimeout = 5 * time.Second
+
+// errClientHelloRead aborts the handshake used to parse a ClientHello once it has been read.
+var errClientHelloRead = errors.New("client hello read")
+
+// PassthroughConfig is the configuration for TLS passthrough, where connections are routed on the SNI and ALPN
+// of their ClientHello and forwarded without terminating TLS, so that upstreams can terminate it themselves. The
+// ClientHello of every connection is read first, and connections matching no route have TLS terminated by the
+// proxy as usual, so one listener can serve both.
+//
+// There is no client certificate to inspect in passthrough, so routes are authorized by source address only.
+type PassthroughConfig struct {
+	// Routes are matched in order, and the first route matching a connection is used.
+	Routes []PassthroughRoute
+}
+
+// PassthroughRoute forwards the connections it matches to its Targets without terminating TLS.
+type PassthroughRoute struct {
+	// Name is a label for the route.
+	Name string
+	// ServerNames are matched against the SNI, ignoring case. A name starting with "*." matches a single label in
+	// its place, so "*.example.com" matches "db.example.com" but not "example.com".
+	ServerNames []string
+	// ALPNProtocols optionally restricts the route to clients offering at least one of these protocols.
+	ALPNProtocols []string
+	// Targets is a list of upstream network addresses, which are expected to terminate TLS.
+	Targets []string
+
+	// AllowedSources lists the CIDRs clients may connect from, for example "10.0.0.0/8". Use "0.0.0.0/0" and
+	// "::/0" to allow every client.
+	AllowedSources []string
+
+	// ProxyProtocol optionally sends a PROXY protocol header as the first bytes of each upstream connection.
+	// Version 2 headers carry the SNI, but there is no client identity to include.
+	ProxyProtocol ProxyProtocolVersion
+
+	// Prewarm optionally keeps idle connections open to each of the Targets. It cannot be combined with
+	// ProxyProtocol.
+	Prewarm *PrewarmConfig
+}
+
+func (c *PassthroughConfig) validate() error {
+	if len(c.Routes) == 0 {
+		return errors.New("passthrough config does not contain any Routes")
+	}
+	for _, route := range c.Routes {
+		if len(route.ServerNames) == 0 {
+			return fmt.Errorf("passthrough route %q does not contain any ServerNames", route.Name)
+		}
+		if len(route.Targets) == 0 {
+			return fmt.Errorf("passthrough route %q does not contain any Targets", route.Name)
+		}
+		if len(route.AllowedSources) == 0 {
+			return fmt.Errorf("passthrough route %q does not contain any AllowedSources", route.Name)
+		}
+		if _, err := parseCIDRs(route.AllowedSources); err != nil {
+			return fmt.Errorf("passthrough route %q has invalid AllowedSources: %w", route.Name, err)
+		}
+		switch route.ProxyProtocol {
+		case "", ProxyProtocolV1, ProxyProtocolV2:
+		default:
+			return fmt.Errorf("passthrough route %q has unknown PROXY protocol version %q", route.Name,
+				route.ProxyProtocol)
+		}
+		if route.Prewarm != nil {
+			if err := route.Prewarm.validate(); err != nil {
+				return fmt.Errorf("passthrough route %q: %w", route.Name, err)
+			}
+			if route.ProxyProtocol != "" {
+				return fmt.Errorf("passthrough route %q cannot combine prewarm with ProxyProtocol", route.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// passthroughRoute is a PassthroughRoute ready to match connections.
+type passthroughRoute struct {
+	name           string
+	serverNames    []string
+	alpnProtocols  []string
+	allowedSources []netip.Prefix
+	pool           *upstreamPool
+}
+
+// newPassthroughRoutes prepares the routes of a validated PassthroughConfig, which may be nil.
+func newPassthroughRoutes(conf *PassthroughConfig) ([]*passthroughRoute, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	routes := make([]*passthroughRoute, 0, len(conf.Routes))
+	for _, route := range conf.Routes {
+		loadBalancer, err := NewLeastConnectionBalancer(route.Targets)
+		if err != nil {
+			return nil, err
+		}
+		// The CIDRs were already parsed by Validate, so this cannot fail.
+		allowedSources, _ := parseCIDRs(route.AllowedSources)
+		serverNames := make([]string, 0, len(route.ServerNames))
+		for _, name := range route.ServerNames {
+			serverNames = append(serverNames, strings.ToLower(name))
+		}
+
+		routes = append(routes, &passthroughRoute{
+			name:           route.Name,
+			serverNames:    serverNames,
+			alpnProtocols:  route.ALPNProtocols,
+			allowedSources: allowedSources,
+			pool:           &upstreamPool{loadBalancer: loadBalancer, proxyProtocol: route.ProxyProtocol},
+		})
+	}
+
+	return routes, nil
+}
+
+// matches reports whether a ClientHello with the given SNI and ALPN protocols should use the route.
+func (r *passthroughRoute) matches(hello clientHello) bool {
+	serverName := strings.ToLower(hello.serverName)
+	if !slices.ContainsFunc(r.serverNames, func(name string) bool {
+		if suffix, ok := strings.CutPrefix(name, "*"); ok {
+			label, found := strings.CutSuffix(serverName, suffix)
+			return found && label != "" && !strings.Contains(label, ".")
+		}
+		return name == serverName
+	}) {
+		return false
+	}
+
+	return len(r.alpnProtocols) == 0 || slices.ContainsFunc(hello.alpnProtocols, func(protocol string) bool {
+		return slices.Contains(r.alpnProtocols, protocol)
+	})
+}
+
+// clientHello is the part of a ClientHello used for routing.
+type clientHello struct {
+	serverName    string
+	alpnProtocols []string
+}
+
+// passthroughConn replays the bytes read while peeking at the ClientHello, before reading from the connection.
+type passthroughConn struct {
+	net.Conn
+	buffered *bytes.Buffer
+	hello    clientHello
+}
+
+func (c *passthroughConn) Read(b []byte) (int, error) {
+	if c.buffered.Len() > 0 {
+		return c.buffered.Read(b)
+	}
+
+	return c.Conn.Read(b)
+}
+
+// unwrap writes the rest of the replayed bytes to w, then returns the underlying connection.
+func (c *passthroughConn) unwrap(w io.Writer) (int64, net.Conn, error) {
+	n, err := c.buffered.WriteTo(w)
+
+	return n, c.Conn, err
+}
+
+// readOnlyConn lets a tls.Server read a ClientHello without writing anything back to the client.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c readOnlyConn) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekClientHello reads the ClientHello from conn, returning it along with a connection that replays the bytes
+// read, so that TLS can still be passed through or terminated.
+func peekClientHello(conn net.Conn) (clientHello, net.Conn, error) {
+	var hello clientHello
+	var buffer bytes.Buffer
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloReadTimeout))
+	err := tls.Server(readOnlyConn{Conn: conn, reader: io.TeeReader(conn, &buffer)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = clientHello{serverName: info.ServerName, alpnProtocols: info.SupportedProtos}
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errClientHelloRead) {
+		return clientHello{}, nil, err
+	}
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		return clientHello{}, nil, err
+	}
+
+	return hello, &passthroughConn{Conn: conn, buffered: &buffer, hello: hello}, nil
+}
+
+// routePassthrough reads the ClientHello of conn, returning the connection to use from now on and the first
+// passthrough route it matches, or nil if TLS should be terminated.
+func (p *Proxy) routePassthrough(conn net.Conn) (net.Conn, *passthroughRoute, error) {
+	hello, peeked, err := peekClientHello(conn)
+	if err != nil {
+		return conn, nil, err
+	}
+	for _, route := range p.passthrough {
+		if route.matches(hello) {
+			return peeked, route, nil
+		}
+	}
+
+	return peeked, nil, nil
+}
+
+// servePassthrough authorizes a connection matching a passthrough route by its source address, and proxies it
+// to the route's upstreams without terminating TLS, returning once the connection is closed. It ends the accept
+// span in ctx if the connection is refused.
+func (p *Proxy) servePassthrough(ctx context.Context, conn net.Conn, route *passthroughRoute) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attributePassthroughRoute.String(route.name))
+
+	reason := p.passthroughAuthorized(ctx, conn, route)
+	p.auditDecision(conn, auditDecisionFor(reason), "", "", nil)
+	if reason != "" {
+		p.logger.WarnContext(
+			ctx,
+			"client is not authorized for passthrough route",
+			slog.String("client", conn.RemoteAddr().String()),
+			slog.String("route", route.name),
+			slog.String("reason", string(reason)),
+		)
+		_ = conn.Close()
+		span.SetAttributes(attributeRejectionReason.String(string(reason)))
+		endSpan(span, errors.New(reason.message()))
+		return
+	}
+
+	p.handleConnection(ctx, conn, route.pool, "", "")
+}
+
+// passthroughAuthorized checks that a passthrough connection comes from one of the route's AllowedSources, and
+// that the Observer does not veto it. It returns an empty RejectionReason if the connection is authorized.
+func (p *Proxy) passthroughAuthorized(ctx context.Context, conn net.Conn, route *passthroughRoute) RejectionReason {
+	ctx, span := p.tracer.Start(ctx, "authorize")
+	defer span.End()
+
+	if !prefixesContain(route.allowedSources, conn.RemoteAddr()) {
+		span.SetAttributes(attributeRejectionReason.String(string(RejectionReasonSourceNotAllowed)))
+		return RejectionReasonSourceNotAllowed
+	}
+
+	var serverName string
+	if peeked, ok := conn.(*passthroughConn); ok {
+		serverName = peeked.hello.serverName
+	}
+	if err := p.hooks.authorize(AuthorizeEvent{
+		ClientAddress: conn.RemoteAddr().String(),
+		ServerName:    serverName,
+	}); err != nil {
+		p.logger.InfoContext(ctx, "observer refused connection", slog.String("route", route.name),
+			slog.String("error", err.Error()))
+		span.SetAttributes(attributeRejectionReason.String(string(RejectionReasonVetoed)))
+		return RejectionReasonVetoed
+	}
+
+	return ""
+}
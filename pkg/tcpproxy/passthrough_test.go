@@ -0,0 +1,196 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassthroughConfig_Validate(t *testing.T) {
+	valid := PassthroughRoute{
+		Name:           "db",
+		ServerNames:    []string{"db.example.com"},
+		Targets:        []string{"10.0.0.1:5432"},
+		AllowedSources: []string{"10.0.0.0/8"},
+	}
+	assert.NoError(t, (&PassthroughConfig{Routes: []PassthroughRoute{valid}}).validate())
+	assert.Error(t, (&PassthroughConfig{}).validate())
+
+	tests := map[string]func(route *PassthroughRoute){
+		"no server names":   func(route *PassthroughRoute) { route.ServerNames = nil },
+		"no targets":        func(route *PassthroughRoute) { route.Targets = nil },
+		"no sources":        func(route *PassthroughRoute) { route.AllowedSources = nil },
+		"invalid source":    func(route *PassthroughRoute) { route.AllowedSources = []string{"10.0.0.1"} },
+		"unknown PROXY ver": func(route *PassthroughRoute) { route.ProxyProtocol = "v3" },
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			route := valid
+			modify(&route)
+			assert.Error(t, (&PassthroughConfig{Routes: []PassthroughRoute{route}}).validate())
+		})
+	}
+}
+
+func TestPassthroughRoute_Matches(t *testing.T) {
+	routes, err := newPassthroughRoutes(&PassthroughConfig{Routes: []PassthroughRoute{{
+		ServerNames:    []string{"DB.example.com", "*.internal.example.com"},
+		ALPNProtocols:  []string{"postgresql"},
+		Targets:        []string{"10.0.0.1:5432"},
+		AllowedSources: []string{"10.0.0.0/8"},
+	}}})
+	require.NoError(t, err)
+	route := routes[0]
+
+	assert.True(t, route.matches(clientHello{serverName: "db.example.com", alpnProtocols: []string{"postgresql"}}))
+	assert.True(t, route.matches(clientHello{serverName: "a.internal.example.com", alpnProtocols: []string{
+		"h2", "postgresql",
+	}}))
+	assert.False(t, route.matches(clientHello{serverName: "db.example.com", alpnProtocols: []string{"h2"}}))
+	assert.False(t, route.matches(clientHello{serverName: "db.example.com"}))
+	assert.False(t, route.matches(clientHello{serverName: "internal.example.com", alpnProtocols: []string{
+		"postgresql",
+	}}))
+	assert.False(t, route.matches(clientHello{serverName: "a.b.internal.example.com", alpnProtocols: []string{
+		"postgresql",
+	}}))
+	assert.False(t, route.matches(clientHello{alpnProtocols: []string{"postgresql"}}))
+}
+
+func TestPeekClientHello(t *testing.T) {
+	serverConfig, err := serverTLSConfig(certificatePath("ca.pem"), certificatePath("tcp-proxy.pem"),
+		certificatePath("tcp-proxy.key"))
+	require.NoError(t, err)
+	clientConn, serverConn := net.Pipe()
+	defer func() { _ = clientConn.Close() }()
+
+	clientConfig := clientTlsConfig(t, "user1")
+	clientConfig.ServerName = "localhost"
+	clientConfig.NextProtos = []string{"h2", "http/1.1"}
+	handshakeErr := make(chan error, 1)
+	go func() {
+		handshakeErr <- tls.Client(clientConn, clientConfig).Handshake()
+	}()
+
+	hello, peeked, err := peekClientHello(serverConn)
+	require.NoError(t, err)
+	assert.Equal(t, clientHello{serverName: "localhost", alpnProtocols: []string{"h2", "http/1.1"}}, hello)
+
+	// The ClientHello is replayed, so the handshake can still be completed with the peeked connection.
+	require.NoError(t, tls.Server(peeked, serverConfig).Handshake())
+	require.NoError(t, <-handshakeErr)
+	assert.NoError(t, peeked.Close())
+}
+
+func TestPeekClientHello_NotTLS(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer func() { _ = clientConn.Close() }()
+	go func() {
+		_, _ = clientConn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	}()
+
+	_, _, err := peekClientHello(serverConn)
+	assert.Error(t, err)
+}
+
+func Test_ProxyPassesThroughTLS(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	tlsEchoSrv := setupTLSEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.PassthroughConfig = &PassthroughConfig{Routes: []PassthroughRoute{{
+		Name:           "echo",
+		ServerNames:    []string{"localhost"},
+		Targets:        []string{tlsEchoSrv.listener.Addr().String()},
+		AllowedSources: []string{"127.0.0.0/8"},
+	}}}
+	sink := newRecordingSink()
+	config.AccessLogConfig = &AccessLogConfig{Sink: sink}
+	proxy := startTestProxy(t, config)
+
+	// The TLS session is with the upstream, which requires the client's certificate itself.
+	clientConfig := clientTlsConfig(t, "user1")
+	clientConfig.ServerName = "localhost"
+	conn, err := tls.Dial("tcp", proxy.Address(), clientConfig)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello world\n", string(line))
+	assert.Equal(t, 1, proxy.TerminateUserSessions(""))
+	select {
+	case record := <-sink.records:
+		assert.Equal(t, "localhost", record.SNI)
+		assert.Empty(t, record.User)
+		assert.Empty(t, record.TLSVersion)
+		assert.Equal(t, tlsEchoSrv.listener.Addr().String(), record.Upstream)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not close")
+	}
+	assert.NoError(t, conn.Close())
+
+	// Connections matching no route have TLS terminated by the proxy, on the same listener.
+	echoThroughProxy(t, proxy, "user1", "hello world\n")
+	select {
+	case record := <-sink.records:
+		assert.Equal(t, "user1", record.User)
+		assert.Equal(t, echoSrv.listener.Addr().String(), record.Upstream)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not close")
+	}
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+	assert.NoError(t, tlsEchoSrv.close())
+}
+
+func Test_ProxyRefusesPassthroughFromDisallowedSources(t *testing.T) {
+	tlsEchoSrv := setupTLSEchoServer(t)
+	config := testProxyConfig(t, tlsEchoSrv.listener.Addr().String(), "engineering")
+	config.PassthroughConfig = &PassthroughConfig{Routes: []PassthroughRoute{{
+		Name:           "echo",
+		ServerNames:    []string{"localhost"},
+		Targets:        []string{tlsEchoSrv.listener.Addr().String()},
+		AllowedSources: []string{"10.0.0.0/8"},
+	}}}
+	proxy := startTestProxy(t, config)
+
+	clientConfig := clientTlsConfig(t, "user1")
+	clientConfig.ServerName = "localhost"
+	_, err := tls.Dial("tcp", proxy.Address(), clientConfig)
+	assert.Error(t, err)
+	assert.Zero(t, proxy.sessions.count())
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, tlsEchoSrv.close())
+}
+
+func Test_ProxyAcceptsWhileWaitingForClientHello(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	tlsEchoSrv := setupTLSEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.PassthroughConfig = &PassthroughConfig{Routes: []PassthroughRoute{{
+		Name:           "echo",
+		ServerNames:    []string{"localhost"},
+		Targets:        []string{tlsEchoSrv.listener.Addr().String()},
+		AllowedSources: []string{"127.0.0.0/8"},
+	}}}
+	proxy := startTestProxy(t, config)
+
+	// A client that never sends its ClientHello does not hold up the next one.
+	silent, err := net.Dial("tcp", proxy.Address())
+	require.NoError(t, err)
+	defer func() { _ = silent.Close() }()
+	start := time.Now()
+	echoThroughProxy(t, proxy, "user1", "hello world\n")
+	assert.Less(t, time.Since(start), clientHelloReadTimeout)
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+	assert.NoError(t, tlsEchoSrv.close())
+}
@@ -0,0 +1,235 @@
+package tcpproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// pcapng block types and constants, as described in https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html.
+const (
+	pcapngSectionHeaderBlock        = 0x0A0D0D0A
+	pcapngInterfaceDescriptionBlock = 0x00000001
+	pcapngEnhancedPacketBlock       = 0x00000006
+	pcapngByteOrderMagic            = 0x1A2B3C4D
+	// pcapngLinkTypeRaw marks packets as starting with an IPv4 or IPv6 header, without a link layer.
+	pcapngLinkTypeRaw = 101
+)
+
+// TCP flags set on synthesized segments.
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// captureSegmentSize is the largest payload carried by a single synthesized segment, keeping packets well within
+// the 65535 byte limit of an IPv4 packet.
+const captureSegmentSize = 32 * 1024
+
+// pcapngWriter writes packets to a pcapng file with a single raw IP interface. Timestamps are in microseconds,
+// the pcapng default.
+type pcapngWriter struct {
+	w io.Writer
+	// written is the number of bytes written to w.
+	written int64
+}
+
+// newPcapngWriter writes the section header and interface description to w.
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	p := &pcapngWriter{w: w}
+
+	section := make([]byte, 16)
+	binary.LittleEndian.PutUint32(section[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(section[4:], 1) // Major version.
+	binary.LittleEndian.PutUint16(section[6:], 0) // Minor version.
+	binary.LittleEndian.PutUint64(section[8:], ^uint64(0))
+	if _, err := p.writeBlock(pcapngSectionHeaderBlock, section); err != nil {
+		return nil, err
+	}
+
+	// The link type is followed by a reserved field and a snap length of 0, meaning unlimited.
+	iface := make([]byte, 8)
+	binary.LittleEndian.PutUint16(iface[0:], pcapngLinkTypeRaw)
+	if _, err := p.writeBlock(pcapngInterfaceDescriptionBlock, iface); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// enhancedPacketBlockSize returns the size of an enhanced packet block carrying a packet of the given length.
+func enhancedPacketBlockSize(packetLength int) int {
+	return 12 + 20 + padded(packetLength)
+}
+
+// writePacket writes a single packet captured at t, returning the number of bytes written.
+func (p *pcapngWriter) writePacket(t time.Time, packet []byte) (int, error) {
+	body := make([]byte, 20+padded(len(packet)))
+	micros := uint64(t.UnixMicro())
+	binary.LittleEndian.PutUint32(body[0:], 0) // Interface ID.
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	copy(body[20:], packet)
+
+	return p.writeBlock(pcapngEnhancedPacketBlock, body)
+}
+
+// writeBlock frames body, which must already be padded to 32 bits, with the block type and lengths.
+func (p *pcapngWriter) writeBlock(blockType uint32, body []byte) (int, error) {
+	length := uint32(12 + len(body))
+	block := make([]byte, 0, length)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	n, err := p.w.Write(block)
+	p.written += int64(n)
+
+	return n, err
+}
+
+// padded rounds n up to a multiple of 4.
+func padded(n int) int {
+	return (n + 3) &^ 3
+}
+
+// tcpEndpoint is one side of a synthesized TCP connection, tracking the next sequence number it sends.
+type tcpEndpoint struct {
+	addr netip.AddrPort
+	seq  uint32
+}
+
+// tcpFlow synthesizes the packets of a TCP connection between a client and a server, so that byte streams
+// observed above TCP can be inspected with tools expecting packets.
+type tcpFlow struct {
+	client tcpEndpoint
+	server tcpEndpoint
+}
+
+// newTCPFlow returns a flow between client and server. If their address families differ, both are represented as
+// IPv6, mapping the IPv4 address.
+func newTCPFlow(client netip.AddrPort, server netip.AddrPort) *tcpFlow {
+	clientAddr, serverAddr := client.Addr().Unmap(), server.Addr().Unmap()
+	if clientAddr.Is4() != serverAddr.Is4() {
+		clientAddr, serverAddr = netip.AddrFrom16(clientAddr.As16()), netip.AddrFrom16(serverAddr.As16())
+	}
+
+	return &tcpFlow{
+		client: tcpEndpoint{addr: netip.AddrPortFrom(clientAddr, client.Port())},
+		server: tcpEndpoint{addr: netip.AddrPortFrom(serverAddr, server.Port())},
+	}
+}
+
+// handshake returns the SYN, SYN-ACK and ACK opening the connection.
+func (f *tcpFlow) handshake() [][]byte {
+	syn := tcpSegment(&f.client, &f.server, tcpFlagSYN, nil)
+	f.client.seq++
+	synAck := tcpSegment(&f.server, &f.client, tcpFlagSYN|tcpFlagACK, nil)
+	f.server.seq++
+
+	return [][]byte{syn, synAck, tcpSegment(&f.client, &f.server, tcpFlagACK, nil)}
+}
+
+// data returns the segments carrying payload, sent by the client if fromClient is true, otherwise by the server.
+func (f *tcpFlow) data(fromClient bool, payload []byte) [][]byte {
+	src, dst := f.endpoints(fromClient)
+
+	var packets [][]byte
+	for len(payload) > 0 {
+		chunk := payload[:min(len(payload), captureSegmentSize)]
+		packets = append(packets, tcpSegment(src, dst, tcpFlagPSH|tcpFlagACK, chunk))
+		src.seq += uint32(len(chunk))
+		payload = payload[len(chunk):]
+	}
+
+	return packets
+}
+
+// fin returns a FIN sent by the client if fromClient is true, otherwise by the server.
+func (f *tcpFlow) fin(fromClient bool) []byte {
+	src, dst := f.endpoints(fromClient)
+	packet := tcpSegment(src, dst, tcpFlagFIN|tcpFlagACK, nil)
+	src.seq++
+
+	return packet
+}
+
+func (f *tcpFlow) endpoints(fromClient bool) (*tcpEndpoint, *tcpEndpoint) {
+	if fromClient {
+		return &f.client, &f.server
+	}
+
+	return &f.server, &f.client
+}
+
+// tcpSegment builds an IP packet holding a TCP segment from src to dst, acknowledging everything dst has sent.
+func tcpSegment(src *tcpEndpoint, dst *tcpEndpoint, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.addr.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.addr.Port())
+	binary.BigEndian.PutUint32(tcp[4:], src.seq)
+	if flags&tcpFlagACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], dst.seq)
+	}
+	tcp[12] = 5 << 4 // Data offset, in 32-bit words.
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // Window size.
+	copy(tcp[20:], payload)
+
+	srcIP, dstIP := src.addr.Addr().AsSlice(), dst.addr.Addr().AsSlice()
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(append(pseudo, srcIP...), dstIP...)
+	if src.addr.Addr().Is4() {
+		pseudo = append(pseudo, 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(tcp)))
+	} else {
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(tcp)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(tcp[16:], internetChecksum(pseudo, tcp))
+
+	if src.addr.Addr().Is4() {
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 4<<4 | 5 // Version and header length, in 32-bit words.
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[8] = 64 // Time to live.
+		ip[9] = 6  // Protocol: TCP.
+		copy(ip[12:], srcIP)
+		copy(ip[16:], dstIP)
+		binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip))
+		return append(ip, tcp...)
+	}
+
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6  // Next header: TCP.
+	ip[7] = 64 // Hop limit.
+	copy(ip[8:], srcIP)
+	copy(ip[24:], dstIP)
+	return append(ip, tcp...)
+}
+
+// internetChecksum computes the RFC 1071 checksum over the concatenation of chunks, each of even length except
+// possibly the last.
+func internetChecksum(chunks ...[]byte) uint16 {
+	var sum uint32
+	for _, chunk := range chunks {
+		for i := 0; i+1 < len(chunk); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(chunk[i:]))
+		}
+		if len(chunk)%2 == 1 {
+			sum += uint32(chunk[len(chunk)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,108 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readPcapngPackets parses a pcapng file written by pcapngWriter, returning the packets it contains.
+func readPcapngPackets(t *testing.T, data []byte) [][]byte {
+	var packets [][]byte
+	for blockIndex := 0; len(data) > 0; blockIndex++ {
+		require.GreaterOrEqual(t, len(data), 12)
+		blockType := binary.LittleEndian.Uint32(data)
+		length := int(binary.LittleEndian.Uint32(data[4:]))
+		require.LessOrEqual(t, length, len(data))
+		require.Equal(t, uint32(length), binary.LittleEndian.Uint32(data[length-4:]), "trailing block length")
+
+		switch blockIndex {
+		case 0:
+			require.Equal(t, uint32(pcapngSectionHeaderBlock), blockType)
+			require.Equal(t, uint32(pcapngByteOrderMagic), binary.LittleEndian.Uint32(data[8:]))
+		case 1:
+			require.Equal(t, uint32(pcapngInterfaceDescriptionBlock), blockType)
+			require.Equal(t, uint16(pcapngLinkTypeRaw), binary.LittleEndian.Uint16(data[8:]))
+		default:
+			require.Equal(t, uint32(pcapngEnhancedPacketBlock), blockType)
+			captured := int(binary.LittleEndian.Uint32(data[20:]))
+			packets = append(packets, data[28:28+captured])
+		}
+		data = data[length:]
+	}
+
+	return packets
+}
+
+// tcpPayload returns the TCP flags and payload of a packet synthesized by tcpFlow.
+func tcpPayload(packet []byte) (byte, []byte) {
+	headerLength := 20
+	if packet[0]>>4 == 6 {
+		headerLength = 40
+	}
+
+	return packet[headerLength+13], packet[headerLength+20:]
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	writer, err := newPcapngWriter(&buffer)
+	require.NoError(t, err)
+
+	flow := newTCPFlow(netip.MustParseAddrPort("10.0.0.1:50000"), netip.MustParseAddrPort("10.0.0.2:80"))
+	packets := append(flow.handshake(), flow.data(true, []byte("hello"))...)
+	packets = append(packets, flow.data(false, make([]byte, captureSegmentSize+1))...)
+	packets = append(packets, flow.fin(true), flow.fin(false))
+	for _, packet := range packets {
+		_, err = writer.writePacket(time.Now(), packet)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(buffer.Len()), writer.written)
+
+	read := readPcapngPackets(t, buffer.Bytes())
+	require.Len(t, read, 8)
+	for i, packet := range read {
+		// Both the IPv4 header and TCP checksums verify.
+		assert.Zero(t, internetChecksum(packet[:20]), i)
+		tcp := packet[20:]
+		pseudo := append(append([]byte{}, packet[12:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		assert.Zero(t, internetChecksum(pseudo, tcp), i)
+		assert.Equal(t, packets[i], packet)
+	}
+
+	flags, payload := tcpPayload(read[3])
+	assert.Equal(t, byte(tcpFlagPSH|tcpFlagACK), flags)
+	assert.Equal(t, []byte("hello"), payload)
+	// The upstream's response is split into two segments, continuing its sequence numbers.
+	_, payload = tcpPayload(read[4])
+	assert.Len(t, payload, captureSegmentSize)
+	assert.Equal(t, binary.BigEndian.Uint32(read[4][24:])+captureSegmentSize, binary.BigEndian.Uint32(read[5][24:]))
+	flags, _ = tcpPayload(read[6])
+	assert.Equal(t, byte(tcpFlagFIN|tcpFlagACK), flags)
+}
+
+func TestTCPFlow_MixedAddressFamilies(t *testing.T) {
+	flow := newTCPFlow(netip.MustParseAddrPort("[2001:db8::1]:50000"), netip.MustParseAddrPort("10.0.0.2:80"))
+	for _, packet := range flow.handshake() {
+		assert.Equal(t, byte(6), packet[0]>>4)
+	}
+}
+
+func TestPcapngWriter_Empty(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "*.pcapng")
+	require.NoError(t, err)
+	writer, err := newPcapngWriter(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	data, err := os.ReadFile(file.Name())
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), writer.written)
+	assert.Empty(t, readPcapngPackets(t, data))
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package tcpproxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// readPeerCredentials reads the credentials of the process connected to conn with SO_PEERCRED. They are those the
+// process had when it connected.
+func readPeerCredentials(conn *net.UnixConn) (peerCredentials, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return peerCredentials{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	if err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return peerCredentials{}, err
+	}
+	if credErr != nil {
+		return peerCredentials{}, credErr
+	}
+
+	return peerCredentials{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
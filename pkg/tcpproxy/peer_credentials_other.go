@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tcpproxy
+
+import (
+	"errors"
+	"net"
+)
+
+// readPeerCredentials is unsupported, as SO_PEERCRED is only available on Linux.
+func readPeerCredentials(*net.UnixConn) (peerCredentials, error) {
+	return peerCredentials{}, errors.New("unix socket peer credentials are not supported on this platform")
+}
@@ -0,0 +1,330 @@
+package tcpproxy
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPrewarmMaxIdleTime is how long a pre-warmed connection may stay idle when PrewarmConfig.MaxIdleTime
+	// is unset.
+	defaultPrewarmMaxIdleTime = time.Minute
+	// prewarmRefillInterval is how often pre-warmed connections are expired and refilled, besides after each one
+	// is handed to a session.
+	prewarmRefillInterval = time.Second
+)
+
+// errUpstreamSentData is why a pre-warmed connection is discarded if the upstream sends data before any client.
+var errUpstreamSentData = errors.New("upstream sent data on an idle connection")
+
+// PrewarmConfig is the configuration for keeping idle connections to each upstream open ahead of time, which new
+// sessions use instead of dialing, cutting the latency of far away upstreams.
+//
+// Only enable it for upstreams whose protocol tolerates connections opened before a client arrives, where the
+// upstream waits for the client to send first. Connections are validated before they are handed to a session, and
+// discarded if the upstream has closed them or sent anything. Pre-warmed connections cannot carry PROXY protocol
+// headers, as the client is not known yet.
+type PrewarmConfig struct {
+	// MinIdle is how many idle connections are kept open to each upstream, refilled in the background.
+	MinIdle int
+	// MaxIdle is the most idle connections kept open to each upstream. When sessions find no idle connection, one
+	// more is kept open, up to MaxIdle, shrinking back to MinIdle as connections expire unused. Defaults to
+	// MinIdle.
+	MaxIdle int
+	// MaxIdleTime is how long a connection may stay idle before it is closed, as upstreams often close idle
+	// connections themselves. Defaults to 1 minute.
+	MaxIdleTime time.Duration
+}
+
+func (c *PrewarmConfig) validate() error {
+	if c.MinIdle < 0 {
+		return errors.New("prewarm MinIdle cannot be negative")
+	}
+	if c.MaxIdle < 0 {
+		return errors.New("prewarm MaxIdle cannot be negative")
+	}
+	if c.MaxIdle > 0 && c.MaxIdle < c.MinIdle {
+		return errors.New("prewarm MaxIdle cannot be less than MinIdle")
+	}
+	if c.MinIdle == 0 && c.MaxIdle == 0 {
+		return errors.New("prewarm config does not contain a MinIdle or MaxIdle")
+	}
+	if c.MaxIdleTime < 0 {
+		return errors.New("prewarm MaxIdleTime cannot be negative")
+	}
+
+	return nil
+}
+
+// idleConn is a pre-warmed connection, which is read from while idle to notice the upstream closing it.
+type idleConn struct {
+	conn    net.Conn
+	created time.Time
+	// done is closed once reading stops, with err set to why.
+	done chan struct{}
+	err  error
+}
+
+// idleConns are the pre-warmed connections to a single upstream.
+type idleConns struct {
+	// conns are the idle connections, oldest first.
+	conns []*idleConn
+	// target is how many idle connections to keep, between MinIdle and MaxIdle.
+	target  int
+	dialing int
+}
+
+// closeAll closes every idle connection.
+func (i *idleConns) closeAll() {
+	for _, c := range i.conns {
+		_ = c.conn.Close()
+	}
+	i.conns = nil
+}
+
+// prewarmer keeps idle connections open to each upstream of a pool, handing them to sessions on request.
+type prewarmer struct {
+	loadBalancer *LeastConnectionBalancer
+	dial         func(address string) (net.Conn, error)
+	minIdle      int
+	maxIdle      int
+	maxIdleTime  time.Duration
+	logger       *slog.Logger
+
+	upstreams map[string]*idleConns
+	closed    bool
+	mutex     sync.Mutex
+
+	refillC   chan struct{}
+	shutdownC chan struct{}
+	wg        sync.WaitGroup
+}
+
+// newPrewarmer returns a prewarmer for the upstreams of loadBalancer, dialing them with dial, or nil if conf is nil.
+// Connections are only opened once start is called.
+func newPrewarmer(
+	conf *PrewarmConfig,
+	loadBalancer *LeastConnectionBalancer,
+	dial func(address string) (net.Conn, error),
+	logger *slog.Logger,
+) *prewarmer {
+	if conf == nil {
+		return nil
+	}
+
+	w := &prewarmer{
+		loadBalancer: loadBalancer,
+		dial:         dial,
+		minIdle:      conf.MinIdle,
+		maxIdle:      conf.MaxIdle,
+		maxIdleTime:  conf.MaxIdleTime,
+		logger:       logger,
+		upstreams:    make(map[string]*idleConns),
+		refillC:      make(chan struct{}, 1),
+		shutdownC:    make(chan struct{}),
+	}
+	if w.maxIdle == 0 {
+		w.maxIdle = w.minIdle
+	}
+	if w.maxIdleTime == 0 {
+		w.maxIdleTime = defaultPrewarmMaxIdleTime
+	}
+
+	return w
+}
+
+// start begins keeping connections open in the background, until close is called.
+func (w *prewarmer) start() {
+	if w == nil {
+		return
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(prewarmRefillInterval)
+		defer ticker.Stop()
+		for {
+			w.refill()
+			select {
+			case <-w.shutdownC:
+				return
+			case <-ticker.C:
+			case <-w.refillC:
+			}
+		}
+	}()
+}
+
+// refill closes expired connections and those of upstreams that were removed or are draining, then dials more
+// connections to each upstream with fewer than its target.
+func (w *prewarmer) refill() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return
+	}
+
+	active := make(map[string]bool)
+	for _, upstream := range w.loadBalancer.FetchUpstreams() {
+		if !upstream.Draining() {
+			active[upstream.Address] = true
+		}
+	}
+	for address, idle := range w.upstreams {
+		if !active[address] {
+			idle.closeAll()
+			delete(w.upstreams, address)
+		}
+	}
+
+	for address := range active {
+		idle, ok := w.upstreams[address]
+		if !ok {
+			idle = &idleConns{target: w.minIdle}
+			w.upstreams[address] = idle
+		}
+		for len(idle.conns) > 0 && time.Since(idle.conns[0].created) > w.maxIdleTime {
+			_ = idle.conns[0].conn.Close()
+			idle.conns = idle.conns[1:]
+			idle.target = max(idle.target-1, w.minIdle)
+		}
+		for ; len(idle.conns)+idle.dialing < idle.target; idle.dialing++ {
+			w.wg.Add(1)
+			go w.dialIdle(address, idle)
+		}
+	}
+}
+
+// dialIdle opens a connection to an upstream, adding it to its idle connections.
+func (w *prewarmer) dialIdle(address string, idle *idleConns) {
+	defer w.wg.Done()
+	conn, err := w.dial(address)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	idle.dialing--
+	if err != nil {
+		w.logger.Debug("pre-warming upstream connection", slog.String("upstream", address),
+			slog.String("error", err.Error()))
+		return
+	}
+	if w.closed || w.upstreams[address] != idle {
+		_ = conn.Close()
+		return
+	}
+
+	c := &idleConn{conn: conn, created: time.Now(), done: make(chan struct{})}
+	idle.conns = append(idle.conns, c)
+	w.wg.Add(1)
+	go w.watch(address, idle, c)
+}
+
+// watch reads from an idle connection until it is handed to a session, which interrupts the read, or the upstream
+// closes it or sends data, which discards it.
+func (w *prewarmer) watch(address string, idle *idleConns, c *idleConn) {
+	defer w.wg.Done()
+	var b [1]byte
+	n, err := c.conn.Read(b[:])
+	if n > 0 {
+		err = errUpstreamSentData
+	}
+	c.err = err
+	close(c.done)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for i, other := range idle.conns {
+		if other == c {
+			idle.conns = append(idle.conns[:i], idle.conns[i+1:]...)
+			_ = c.conn.Close()
+			w.logger.Debug("discarding pre-warmed upstream connection", slog.String("upstream", address),
+				slog.String("error", err.Error()))
+			return
+		}
+	}
+}
+
+// take returns an idle connection to an upstream that is still healthy, or nil if there is none, in which case
+// more connections are kept open from then on.
+func (w *prewarmer) take(address string) net.Conn {
+	if w == nil {
+		return nil
+	}
+	defer w.signalRefill()
+
+	for {
+		w.mutex.Lock()
+		idle, ok := w.upstreams[address]
+		if !ok {
+			// Refilling has not seen the upstream yet, and removes it again if it is not one.
+			idle = &idleConns{target: w.minIdle}
+			w.upstreams[address] = idle
+		}
+		if len(idle.conns) == 0 {
+			idle.target = min(idle.target+1, w.maxIdle)
+			w.mutex.Unlock()
+			return nil
+		}
+		// The newest connection is the least likely to have been closed by the upstream.
+		c := idle.conns[len(idle.conns)-1]
+		idle.conns = idle.conns[:len(idle.conns)-1]
+		w.mutex.Unlock()
+
+		// Stop reading, and check the read ended because of that rather than the upstream.
+		_ = c.conn.SetReadDeadline(time.Unix(1, 0))
+		<-c.done
+		if errors.Is(c.err, os.ErrDeadlineExceeded) && time.Since(c.created) <= w.maxIdleTime &&
+			c.conn.SetReadDeadline(time.Time{}) == nil {
+			return c.conn
+		}
+		_ = c.conn.Close()
+	}
+}
+
+// signalRefill asks for connections to be refilled without waiting for the next interval.
+func (w *prewarmer) signalRefill() {
+	select {
+	case w.refillC <- struct{}{}:
+	default:
+	}
+}
+
+// idle returns how many idle connections to an upstream are open.
+func (w *prewarmer) idle(address string) int {
+	if w == nil {
+		return 0
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if idle, ok := w.upstreams[address]; ok {
+		return len(idle.conns)
+	}
+
+	return 0
+}
+
+// close stops refilling, and closes every idle connection.
+func (w *prewarmer) close() {
+	if w == nil {
+		return
+	}
+
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return
+	}
+	w.closed = true
+	for _, idle := range w.upstreams {
+		idle.closeAll()
+	}
+	w.mutex.Unlock()
+	close(w.shutdownC)
+	w.wg.Wait()
+}
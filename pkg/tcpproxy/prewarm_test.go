@@ -0,0 +1,229 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingUpstream is an echo server that keeps every connection it accepts.
+type countingUpstream struct {
+	listener net.Listener
+	conns    []net.Conn
+	mutex    sync.Mutex
+}
+
+func setupCountingUpstream(t *testing.T) *countingUpstream {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstream := &countingUpstream{listener: listener}
+	t.Cleanup(func() {
+		_ = listener.Close()
+		upstream.mutex.Lock()
+		defer upstream.mutex.Unlock()
+		for _, conn := range upstream.conns {
+			_ = conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream.mutex.Lock()
+			upstream.conns = append(upstream.conns, conn)
+			upstream.mutex.Unlock()
+			go func() { _, _ = io.Copy(conn, conn) }()
+		}
+	}()
+
+	return upstream
+}
+
+func (u *countingUpstream) address() string {
+	return u.listener.Addr().String()
+}
+
+func (u *countingUpstream) accepted() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return len(u.conns)
+}
+
+func (u *countingUpstream) conn(i int) net.Conn {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.conns[i]
+}
+
+func startTestPrewarmer(t *testing.T, conf *PrewarmConfig, address string) *prewarmer {
+	loadBalancer, err := NewLeastConnectionBalancer([]string{address})
+	require.NoError(t, err)
+	w := newPrewarmer(conf, loadBalancer, func(address string) (net.Conn, error) {
+		return net.Dial("tcp", address)
+	}, slog.Default())
+	w.start()
+	t.Cleanup(w.close)
+
+	return w
+}
+
+func TestPrewarmConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&PrewarmConfig{MinIdle: 2}).validate())
+	assert.NoError(t, (&PrewarmConfig{MaxIdle: 4, MaxIdleTime: time.Second}).validate())
+
+	tests := map[string]PrewarmConfig{
+		"empty":                 {},
+		"negative MinIdle":      {MinIdle: -1},
+		"negative MaxIdle":      {MinIdle: 1, MaxIdle: -1},
+		"MaxIdle below MinIdle": {MinIdle: 4, MaxIdle: 2},
+		"negative MaxIdleTime":  {MinIdle: 1, MaxIdleTime: -time.Second},
+	}
+	for name, conf := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, conf.validate())
+		})
+	}
+}
+
+func TestPrewarmer_HandsOffAndRefills(t *testing.T) {
+	upstream := setupCountingUpstream(t)
+	w := startTestPrewarmer(t, &PrewarmConfig{MinIdle: 2}, upstream.address())
+	require.Eventually(t, func() bool { return w.idle(upstream.address()) == 2 }, time.Second, 10*time.Millisecond)
+
+	conn := w.take(upstream.address())
+	require.NotNil(t, conn)
+	defer func() { _ = conn.Close() }()
+	_, err := conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+
+	// The connection handed off is replaced in the background.
+	require.Eventually(t, func() bool { return w.idle(upstream.address()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, upstream.accepted())
+	assert.Nil(t, w.take("127.0.0.1:1"))
+}
+
+func TestPrewarmer_DiscardsConnectionsClosedByUpstream(t *testing.T) {
+	upstream := setupCountingUpstream(t)
+	w := startTestPrewarmer(t, &PrewarmConfig{MinIdle: 1}, upstream.address())
+	require.Eventually(t, func() bool { return upstream.accepted() == 1 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, upstream.conn(0).Close())
+	require.Eventually(t, func() bool { return upstream.accepted() == 2 }, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return w.idle(upstream.address()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// The replacement is handed off, not the closed connection.
+	conn := w.take(upstream.address())
+	require.NotNil(t, conn)
+	defer func() { _ = conn.Close() }()
+	_, err := conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+}
+
+func TestPrewarmer_GrowsToMaxIdle(t *testing.T) {
+	upstream := setupCountingUpstream(t)
+	w := startTestPrewarmer(t, &PrewarmConfig{MaxIdle: 2}, upstream.address())
+
+	// With no MinIdle, connections are only kept once sessions find none idle.
+	assert.Nil(t, w.take(upstream.address()))
+	require.Eventually(t, func() bool { return w.idle(upstream.address()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, w.take("127.0.0.1:1"))
+
+	for i := 0; i < 3; i++ {
+		conn := w.take(upstream.address())
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}
+	require.Eventually(t, func() bool { return w.idle(upstream.address()) == 2 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, w.idle(upstream.address()))
+}
+
+func TestPrewarmer_ExpiresIdleConnections(t *testing.T) {
+	upstream := setupCountingUpstream(t)
+	w := startTestPrewarmer(t, &PrewarmConfig{MinIdle: 1, MaxIdleTime: 100 * time.Millisecond}, upstream.address())
+
+	// Expired connections are replaced on the next refill.
+	require.Eventually(t, func() bool { return upstream.accepted() == 2 }, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, w.idle(upstream.address()))
+}
+
+func Test_ProxyUsesPrewarmedConnections(t *testing.T) {
+	upstream := setupCountingUpstream(t)
+	config := testProxyConfig(t, upstream.address(), "engineering")
+	config.UpstreamConfig.Prewarm = &PrewarmConfig{MinIdle: 1}
+	proxy := startTestProxy(t, config)
+	require.Eventually(t, func() bool {
+		return proxy.Status().Upstreams[0].IdleConnections == 1
+	}, time.Second, 10*time.Millisecond)
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello world\n", string(line))
+
+	// The session used the pre-warmed connection, which is then replaced.
+	require.Eventually(t, func() bool {
+		return proxy.Status().Upstreams[0].IdleConnections == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, upstream.accepted())
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+}
+
+func Test_ProxyReportsPrewarmedPassthroughConnections(t *testing.T) {
+	upstream := setupCountingUpstream(t)
+	config := testProxyConfig(t, "localhost:0", "engineering")
+	config.PassthroughConfig = &PassthroughConfig{Routes: []PassthroughRoute{{
+		Name:           "db",
+		ServerNames:    []string{"db.example.com"},
+		Targets:        []string{upstream.address()},
+		AllowedSources: []string{"127.0.0.0/8"},
+		Prewarm:        &PrewarmConfig{MinIdle: 2},
+	}}}
+	proxy := startTestProxy(t, config)
+
+	// Upstreams of passthrough routes are listed after the UpstreamConfig targets, labelled with their route.
+	require.Eventually(t, func() bool {
+		upstreams := proxy.Upstreams()
+		return len(upstreams) == 2 && upstreams[1].IdleConnections == 2
+	}, time.Second, 10*time.Millisecond)
+	upstreams := proxy.Upstreams()
+	assert.Equal(t, "", upstreams[0].Route)
+	assert.Equal(t, "db", upstreams[1].Route)
+	assert.Equal(t, upstream.address(), upstreams[1].Address)
+
+	assert.NoError(t, proxy.Close())
+}
+
+func TestConfig_ValidatePrewarm(t *testing.T) {
+	config := testProxyConfig(t, "localhost:0", "engineering")
+	config.UpstreamConfig.Prewarm = &PrewarmConfig{MinIdle: 1}
+	assert.NoError(t, config.Validate())
+
+	config.UpstreamConfig.ProxyProtocol = ProxyProtocolV2
+	assert.ErrorContains(t, config.Validate(), "prewarm cannot be combined with ProxyProtocol")
+}
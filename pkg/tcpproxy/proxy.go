@@ -1,34 +1,69 @@
 package tcpproxy
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
 	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // DialTimeout is how long the proxy will wait when connecting to an upstream before giving up.
 const DialTimeout = 5 * time.Second
 
-// Proxy is an instance of the TCP proxy. Use New() with a Config to construct a proper Proxy.
-type Proxy struct {
-	loadBalancer     *LeastConnectionBalancer
-	listenerConfig   *ListenerConfig
-	logger           *slog.Logger
-	rateLimitManager *RateLimitManager
-	upstreamConfig   *UpstreamConfig
+// handshakeTimeout is how long a client may take to complete the TLS handshake before it is closed.
+const handshakeTimeout = 10 * time.Second
 
-	listener  net.Listener
-	shutdownC chan struct{}
+// defaultHalfCloseTimeout is how long one direction of a session may continue after the other has finished, when
+// ListenerConfig.HalfCloseTimeout is unset.
+const defaultHalfCloseTimeout = time.Minute
 
-	serving atomic.Bool
+// Proxy is an instance of the TCP proxy. Use New() with a Config to construct a proper Proxy.
+type Proxy struct {
+	loadBalancer      *LeastConnectionBalancer
+	listenerConfig    *ListenerConfig
+	logger            *slog.Logger
+	rateLimitStore    RateLimitStore
+	rateLimitFailOpen bool
+	upstreamConfig    *UpstreamConfig
+
+	accessLog         AccessLogSink
+	admin             *adminServer
+	auditLog          *auditLog
+	captures          *captureManager
+	config            *Config
+	connectionLimiter *connectionLimiter
+	health            *healthServer
+	hooks             *hooks
+	listener          net.Listener
+	unixListener      *unixSocketListener
+	passthrough       []*passthroughRoute
+	pool              *upstreamPool
+	sessions          *sessionRegistry
+	startTime         time.Time
+	trustedProxies    []netip.Prefix
+	tlsConfig         atomic.Pointer[tls.Config]
+	upstreamTLSConfig atomic.Pointer[tls.Config]
+	tracer            trace.Tracer
+	tracingShutdown   func(context.Context) error
+	udp               *udpProxy
+	shutdownC         chan struct{}
+
+	serving  atomic.Bool
+	draining atomic.Bool
 }
 
 // New constructs a Proxy for a given Config. It will validate the configuration, and if valid, begin listening
@@ -40,28 +75,147 @@ func New(conf *Config) (*Proxy, error) {
 	}
 
 	proxy := &Proxy{
-		loadBalancer:   conf.LoadBalancer,
-		listenerConfig: conf.ListenerConfig,
-		logger:         conf.Logger,
-		upstreamConfig: conf.UpstreamConfig,
-		rateLimitManager: NewRateLimitManager(
-			conf.RateLimitConfig.Capacity,
-			conf.RateLimitConfig.FillRate,
-			conf.Logger,
-		),
-		shutdownC: make(chan struct{}),
-	}
-
-	tlsConfig, err := conf.TLSConfig()
+		loadBalancer:      conf.LoadBalancer,
+		listenerConfig:    conf.ListenerConfig,
+		logger:            conf.Logger,
+		rateLimitStore:    conf.RateLimitConfig.Store,
+		rateLimitFailOpen: conf.RateLimitConfig.FailOpen,
+		upstreamConfig:    conf.UpstreamConfig,
+		config:            conf,
+		sessions:          newSessionRegistry(),
+		startTime:         time.Now(),
+		shutdownC:         make(chan struct{}),
+	}
+	proxy.pool = &upstreamPool{
+		loadBalancer:  conf.LoadBalancer,
+		proxyProtocol: conf.UpstreamConfig.ProxyProtocol,
+		originateTLS:  true,
+	}
+	if proxy.rateLimitStore == nil {
+		proxy.rateLimitStore = NewRateLimitManagerFromConfig(conf.RateLimitConfig, conf.Logger)
+	}
+	// The CIDRs were already parsed by Validate, so this cannot fail.
+	proxy.trustedProxies, _ = parseCIDRs(conf.ListenerConfig.TrustedProxies)
+	if proxy.passthrough, err = newPassthroughRoutes(conf.PassthroughConfig); err != nil {
+		return nil, err
+	}
+	proxy.pool.prewarm = proxy.newPrewarmer(conf.UpstreamConfig.Prewarm, proxy.pool)
+	for i, route := range proxy.passthrough {
+		route.pool.prewarm = proxy.newPrewarmer(conf.PassthroughConfig.Routes[i].Prewarm, route.pool)
+	}
+	// Upstream sockets are only created when dialing, so check the kernel accepts their options up front.
+	if err = conf.UpstreamConfig.SocketOptions.probe(); err != nil {
+		proxy.logger.Error("invalid upstream socket options", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("upstream socket options: %w", err)
+	}
+
+	tracerProvider, tracingShutdown, err := newTracerProvider(conf.TracingConfig)
 	if err != nil {
+		proxy.logger.Error("failure configuring tracing", slog.String("error", err.Error()))
+		return nil, err
+	}
+	proxy.tracer, proxy.tracingShutdown = tracerProvider.Tracer(tracerName), tracingShutdown
+	if conf.TracingConfig != nil {
+		proxy.logger = slog.New(traceHandler{proxy.logger.Handler()})
+	}
+
+	proxy.hooks = newHooks(conf.HooksConfig, proxy.logger)
+
+	if conf.ConnectionLimitConfig != nil {
+		proxy.connectionLimiter = newConnectionLimiter(*conf.ConnectionLimitConfig, time.Now)
+	}
+
+	if err = proxy.loadTLSConfig(); err != nil {
 		proxy.logger.Error("failure loading TLS configuration", "error", err)
 		return nil, err
 	}
 
-	if proxy.listener, err = tls.Listen("tcp", proxy.listenerConfig.ListenerAddr, tlsConfig); err != nil {
+	// TLS is layered on per connection in Serve, so that cheap checks can run before any TLS work is done.
+	if conf.AccessLogConfig != nil {
+		if proxy.accessLog, err = NewAccessLogSink(conf.AccessLogConfig); err != nil {
+			proxy.logger.Error("error opening access log", slog.String("error", err.Error()))
+			return nil, err
+		}
+	}
+
+	if conf.AuditLogConfig != nil {
+		if proxy.auditLog, err = openAuditLog(conf.AuditLogConfig.Path, proxy.logger); err != nil {
+			proxy.logger.Error("error opening audit log", slog.String("error", err.Error()))
+			proxy.closeAccessLog()
+			return nil, err
+		}
+	}
+
+	if proxy.captures, err = newCaptureManager(conf.CaptureConfig, proxy.logger); err != nil {
+		proxy.logger.Error("error starting capture", slog.String("error", err.Error()))
+		proxy.closeLogs()
+		return nil, err
+	}
+
+	listenConfig, address := proxy.listenerConfig.SocketOptions.listenConfig(), proxy.listenerConfig.ListenerAddr
+	if proxy.listener, err = listenConfig.Listen(context.Background(), "tcp", address); err != nil {
 		proxy.logger.Error("error listening", slog.String("error", err.Error()))
+		proxy.captures.close()
+		proxy.closeLogs()
 		return nil, err
 	}
+
+	if conf.ListenerConfig.UnixSocket != nil {
+		if proxy.unixListener, err = listenUnixSocket(conf.ListenerConfig.UnixSocket); err != nil {
+			proxy.logger.Error("error listening on unix socket", slog.String("error", err.Error()))
+			_ = proxy.listener.Close()
+			proxy.captures.close()
+			proxy.closeLogs()
+			return nil, err
+		}
+		proxy.logger.Info("unix socket ready", slog.String("listening", conf.ListenerConfig.UnixSocket.Path))
+	}
+
+	if conf.AdminConfig != nil {
+		if proxy.admin, err = newAdminServer(proxy, conf); err != nil {
+			proxy.logger.Error("error starting admin API", slog.String("error", err.Error()))
+			_ = proxy.listener.Close()
+			proxy.closeUnixListener()
+			proxy.captures.close()
+			proxy.closeLogs()
+			return nil, err
+		}
+		proxy.logger.Info("admin API ready", slog.String("listening", proxy.admin.address()))
+	}
+
+	if conf.HealthConfig != nil {
+		if proxy.health, err = newHealthServer(proxy, conf.HealthConfig); err != nil {
+			proxy.logger.Error("error starting health probes", slog.String("error", err.Error()))
+			_ = proxy.listener.Close()
+			proxy.closeUnixListener()
+			if proxy.admin != nil {
+				_ = proxy.admin.close()
+			}
+			proxy.captures.close()
+			proxy.closeLogs()
+			return nil, err
+		}
+		proxy.logger.Info("health probes ready", slog.String("listening", proxy.HealthAddress()))
+	}
+
+	if proxy.udp, err = newUDPProxy(conf.UDPConfig, proxy.logger); err != nil {
+		proxy.logger.Error("error listening for UDP", slog.String("error", err.Error()))
+		_ = proxy.listener.Close()
+		proxy.closeUnixListener()
+		if proxy.admin != nil {
+			_ = proxy.admin.close()
+		}
+		if proxy.health != nil {
+			_ = proxy.health.close()
+		}
+		proxy.captures.close()
+		proxy.closeLogs()
+		return nil, err
+	}
+	if proxy.udp != nil {
+		proxy.logger.Info("UDP proxy ready", slog.String("listening", proxy.UDPAddress()))
+	}
+
 	proxy.logger.Info(
 		"proxy ready",
 		slog.String("listening", proxy.listener.Addr().String()),
@@ -79,10 +233,33 @@ func (p *Proxy) Serve() error {
 	}
 	p.serving.Store(true)
 
+	if p.admin != nil {
+		go p.admin.serve()
+	}
+	if p.health != nil {
+		go p.health.serve(p.logger)
+	}
+	if p.udp != nil {
+		go p.udp.serve()
+	}
+	for _, pool := range p.pools() {
+		pool.prewarm.start()
+	}
+	go p.recheckUpstreams()
+
 	wg := &sync.WaitGroup{}
+	// The Unix socket listener is served alongside, and must stop adding to wg before it is waited on.
+	unixDone := make(chan struct{})
+	go func() {
+		if p.unixListener != nil {
+			p.serveUnix(wg)
+		}
+		close(unixDone)
+	}()
 	for {
 		select {
 		case <-p.shutdownC:
+			<-unixDone
 			wg.Wait()
 			return nil
 		default:
@@ -90,37 +267,154 @@ func (p *Proxy) Serve() error {
 			if err != nil {
 				continue
 			}
-
-			// Ensure we have a TLS connection, if not close it and continue.
-			tlsConn, ok := conn.(*tls.Conn)
-			if !ok {
-				p.logger.Warn("non TLS connection detected")
-				_ = conn.Close()
-				continue
+			if err = p.listenerConfig.SocketOptions.configure(conn); err != nil {
+				p.logger.Debug("configuring accepted socket", slog.String("error", err.Error()))
 			}
 
-			// Force a handshake so we can inspect x509 data. This would happen normally
-			// when the first IO occurs, but we need to validate the user before accepting.
-			if err = tlsConn.Handshake(); err != nil {
-				p.logger.Warn("could not run handshake protocol for TLS connection, closing")
-				_ = conn.Close()
+			// Refuse connections exceeding the global or per-source accept rate before doing any TLS work. Those from
+			// trusted load balancers are checked once the client address is known from their PROXY protocol header.
+			fromTrustedProxy := prefixesContain(p.trustedProxies, conn.RemoteAddr())
+			if !fromTrustedProxy && !p.allowConnection(conn) {
 				continue
 			}
 
-			// Check if the user is in the AuthorizedGroups and has not exceeded the RateLimit. Otherwise,
-			// close the connection.
-			if p.connectionAuthorized(tlsConn) {
-				wg.Add(1)
-				go func() {
-					p.handleConnection(conn)
-					wg.Done()
-				}()
-			} else {
-				p.logger.Warn("user is not authorized to access upstream")
-				_ = conn.Close()
-			}
+			// Everything else, including reading the PROXY protocol header, the ClientHello and the TLS handshake,
+			// happens in the connection's own goroutine, so that slow clients cannot hold up accepting others.
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := p.acceptProxyProtocol(conn)
+				if err != nil {
+					p.logger.Warn("invalid PROXY protocol header, closing", slog.String("error", err.Error()))
+					return
+				}
+				if fromTrustedProxy && !p.allowConnection(conn) {
+					return
+				}
+				p.serveConnection(conn)
+			}()
+		}
+	}
+}
+
+// allowConnection reports whether conn is within the connection rate limits, closing it if not.
+func (p *Proxy) allowConnection(conn net.Conn) bool {
+	if p.connectionLimiter == nil || p.connectionLimiter.allow(conn.RemoteAddr()) {
+		return true
+	}
+	p.logger.Debug("connection rate limit exceeded, closing", slog.String("client", conn.RemoteAddr().String()))
+	_ = conn.Close()
+
+	return false
+}
+
+// serveConnection authorizes an accepted connection and proxies it, or rejects it, returning once it is closed.
+func (p *Proxy) serveConnection(conn net.Conn) {
+	clientAddress := conn.RemoteAddr().String()
+	p.hooks.notify(func(o Observer) {
+		o.OnAccept(AcceptEvent{ClientAddress: clientAddress, Time: time.Now()})
+	})
+
+	// The accept span covers the whole connection, and is ended once it is rejected or closed.
+	ctx, span := p.tracer.Start(context.Background(), "accept", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.ClientAddress(clientAddress)))
+
+	// With passthrough routes, the ClientHello is read first to decide whether to pass the connection through or
+	// terminate TLS.
+	if len(p.passthrough) > 0 {
+		var route *passthroughRoute
+		var err error
+		if conn, route, err = p.routePassthrough(conn); err != nil {
+			p.logger.WarnContext(ctx, "could not read TLS ClientHello, closing", slog.String("error", err.Error()))
+			p.auditDecision(conn, AuditDecisionHandshakeFailure, "", "", err)
+			_ = conn.Close()
+			endSpan(span, err)
+			return
+		}
+		if route != nil {
+			p.servePassthrough(ctx, conn, route)
+			return
+		}
+	}
+
+	tlsConn := tls.Server(conn, p.tlsConfig.Load())
+
+	// Force a handshake so we can inspect x509 data. This would happen normally
+	// when the first IO occurs, but we need to validate the user before accepting.
+	err := p.handshake(ctx, tlsConn)
+	p.notifyHandshake(tlsConn, err)
+	if err != nil {
+		p.logger.WarnContext(ctx, "could not run handshake protocol for TLS connection, closing")
+		p.auditHandshakeFailure(tlsConn, err)
+		_ = tlsConn.Close()
+		endSpan(span, err)
+		return
+	}
+
+	// Check if the user is in the AuthorizedGroups and has not exceeded the RateLimit. Otherwise,
+	// close the connection.
+	user, group, reason := p.connectionAuthorized(ctx, tlsConn)
+	p.auditDecision(tlsConn, auditDecisionFor(reason), user, group, nil)
+	span.SetAttributes(semconv.EnduserID(user), attributeGroup.String(group))
+	p.dispatch(ctx, tlsConn, user, group, reason)
+}
+
+// dispatch proxies an authorized connection to an upstream, or rejects it if reason is set, returning once the
+// connection is closed. It ends the accept span in ctx once the connection is rejected or closed.
+func (p *Proxy) dispatch(ctx context.Context, conn net.Conn, user string, group string, reason RejectionReason) {
+	if reason == "" {
+		p.handleConnection(ctx, conn, p.pool, user, group)
+		return
+	}
+
+	p.logger.WarnContext(
+		ctx,
+		"user is not authorized to access upstream",
+		slog.String("user", user),
+		slog.String("reason", string(reason)),
+	)
+	p.reject(conn, reason, user)
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attributeRejectionReason.String(string(reason)))
+	endSpan(span, errors.New(reason.message()))
+}
+
+// Reload re-reads TLS material for the proxy and admin listeners, and for upstream connections, from disk, for
+// example after certificates are rotated. New connections use the reloaded material, while existing connections are
+// unaffected. If loading fails, the previous material stays in use.
+func (p *Proxy) Reload() error {
+	if err := p.loadTLSConfig(); err != nil {
+		p.logger.Error("failure reloading TLS configuration", "error", err)
+		return err
+	}
+	if p.admin != nil {
+		if err := p.admin.loadTLSConfig(p.config); err != nil {
+			p.logger.Error("failure reloading admin TLS configuration", "error", err)
+			return err
 		}
 	}
+	p.logger.Info("reloaded TLS configuration")
+
+	return nil
+}
+
+// loadTLSConfig loads the listener's and upstreams' TLS material and swaps it in for new connections.
+func (p *Proxy) loadTLSConfig() error {
+	tlsConfig, err := p.config.TLSConfig()
+	if err != nil {
+		return err
+	}
+	if p.listenerConfig.RejectionMode == RejectionModeTLSAlert {
+		tlsConfig.VerifyConnection = p.verifyConnection
+	}
+	upstreamTLSConfig, err := p.config.UpstreamTLSConfig()
+	if err != nil {
+		return fmt.Errorf("loading upstream TLS configuration: %w", err)
+	}
+	p.tlsConfig.Store(tlsConfig)
+	p.upstreamTLSConfig.Store(upstreamTLSConfig)
+
+	return nil
 }
 
 // Address returns full address and port the proxy is serving on. Eg: 127.0.0.1:5000
@@ -128,7 +422,8 @@ func (p *Proxy) Address() string {
 	return p.listener.Addr().String()
 }
 
-// Close will clean up connections and close the listener, if it is listening.
+// Close will clean up connections and close the listener, if it is listening. The Proxy reports not ready for the
+// HealthConfig DrainDelay before the listener is closed.
 func (p *Proxy) Close() error {
 	// TODO: This prevents a panic if someone calls Close() twice on a Proxy instance. This is a hack,
 	// in that you could in theory close and re-listen at the call site, however the API exposed here prefers
@@ -136,36 +431,194 @@ func (p *Proxy) Close() error {
 	if !p.serving.Load() {
 		return errors.New("cannot close a proxy that is not serving")
 	}
+	p.waitForDrain()
 	close(p.shutdownC)
 
 	err := p.listener.Close()
 	if err != nil {
 		return err
 	}
+	p.closeUnixListener()
+	for _, pool := range p.pools() {
+		pool.prewarm.close()
+	}
+
+	if p.admin != nil {
+		if err = p.admin.close(); err != nil {
+			return err
+		}
+	}
+
+	if p.health != nil {
+		if err = p.health.close(); err != nil {
+			return err
+		}
+	}
+
+	if p.udp != nil {
+		if err = p.udp.close(); err != nil {
+			return err
+		}
+	}
 
-	p.rateLimitManager.Close()
+	p.rateLimitStore.Close()
+	p.captures.close()
+	p.closeLogs()
+	p.shutdownTracing()
+	p.hooks.close()
 
 	p.serving.Store(false)
 
 	return nil
 }
 
-func (p *Proxy) handleConnection(clientConn net.Conn) {
+// upstreamPool is a set of upstreams sessions can be proxied to, and how connections to them are made.
+type upstreamPool struct {
+	loadBalancer  *LeastConnectionBalancer
+	proxyProtocol ProxyProtocolVersion
+	// originateTLS uses the UpstreamConfig TLS, if set, for connections to the upstreams. Passthrough sessions are
+	// already encrypted end-to-end, so do not.
+	originateTLS bool
+	// prewarm keeps idle connections open to the upstreams, if configured.
+	prewarm *prewarmer
+}
+
+// pools returns every upstreamPool: the pool of terminated connections, and that of each passthrough route.
+func (p *Proxy) pools() []*upstreamPool {
+	pools := []*upstreamPool{p.pool}
+	for _, route := range p.passthrough {
+		pools = append(pools, route.pool)
+	}
+
+	return pools
+}
+
+// newPrewarmer returns a prewarmer for the upstreams of pool, or nil if conf is nil.
+func (p *Proxy) newPrewarmer(conf *PrewarmConfig, pool *upstreamPool) *prewarmer {
+	return newPrewarmer(conf, pool.loadBalancer, func(address string) (net.Conn, error) {
+		return p.connectPool(pool, address)
+	}, p.logger)
+}
+
+// connectPool connects to the upstream at address in pool ahead of any session, originating TLS if the pool does,
+// and records the outcome for the readiness check.
+func (p *Proxy) connectPool(pool *upstreamPool, address string) (net.Conn, error) {
+	conn, err := p.connectUpstream(address)
+	if err == nil {
+		conn, err = p.originateTLS(pool, conn, address)
+	}
+	pool.loadBalancer.recordDial(address, err)
+
+	return conn, err
+}
+
+// handleConnection proxies an authorized connection to an upstream in pool. It ends the accept span in ctx once the
+// connection is closed. Its goroutine, and those copying data, carry profiler labels for the session and upstream.
+func (p *Proxy) handleConnection(
+	ctx context.Context,
+	clientConn net.Conn,
+	pool *upstreamPool,
+	user string,
+	group string,
+) {
+	start := time.Now()
+	record := newAccessLogRecord(newSessionID(), user, group, clientConn)
+	ctx = withLabels(ctx, labelSession, record.SessionID)
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attributeSessionID.String(record.SessionID))
+	defer func() {
+		record.Time = time.Now()
+		record.Duration = durationMilliseconds(record.Time.Sub(start))
+		span.SetAttributes(attributeCloseReason.String(string(record.CloseReason)))
+		span.End()
+		p.logAccess(record)
+		p.hooks.notify(func(o Observer) {
+			o.OnSessionEnd(record)
+		})
+	}()
+
 	// Fetch a target based on our load balancing strategy. Ensure to clean up when we are done with the upstream.
-	upstream := p.loadBalancer.FetchUpstream()
+	_, selectSpan := p.tracer.Start(ctx, "upstream.select")
+	upstream := pool.loadBalancer.FetchUpstream()
+	if upstream == nil {
+		p.logger.ErrorContext(ctx, "no upstream available, all upstreams are draining")
+		record.CloseReason = CloseReasonNoUpstream
+		endSpan(selectSpan, errors.New("no upstream available"))
+		p.closeConnection(ctx, clientConn)
+		return
+	}
 	defer upstream.Release()
-
-	targetConn, err := net.DialTimeout("tcp", upstream.Address, DialTimeout)
+	record.Upstream = upstream.Address
+	ctx = withLabels(ctx, labelUpstream, upstream.Address)
+	selectSpan.SetAttributes(semconv.ServerAddress(upstream.Address))
+	selectSpan.End()
+	p.hooks.notify(func(o Observer) {
+		o.OnUpstreamSelected(UpstreamSelectedEvent{
+			SessionID: record.SessionID,
+			User:      user,
+			Group:     group,
+			Upstream:  upstream.Address,
+		})
+	})
+
+	_, dialSpan := p.tracer.Start(ctx, "upstream.dial", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.ServerAddress(upstream.Address)))
+	dialStart := time.Now()
+	targetConn, err := p.dialUpstream(pool, upstream.Address, clientConn, user, group)
+	record.DialLatency = durationMilliseconds(time.Since(dialStart))
+	upstream.recordDial(err)
+	endSpan(dialSpan, err)
 	if err != nil {
-		p.logger.Error("connecting to target", "error", err)
+		p.logger.ErrorContext(ctx, "connecting to target", "error", err)
+		record.CloseReason, record.Error = CloseReasonDialFailed, err.Error()
+		dialErr := err
+		p.hooks.notify(func(o Observer) {
+			o.OnDialError(DialErrorEvent{
+				SessionID: record.SessionID,
+				User:      user,
+				Upstream:  upstream.Address,
+				Error:     dialErr,
+			})
+		})
+		p.closeConnection(ctx, clientConn)
 		return
 	}
 
-	defer func() {
-		if err = targetConn.Close(); err != nil {
-			p.logger.Error("closing connection", "error", err)
+	// Register the session so it can be listed and terminated through the admin API.
+	session := newSession(record.SessionID, user, group, clientConn, targetConn, upstream.Address)
+	p.sessions.add(session)
+	defer p.sessions.remove(session)
+
+	// Record the decrypted traffic if the session matches an active capture.
+	tap := p.captures.tap(user, group, upstream.Address, clientConn.RemoteAddr(), targetConn.RemoteAddr())
+	defer tap.close()
+
+	ctx, transferSpan := p.tracer.Start(ctx, "data.transfer")
+
+	// Both connections are closed once data transfer is complete in both directions, or as soon as it fails.
+	closeConnections := sync.OnceFunc(func() {
+		p.closeConnection(ctx, clientConn)
+		p.closeConnection(ctx, targetConn)
+	})
+	// When one side finishes sending, the other is told by half-closing its connection, and may keep sending until
+	// the half-close timeout expires.
+	var halfCloseOnce sync.Once
+	var halfCloseTimer *time.Timer
+	halfClose := func(ctx context.Context, dst net.Conn, err error) {
+		if err == nil {
+			err = closeWrite(dst)
 		}
-	}()
+		if err != nil {
+			closeConnections()
+			return
+		}
+		halfCloseOnce.Do(func() {
+			halfCloseTimer = time.AfterFunc(p.halfCloseTimeout(), func() {
+				p.logger.DebugContext(ctx, "half-close timeout expired, closing session")
+				closeConnections()
+			})
+		})
+	}
 
 	// Create a WaitGroup to handle nested goroutines that copy data
 	wg := &sync.WaitGroup{}
@@ -174,63 +627,261 @@ func (p *Proxy) handleConnection(clientConn net.Conn) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		p.copyData(targetConn, clientConn)
+		ctx := withLabels(ctx, labelDirection, "client_to_upstream")
+		err := p.copyData(ctx, tap.writer(&countingWriter{writer: targetConn, counter: &session.bytesIn}, true), clientConn)
+		session.finish(closeReasonFor(err, CloseReasonClientClosed), err)
+		halfClose(ctx, targetConn, err)
 	}()
 
 	// Copy data from target back to the client
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		p.copyData(clientConn, targetConn)
-
-		// For added safety, close the target connection once data transfer is complete to ensure the other
-		// goroutine can't get stuck.
-		p.closeConnection(targetConn)
+		ctx := withLabels(ctx, labelDirection, "upstream_to_client")
+		err := p.copyData(ctx, tap.writer(&countingWriter{writer: clientConn, counter: &session.bytesOut}, false), targetConn)
+		session.finish(closeReasonFor(err, CloseReasonUpstreamClosed), err)
+		halfClose(ctx, clientConn, err)
 	}()
 
 	wg.Wait()
+	if halfCloseTimer != nil {
+		halfCloseTimer.Stop()
+	}
+	closeConnections()
 
-	// Close connections once EOF has been met and data transfer is complete
-	p.closeConnection(clientConn)
-	p.closeConnection(targetConn)
+	record.BytesIn, record.BytesOut = session.bytesIn.Load(), session.bytesOut.Load()
+	record.CloseReason = session.closeReason
+	if session.closeErr != nil {
+		record.Error = session.closeErr.Error()
+	}
+	transferSpan.SetAttributes(attributeBytesIn.Int64(record.BytesIn), attributeBytesOut.Int64(record.BytesOut))
+	endSpan(transferSpan, session.closeErr)
 }
 
-func (p *Proxy) copyData(dst net.Conn, src net.Conn) {
-	_, err := io.Copy(dst, src)
+// halfCloseTimeout returns how long one direction of a session may continue after the other has finished.
+func (p *Proxy) halfCloseTimeout() time.Duration {
+	if p.listenerConfig.HalfCloseTimeout == 0 {
+		return defaultHalfCloseTimeout
+	}
+
+	return p.listenerConfig.HalfCloseTimeout
+}
+
+// closeUnixListener closes the Unix socket listener, if there is one, which removes its socket file.
+func (p *Proxy) closeUnixListener() {
+	if p.unixListener == nil {
+		return
+	}
+	if err := p.unixListener.Close(); err != nil {
+		p.logger.Error("closing unix socket", slog.String("error", err.Error()))
+	}
+}
+
+// dialUpstream connects to an upstream in pool, sending a PROXY protocol header describing clientConn if
+// configured. The header is sent in the clear, before any TLS handshake with the upstream. A pre-warmed connection
+// is used instead of dialing if one is available.
+func (p *Proxy) dialUpstream(
+	pool *upstreamPool,
+	address string,
+	clientConn net.Conn,
+	user string,
+	group string,
+) (net.Conn, error) {
+	if conn := pool.prewarm.take(address); conn != nil {
+		return conn, nil
+	}
+
+	conn, err := p.connectUpstream(address)
+	if err != nil {
+		return nil, err
+	}
+	if pool.proxyProtocol == "" {
+		return p.originateTLS(pool, conn, address)
+	}
+
+	header, err := newProxyHeader(clientConn, user, group).encode(pool.proxyProtocol)
+	if err == nil {
+		_ = conn.SetWriteDeadline(time.Now().Add(DialTimeout))
+		if _, err = conn.Write(header); err == nil {
+			err = conn.SetWriteDeadline(time.Time{})
+		}
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("sending PROXY protocol header: %w", err)
+	}
+
+	return p.originateTLS(pool, conn, address)
+}
+
+// connectUpstream dials an upstream with the configured socket options.
+func (p *Proxy) connectUpstream(address string) (net.Conn, error) {
+	network, target := targetNetwork(address)
+	conn, err := p.upstreamConfig.SocketOptions.dialer(DialTimeout).Dial(network, target)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.upstreamConfig.SocketOptions.configure(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// closeReasonFor returns the CloseReason for a finished copy: closed if it ended cleanly, otherwise an error.
+func closeReasonFor(err error, closed CloseReason) CloseReason {
+	if err != nil {
+		return CloseReasonError
+	}
+
+	return closed
+}
+
+// copyData copies from src to dst until src reaches EOF or an error occurs, logging any error.
+func (p *Proxy) copyData(ctx context.Context, dst io.Writer, src net.Conn) error {
+	_, err := transfer(dst, src)
 	if err != nil {
 		if errors.Is(err, os.ErrDeadlineExceeded) {
-			p.logger.Error("deadline exceeded", "error", err)
+			p.logger.ErrorContext(ctx, "deadline exceeded", "error", err)
 		}
-		p.logger.Error("copying data", "error", err)
+		p.logger.ErrorContext(ctx, "copying data", "error", err)
+	}
+
+	return err
+}
+
+// logAccess writes a record to the access log, if one is configured.
+func (p *Proxy) logAccess(record AccessLogRecord) {
+	if p.accessLog == nil {
+		return
+	}
+	if err := p.accessLog.Log(record); err != nil {
+		p.logger.Error("writing access log", slog.String("error", err.Error()))
+	}
+}
+
+func (p *Proxy) closeAccessLog() {
+	if p.accessLog == nil {
+		return
+	}
+	if err := p.accessLog.Close(); err != nil {
+		p.logger.Error("closing access log", slog.String("error", err.Error()))
 	}
 }
 
-func (p *Proxy) closeConnection(conn net.Conn) {
+// closeLogs closes the access and audit logs, if they are configured.
+func (p *Proxy) closeLogs() {
+	p.closeAccessLog()
+	if p.auditLog == nil {
+		return
+	}
+	if err := p.auditLog.close(); err != nil {
+		p.logger.Error("closing audit log", slog.String("error", err.Error()))
+	}
+}
+
+// durationMilliseconds converts a time.Duration to fractional milliseconds.
+func durationMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (p *Proxy) closeConnection(ctx context.Context, conn net.Conn) {
 	if err := conn.Close(); err != nil {
-		p.logger.Error("closing connection", "error", err)
+		p.logger.ErrorContext(ctx, "closing connection", "error", err)
 	}
 }
 
+// handshake runs the TLS handshake within a span.
+func (p *Proxy) handshake(ctx context.Context, conn *tls.Conn) error {
+	ctx, span := p.tracer.Start(ctx, "tls.handshake")
+	handshakeCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	err := conn.HandshakeContext(handshakeCtx)
+	if err == nil {
+		state := conn.ConnectionState()
+		span.SetAttributes(
+			semconv.TLSProtocolVersion(strings.TrimPrefix(tls.VersionName(state.Version), "TLS ")),
+			semconv.TLSCipher(tls.CipherSuiteName(state.CipherSuite)),
+			semconv.TLSClientServerName(state.ServerName),
+		)
+	}
+	endSpan(span, err)
+
+	return err
+}
+
 // connectionAuthorized will look for our authorization stored in a certificates CN, in the format "user@group",
-// and extract that to verify the user is a member of the AuthorizedGroups configured.
-func (p *Proxy) connectionAuthorized(conn *tls.Conn) bool {
+// and extract that to verify the user is a member of the AuthorizedGroups configured. It returns the user and
+// group, if they could be extracted, and an empty RejectionReason if the connection is authorized.
+func (p *Proxy) connectionAuthorized(ctx context.Context, conn *tls.Conn) (string, string, RejectionReason) {
+	ctx, span := p.tracer.Start(ctx, "authorize")
+	defer span.End()
+
 	// TODO: This may be naive but assume one PeerCertificate for now.
 	cert := conn.ConnectionState().PeerCertificates[0]
-	if cert == nil {
-		return false
+	user, group, ok := identityFromCertificate(cert)
+	if !ok {
+		span.SetAttributes(attributeRejectionReason.String(string(RejectionReasonInvalidIdentity)))
+		return "", "", RejectionReasonInvalidIdentity
 	}
 
-	s := strings.Split(cert.Subject.CommonName, "@")
-	if len(s) != 2 {
-		return false
+	return user, group, p.identityAuthorized(ctx, conn, user, group, cert)
+}
+
+// identityAuthorized checks that an identified client is a member of the AuthorizedGroups, is not vetoed by the
+// Observer and has not exceeded its rate limit. cert is nil for clients identified by other means. It returns an
+// empty RejectionReason if the connection is authorized.
+func (p *Proxy) identityAuthorized(
+	ctx context.Context,
+	conn net.Conn,
+	user string,
+	group string,
+	cert *x509.Certificate,
+) RejectionReason {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(semconv.EnduserID(user), attributeGroup.String(group))
+	if !slices.Contains(p.upstreamConfig.AuthorizedGroups, group) {
+		span.SetAttributes(attributeRejectionReason.String(string(RejectionReasonUnauthorized)))
+		return RejectionReasonUnauthorized
+	}
+	if err := p.hooks.authorize(AuthorizeEvent{
+		ClientAddress: conn.RemoteAddr().String(),
+		User:          user,
+		Group:         group,
+		Certificate:   cert,
+	}); err != nil {
+		p.logger.InfoContext(ctx, "observer refused connection", slog.String("user", user), slog.String("error", err.Error()))
+		span.SetAttributes(attributeRejectionReason.String(string(RejectionReasonVetoed)))
+		return RejectionReasonVetoed
+	}
+	if !p.rateLimitAllowed(ctx, user) {
+		span.SetAttributes(attributeRejectionReason.String(string(RejectionReasonRateLimited)))
+		p.notifyRateLimited(conn, user, group)
+		return RejectionReasonRateLimited
 	}
-	user := s[0]
-	group := s[1]
 
-	rateLimiter := p.rateLimitManager.RateLimiterFor(user)
-	if slices.Contains(p.upstreamConfig.AuthorizedGroups, group) && rateLimiter.ConnectionAllowed() {
-		return true
+	return ""
+}
+
+// rateLimitAllowed consults the RateLimitStore for a user. If the store fails, the configured FailOpen behavior
+// decides the outcome.
+func (p *Proxy) rateLimitAllowed(ctx context.Context, user string) bool {
+	ctx, span := p.tracer.Start(ctx, "rate_limit.check")
+	allowed, err := p.rateLimitStore.ConnectionAllowed(user)
+	if err == nil {
+		span.SetAttributes(attributeRateLimited.Bool(!allowed))
+	}
+	endSpan(span, err)
+	if err != nil {
+		p.logger.ErrorContext(
+			ctx,
+			"rate limit store unavailable",
+			slog.String("error", err.Error()),
+			slog.Bool("fail_open", p.rateLimitFailOpen),
+		)
+		return p.rateLimitFailOpen
 	}
 
-	return false
+	return allowed
 }
@@ -0,0 +1,370 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyProtocolVersion selects the version of the PROXY protocol header sent to upstreams, as described in
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+type ProxyProtocolVersion string
+
+const (
+	// ProxyProtocolV1 sends the human-readable header, carrying only the client and proxy addresses.
+	ProxyProtocolV1 ProxyProtocolVersion = "v1"
+	// ProxyProtocolV2 sends the binary header, with TLVs describing the client's identity and TLS connection.
+	ProxyProtocolV2 ProxyProtocolVersion = "v2"
+)
+
+// TLV types sent in PROXY protocol v2 headers. The SSL and authority types are standard, while the identity of the
+// client is sent in the range reserved for custom types.
+const (
+	// ProxyProtocolTLVAuthority carries the SNI sent by the client.
+	ProxyProtocolTLVAuthority byte = 0x02
+	// ProxyProtocolTLVSSL carries the client's TLS version and certificate common name as sub-TLVs.
+	ProxyProtocolTLVSSL byte = 0x20
+	// ProxyProtocolSubTLVSSLVersion carries the TLS version, for example "TLSv1.3".
+	ProxyProtocolSubTLVSSLVersion byte = 0x21
+	// ProxyProtocolSubTLVSSLCN carries the common name of the client certificate.
+	ProxyProtocolSubTLVSSLCN byte = 0x22
+	// ProxyProtocolTLVUser carries the user authenticated by the client certificate.
+	ProxyProtocolTLVUser byte = 0xE0
+	// ProxyProtocolTLVGroup carries the group authenticated by the client certificate.
+	ProxyProtocolTLVGroup byte = 0xE1
+	// ProxyProtocolTLVCertificateFingerprint carries the hex encoded SHA-256 fingerprint of the client certificate.
+	ProxyProtocolTLVCertificateFingerprint byte = 0xE2
+)
+
+const (
+	// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+	proxyProtocolV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+	// proxyProtocolV2Proxy is the version 2 and PROXY command byte.
+	proxyProtocolV2Proxy = 0x21
+	// proxyProtocolV2Local is the version 2 and LOCAL command byte, sent when addresses are unknown.
+	proxyProtocolV2Local = 0x20
+	// proxyProtocolV2TCP4 and proxyProtocolV2TCP6 are the address family and protocol bytes for TCP.
+	proxyProtocolV2TCP4 = 0x11
+	proxyProtocolV2TCP6 = 0x21
+
+	// proxyProtocolSSLClientSSL and proxyProtocolSSLClientCertConn flag that the client connected over TLS and
+	// presented a certificate.
+	proxyProtocolSSLClientSSL      = 0x01
+	proxyProtocolSSLClientCertConn = 0x02
+
+	// proxyProtocolV1MaxLength is the longest a PROXY protocol v1 header can be, including the CRLF.
+	proxyProtocolV1MaxLength = 107
+	// proxyProtocolReadTimeout bounds how long a trusted load balancer may take to send its PROXY protocol header.
+	proxyProtocolReadTimeout = 5 * time.Second
+)
+
+// proxyHeader describes a proxied connection, to be sent to an upstream as a PROXY protocol header.
+type proxyHeader struct {
+	// Source is the client's address, and Destination the address it connected to.
+	Source      net.Addr
+	Destination net.Addr
+
+	User        string
+	Group       string
+	SNI         string
+	TLSVersion  string
+	CommonName  string
+	Fingerprint string
+}
+
+// newProxyHeader describes a client connection for an upstream. TLS details are included if conn is a *tls.Conn
+// that has completed its handshake.
+func newProxyHeader(conn net.Conn, user string, group string) proxyHeader {
+	header := proxyHeader{
+		Source:      conn.RemoteAddr(),
+		Destination: conn.LocalAddr(),
+		User:        user,
+		Group:       group,
+	}
+	switch conn := conn.(type) {
+	case *tls.Conn:
+		state := conn.ConnectionState()
+		header.SNI = state.ServerName
+		header.TLSVersion = strings.Replace(tls.VersionName(state.Version), "TLS ", "TLSv", 1)
+		if len(state.PeerCertificates) > 0 {
+			header.CommonName = state.PeerCertificates[0].Subject.CommonName
+			_, header.Fingerprint = certificateFingerprint(state.PeerCertificates[0])
+		}
+	case *passthroughConn:
+		header.SNI = conn.hello.serverName
+	}
+
+	return header
+}
+
+// encode returns the header in the given version of the PROXY protocol.
+func (h proxyHeader) encode(version ProxyProtocolVersion) ([]byte, error) {
+	switch version {
+	case ProxyProtocolV1:
+		return h.encodeV1(), nil
+	case ProxyProtocolV2:
+		return h.encodeV2()
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+}
+
+// addresses returns the source and destination as addresses of the same family, or false if they cannot be
+// represented in a PROXY protocol header.
+func (h proxyHeader) addresses() (netip.AddrPort, netip.AddrPort, bool) {
+	if h.Source == nil || h.Destination == nil {
+		return netip.AddrPort{}, netip.AddrPort{}, false
+	}
+	source, sourceErr := netip.ParseAddrPort(h.Source.String())
+	destination, destinationErr := netip.ParseAddrPort(h.Destination.String())
+	if sourceErr != nil || destinationErr != nil {
+		return netip.AddrPort{}, netip.AddrPort{}, false
+	}
+
+	source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+	destination = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+	if source.Addr().Is4() != destination.Addr().Is4() {
+		source = netip.AddrPortFrom(netip.AddrFrom16(source.Addr().As16()), source.Port())
+		destination = netip.AddrPortFrom(netip.AddrFrom16(destination.Addr().As16()), destination.Port())
+	}
+
+	return source, destination, true
+}
+
+func (h proxyHeader) encodeV1() []byte {
+	source, destination, ok := h.addresses()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP4"
+	if source.Addr().Is6() {
+		family = "TCP6"
+	}
+
+	return []byte(fmt.Sprintf(
+		"PROXY %s %s %s %d %d\r\n",
+		family, source.Addr(), destination.Addr(), source.Port(), destination.Port(),
+	))
+}
+
+func (h proxyHeader) encodeV2() ([]byte, error) {
+	var body bytes.Buffer
+	command, family := byte(proxyProtocolV2Local), byte(0)
+	if source, destination, ok := h.addresses(); ok {
+		command, family = proxyProtocolV2Proxy, proxyProtocolV2TCP4
+		if source.Addr().Is6() {
+			family = proxyProtocolV2TCP6
+		}
+		body.Write(source.Addr().AsSlice())
+		body.Write(destination.Addr().AsSlice())
+		_ = binary.Write(&body, binary.BigEndian, source.Port())
+		_ = binary.Write(&body, binary.BigEndian, destination.Port())
+	}
+
+	writeTLV(&body, ProxyProtocolTLVAuthority, h.SNI)
+	if h.TLSVersion != "" {
+		var ssl bytes.Buffer
+		client := byte(proxyProtocolSSLClientSSL)
+		if h.CommonName != "" || h.Fingerprint != "" {
+			client |= proxyProtocolSSLClientCertConn
+		}
+		// The client byte is followed by a 32-bit verify field, where zero means the certificate was verified.
+		ssl.Write([]byte{client, 0, 0, 0, 0})
+		writeTLV(&ssl, ProxyProtocolSubTLVSSLVersion, h.TLSVersion)
+		writeTLV(&ssl, ProxyProtocolSubTLVSSLCN, h.CommonName)
+		writeTLV(&body, ProxyProtocolTLVSSL, ssl.String())
+	}
+	writeTLV(&body, ProxyProtocolTLVUser, h.User)
+	writeTLV(&body, ProxyProtocolTLVGroup, h.Group)
+	writeTLV(&body, ProxyProtocolTLVCertificateFingerprint, h.Fingerprint)
+	if body.Len() > 0xFFFF {
+		return nil, fmt.Errorf("PROXY protocol header of %d bytes is too large", body.Len())
+	}
+
+	header := make([]byte, 0, 16+body.Len())
+	header = append(header, proxyProtocolV2Signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(body.Len()))
+
+	return append(header, body.Bytes()...), nil
+}
+
+// writeTLV appends a TLV to b, unless value is empty.
+func writeTLV(b *bytes.Buffer, tlvType byte, value string) {
+	if value == "" {
+		return
+	}
+	b.WriteByte(tlvType)
+	_ = binary.Write(b, binary.BigEndian, uint16(len(value)))
+	b.WriteString(value)
+}
+
+// errNoProxyHeader is returned when a connection does not start with a PROXY protocol header.
+var errNoProxyHeader = errors.New("connection did not start with a PROXY protocol header")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r, returning the source and destination addresses it
+// carries. Nil addresses are returned for headers that do not describe a TCP connection, such as the v1 UNKNOWN
+// and v2 LOCAL commands, in which case the connection's own addresses should be used.
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	if prefix, err := r.Peek(len(proxyProtocolV2Signature)); err == nil && string(prefix) == proxyProtocolV2Signature {
+		return readProxyHeaderV2(r)
+	}
+	if prefix, err := r.Peek(6); err == nil && string(prefix) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+
+	return nil, nil, errNoProxyHeader
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, nil, errors.New("PROXY protocol v1 header is too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	source, sourceErr := parseProxyAddress(fields[2], fields[4], fields[1] == "TCP4")
+	destination, destinationErr := parseProxyAddress(fields[3], fields[5], fields[1] == "TCP4")
+	if sourceErr != nil || destinationErr != nil {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+
+	return source, destination, nil
+}
+
+// parseProxyAddress parses an address and port from a PROXY protocol v1 header.
+func parseProxyAddress(address string, port string, is4 bool) (net.Addr, error) {
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip.Is4() != is4 {
+		return nil, errors.New("address does not match the address family")
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(portNumber))), nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	prefix := make([]byte, 16)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(prefix[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch prefix[12] {
+	case proxyProtocolV2Local:
+		return nil, nil, nil
+	case proxyProtocolV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol v2 version and command 0x%02x", prefix[12])
+	}
+
+	// Only the address family is considered, so TCP and UDP are both accepted. TLVs are ignored.
+	var size int
+	switch prefix[13] >> 4 {
+	case 0x1:
+		size = 4
+	case 0x2:
+		size = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("PROXY protocol v2 header is too short for its addresses")
+	}
+	sourceIP, _ := netip.AddrFromSlice(body[:size])
+	destinationIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	source := netip.AddrPortFrom(sourceIP, binary.BigEndian.Uint16(body[2*size:]))
+	destination := netip.AddrPortFrom(destinationIP, binary.BigEndian.Uint16(body[2*size+2:]))
+
+	return net.TCPAddrFromAddrPort(source), net.TCPAddrFromAddrPort(destination), nil
+}
+
+// proxyProtocolConn is a connection whose addresses were read from a PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	reader      *bufio.Reader
+	source      net.Addr
+	destination net.Addr
+}
+
+// Read reads from the buffer first, as it may hold data sent after the header.
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// unwrap writes any data buffered after the header to w, then returns the underlying connection.
+func (c *proxyProtocolConn) unwrap(w io.Writer) (int64, net.Conn, error) {
+	buffered, _ := c.reader.Peek(c.reader.Buffered())
+	n, err := w.Write(buffered)
+	_, _ = c.reader.Discard(n)
+
+	return int64(n), c.Conn, err
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.source
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	return c.destination
+}
+
+// acceptProxyProtocol reads the PROXY protocol header from connections from trusted load balancers, returning a
+// connection reporting the addresses in the header. Connections from other sources are returned unchanged, and
+// any header they send is treated as part of the TLS handshake. Connections with an invalid header are closed.
+func (p *Proxy) acceptProxyProtocol(conn net.Conn) (net.Conn, error) {
+	if len(p.trustedProxies) == 0 {
+		return conn, nil
+	}
+	if !prefixesContain(p.trustedProxies, conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(proxyProtocolReadTimeout))
+	reader := bufio.NewReader(conn)
+	source, destination, err := readProxyHeader(reader)
+	if err == nil {
+		err = conn.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("from %s: %w", conn.RemoteAddr(), err)
+	}
+	if source == nil {
+		source, destination = conn.RemoteAddr(), conn.LocalAddr()
+	}
+
+	return &proxyProtocolConn{Conn: conn, reader: reader, source: source, destination: destination}, nil
+}
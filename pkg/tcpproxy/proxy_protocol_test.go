@@ -0,0 +1,302 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parseTLVs splits a sequence of PROXY protocol v2 TLVs by type.
+func parseTLVs(t *testing.T, data []byte) map[byte][]byte {
+	tlvs := make(map[byte][]byte)
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), 3)
+		length := int(binary.BigEndian.Uint16(data[1:]))
+		require.GreaterOrEqual(t, len(data), 3+length)
+		tlvs[data[0]] = data[3 : 3+length]
+		data = data[3+length:]
+	}
+
+	return tlvs
+}
+
+func TestProxyHeader_EncodeV1(t *testing.T) {
+	tests := map[string]struct {
+		header   proxyHeader
+		expected string
+	}{
+		"IPv4": {
+			header:   proxyHeader{Source: tcpAddr("10.0.0.1:50000"), Destination: tcpAddr("10.0.0.2:5000")},
+			expected: "PROXY TCP4 10.0.0.1 10.0.0.2 50000 5000\r\n",
+		},
+		"IPv6": {
+			header:   proxyHeader{Source: tcpAddr("[2001:db8::1]:50000"), Destination: tcpAddr("[2001:db8::2]:5000")},
+			expected: "PROXY TCP6 2001:db8::1 2001:db8::2 50000 5000\r\n",
+		},
+		"mixed families": {
+			header:   proxyHeader{Source: tcpAddr("10.0.0.1:50000"), Destination: tcpAddr("[2001:db8::2]:5000")},
+			expected: "PROXY TCP6 ::ffff:10.0.0.1 2001:db8::2 50000 5000\r\n",
+		},
+		"unknown": {
+			header:   proxyHeader{},
+			expected: "PROXY UNKNOWN\r\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := test.header.encode(ProxyProtocolV1)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(encoded))
+		})
+	}
+}
+
+func TestProxyHeader_EncodeV2(t *testing.T) {
+	header := proxyHeader{
+		Source:      tcpAddr("10.0.0.1:50000"),
+		Destination: tcpAddr("10.0.0.2:5000"),
+		User:        "user1",
+		Group:       "engineering",
+		SNI:         "proxy.example.com",
+		TLSVersion:  "TLSv1.3",
+		CommonName:  "user1@engineering",
+		Fingerprint: "abcdef",
+	}
+	encoded, err := header.encode(ProxyProtocolV2)
+	require.NoError(t, err)
+
+	require.Equal(t, proxyProtocolV2Signature, string(encoded[:12]))
+	assert.Equal(t, byte(proxyProtocolV2Proxy), encoded[12])
+	assert.Equal(t, byte(proxyProtocolV2TCP4), encoded[13])
+	assert.Equal(t, len(encoded)-16, int(binary.BigEndian.Uint16(encoded[14:])))
+	assert.Equal(t, []byte{10, 0, 0, 1, 10, 0, 0, 2, 0xC3, 0x50, 0x13, 0x88}, encoded[16:28])
+
+	tlvs := parseTLVs(t, encoded[28:])
+	assert.Equal(t, "proxy.example.com", string(tlvs[ProxyProtocolTLVAuthority]))
+	assert.Equal(t, "user1", string(tlvs[ProxyProtocolTLVUser]))
+	assert.Equal(t, "engineering", string(tlvs[ProxyProtocolTLVGroup]))
+	assert.Equal(t, "abcdef", string(tlvs[ProxyProtocolTLVCertificateFingerprint]))
+
+	ssl := tlvs[ProxyProtocolTLVSSL]
+	require.Greater(t, len(ssl), 5)
+	assert.Equal(t, byte(proxyProtocolSSLClientSSL|proxyProtocolSSLClientCertConn), ssl[0])
+	subTLVs := parseTLVs(t, ssl[5:])
+	assert.Equal(t, "TLSv1.3", string(subTLVs[ProxyProtocolSubTLVSSLVersion]))
+	assert.Equal(t, "user1@engineering", string(subTLVs[ProxyProtocolSubTLVSSLCN]))
+
+	// Without addresses, the LOCAL command is sent.
+	encoded, err = proxyHeader{User: "user1"}.encode(ProxyProtocolV2)
+	require.NoError(t, err)
+	assert.Equal(t, byte(proxyProtocolV2Local), encoded[12])
+	assert.Equal(t, byte(0), encoded[13])
+	assert.Equal(t, "user1", string(parseTLVs(t, encoded[16:])[ProxyProtocolTLVUser]))
+
+	_, err = header.encode("v3")
+	assert.Error(t, err)
+}
+
+func Test_ProxySendsProxyProtocolHeader(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = upstream.Close() }()
+
+	config := testProxyConfig(t, upstream.Addr().String(), "engineering")
+	config.UpstreamConfig.ProxyProtocol = ProxyProtocolV2
+	proxy := startTestProxy(t, config)
+
+	clientConfig := clientTlsConfig(t, "user1")
+	clientConfig.ServerName = "localhost"
+	conn, err := tls.Dial("tcp", proxy.Address(), clientConfig)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	upstreamConn, err := upstream.Accept()
+	require.NoError(t, err)
+	require.NoError(t, upstreamConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	prefix := make([]byte, 16)
+	_, err = io.ReadFull(upstreamConn, prefix)
+	require.NoError(t, err)
+	body := make([]byte, binary.BigEndian.Uint16(prefix[14:]))
+	_, err = io.ReadFull(upstreamConn, body)
+	require.NoError(t, err)
+
+	// The source is the client's address, and the destination the proxy's listener.
+	assert.Equal(t, byte(proxyProtocolV2TCP4), prefix[13])
+	assert.Equal(t, conn.LocalAddr().(*net.TCPAddr).Port, int(binary.BigEndian.Uint16(body[8:])))
+	assert.Equal(t, proxy.listener.Addr().(*net.TCPAddr).Port, int(binary.BigEndian.Uint16(body[10:])))
+	tlvs := parseTLVs(t, body[12:])
+	assert.Equal(t, "user1", string(tlvs[ProxyProtocolTLVUser]))
+	assert.Equal(t, "engineering", string(tlvs[ProxyProtocolTLVGroup]))
+	assert.Equal(t, "localhost", string(tlvs[ProxyProtocolTLVAuthority]))
+	assert.Len(t, tlvs[ProxyProtocolTLVCertificateFingerprint], 64)
+
+	// The client's data follows the header.
+	data := make([]byte, 5)
+	_, err = io.ReadFull(upstreamConn, data)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	assert.NoError(t, upstreamConn.Close())
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	header := proxyHeader{
+		Source:      tcpAddr("[2001:db8::1]:50000"),
+		Destination: tcpAddr("[2001:db8::2]:5000"),
+		User:        "user1",
+	}
+	for _, version := range []ProxyProtocolVersion{ProxyProtocolV1, ProxyProtocolV2} {
+		encoded, err := header.encode(version)
+		require.NoError(t, err)
+		reader := bufio.NewReader(bytes.NewReader(append(encoded, "hello"...)))
+
+		source, destination, err := readProxyHeader(reader)
+		require.NoError(t, err, version)
+		assert.Equal(t, "[2001:db8::1]:50000", source.String(), version)
+		assert.Equal(t, "[2001:db8::2]:5000", destination.String(), version)
+
+		// Data following the header is left to be read.
+		rest, _ := io.ReadAll(reader)
+		assert.Equal(t, "hello", string(rest), version)
+	}
+
+	// Headers without addresses leave them to the connection.
+	for _, version := range []ProxyProtocolVersion{ProxyProtocolV1, ProxyProtocolV2} {
+		encoded, _ := proxyHeader{}.encode(version)
+		source, destination, err := readProxyHeader(bufio.NewReader(bytes.NewReader(encoded)))
+		require.NoError(t, err, version)
+		assert.Nil(t, source, version)
+		assert.Nil(t, destination, version)
+	}
+}
+
+func TestReadProxyHeader_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"no header":        "\x16\x03\x01\x00\xa5",
+		"too long":         "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		"unknown protocol": "PROXY UDP4 10.0.0.1 10.0.0.2 1 2\r\n",
+		"wrong family":     "PROXY TCP4 2001:db8::1 10.0.0.2 1 2\r\n",
+		"invalid port":     "PROXY TCP4 10.0.0.1 10.0.0.2 1 70000\r\n",
+		"short v2":         proxyProtocolV2Signature + "\x21\x11\x00\x04\x0a\x00\x00\x01",
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(input)))
+			assert.Error(t, err)
+		})
+	}
+}
+
+// dialThroughLoadBalancer connects to the proxy, sends header, and completes a TLS handshake as user.
+func dialThroughLoadBalancer(t *testing.T, proxy *Proxy, header string, user string) (*tls.Conn, error) {
+	conn, err := net.Dial("tcp", proxy.Address())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(header))
+	require.NoError(t, err)
+
+	clientConfig := clientTlsConfig(t, user)
+	clientConfig.ServerName = "localhost"
+	tlsConn := tls.Client(conn, clientConfig)
+	if err = tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func Test_ProxyAcceptsProxyProtocolFromTrustedProxies(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.ListenerConfig.TrustedProxies = []string{"127.0.0.0/8"}
+	sink := newRecordingSink()
+	config.AccessLogConfig = &AccessLogConfig{Sink: sink}
+	proxy := startTestProxy(t, config)
+
+	conn, err := dialThroughLoadBalancer(t, proxy, "PROXY TCP4 203.0.113.7 10.0.0.2 50000 5000\r\n", "user1")
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+
+	sessions := proxy.Sessions("user1", "")
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "203.0.113.7:50000", sessions[0].ClientAddress)
+	assert.Equal(t, 1, proxy.TerminateUserSessions("user1"))
+	select {
+	case record := <-sink.records:
+		assert.Equal(t, "203.0.113.7:50000", record.ClientAddress)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not close")
+	}
+	assert.NoError(t, conn.Close())
+
+	// Trusted sources must send a header.
+	_, err = dialThroughLoadBalancer(t, proxy, "", "user1")
+	assert.Error(t, err)
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
+
+func Test_ProxyReadsProxyProtocolOutsideAcceptLoop(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.ListenerConfig.TrustedProxies = []string{"127.0.0.0/8"}
+	config.ConnectionLimitConfig = &ConnectionLimitConfig{SourceCapacity: 1, SourceFillRate: time.Hour}
+	proxy := startTestProxy(t, config)
+
+	// A load balancer connection that never sends its header does not hold up the next one.
+	silent, err := net.Dial("tcp", proxy.Address())
+	require.NoError(t, err)
+	defer func() { _ = silent.Close() }()
+	start := time.Now()
+	conn, err := dialThroughLoadBalancer(t, proxy, "PROXY TCP4 203.0.113.7 10.0.0.2 50000 5000\r\n", "user1")
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), proxyProtocolReadTimeout)
+	assert.NoError(t, conn.Close())
+
+	// Connections through the load balancer are limited by the client address in their header.
+	conn, err = dialThroughLoadBalancer(t, proxy, "PROXY TCP4 203.0.113.8 10.0.0.2 50000 5000\r\n", "user1")
+	require.NoError(t, err)
+	assert.NoError(t, conn.Close())
+	_, err = dialThroughLoadBalancer(t, proxy, "PROXY TCP4 203.0.113.7 10.0.0.2 50001 5000\r\n", "user1")
+	assert.Error(t, err)
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
+
+func Test_ProxyIgnoresProxyProtocolFromUntrustedSources(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.ListenerConfig.TrustedProxies = []string{"10.0.0.0/8"}
+	proxy := startTestProxy(t, config)
+
+	// The header is treated as the start of the TLS handshake, which fails.
+	_, err := dialThroughLoadBalancer(t, proxy, "PROXY TCP4 203.0.113.7 10.0.0.2 50000 5000\r\n", "user1")
+	assert.Error(t, err)
+
+	// Clients connecting directly are unaffected.
+	conn, err := dialThroughLoadBalancer(t, proxy, "", "user1")
+	require.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
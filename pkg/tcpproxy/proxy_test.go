@@ -5,7 +5,9 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"os"
 	"testing"
 	"time"
@@ -64,6 +66,158 @@ func Test_ProxyForwardsRequests_UnauthorizedClient(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func Test_ProxyRejectsWithBanner(t *testing.T) {
+	config := testProxyConfig(t, "localhost:0", "administrators")
+	config.ListenerConfig.RejectionMode = RejectionModeBanner
+	proxy := startTestProxy(t, config)
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+
+	// The proxy explains why before closing the connection.
+	result, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ERROR unauthorized group is not authorized for this upstream\n", result)
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+}
+
+func Test_ProxyRejectsWithTLSAlert(t *testing.T) {
+	config := testProxyConfig(t, "localhost:0", "administrators")
+	config.ListenerConfig.RejectionMode = RejectionModeTLSAlert
+	proxy := startTestProxy(t, config)
+
+	// With TLS 1.3 the client learns about the alert on its first read.
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.ErrorContains(t, err, "bad certificate")
+	assert.NoError(t, proxy.Close())
+}
+
+func Test_ProxyReload(t *testing.T) {
+	config := testProxyConfig(t, "localhost:0", "engineering")
+	proxy, err := New(config)
+	require.NoError(t, err)
+	defer proxy.listener.Close()
+	previous := proxy.tlsConfig.Load()
+
+	require.NoError(t, proxy.Reload())
+	assert.NotSame(t, previous, proxy.tlsConfig.Load())
+
+	// A failed reload keeps the previous TLS material in use.
+	previous = proxy.tlsConfig.Load()
+	config.ListenerConfig.Certificate = certificatePath("missing.pem")
+	assert.Error(t, proxy.Reload())
+	assert.Same(t, previous, proxy.tlsConfig.Load())
+}
+
+// setupUpstream accepts a single connection on a new listener, handling it with handle, until the test ends.
+func setupUpstream(t *testing.T, handle func(conn *net.TCPConn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		handle(conn.(*net.TCPConn))
+	}()
+
+	return listener.Addr().String()
+}
+
+func Test_ProxyPropagatesHalfCloseFromClient(t *testing.T) {
+	// The upstream only answers once the client has finished sending.
+	target := setupUpstream(t, func(conn *net.TCPConn) {
+		request, _ := io.ReadAll(conn)
+		_, _ = fmt.Fprintf(conn, "received %q", request)
+	})
+	config := testProxyConfig(t, target, "engineering")
+	sink := newRecordingSink()
+	config.AccessLogConfig = &AccessLogConfig{Sink: sink}
+	proxy := startTestProxy(t, config)
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	response, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, `received "hello world"`, string(response))
+	select {
+	case record := <-sink.records:
+		assert.Equal(t, CloseReasonClientClosed, record.CloseReason)
+		assert.Equal(t, int64(len("hello world")), record.BytesIn)
+		assert.Equal(t, int64(len(response)), record.BytesOut)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not close")
+	}
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+}
+
+func Test_ProxyPropagatesHalfCloseFromUpstream(t *testing.T) {
+	// The upstream sends a greeting and finishes sending, then still reads what the client sends.
+	received := make(chan string, 1)
+	target := setupUpstream(t, func(conn *net.TCPConn) {
+		_, _ = conn.Write([]byte("greeting"))
+		_ = conn.CloseWrite()
+		request, _ := io.ReadAll(conn)
+		received <- string(request)
+	})
+	proxy := setupTestProxy(t, target, "engineering")
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	greeting, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "greeting", string(greeting))
+	_, err = conn.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	select {
+	case request := <-received:
+		assert.Equal(t, "hello world", request)
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream did not receive the request")
+	}
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+}
+
+func Test_ProxyClosesHalfClosedSessionsAfterTimeout(t *testing.T) {
+	// The upstream never answers, or closes the connection.
+	done := make(chan struct{})
+	defer close(done)
+	target := setupUpstream(t, func(conn *net.TCPConn) {
+		_, _ = io.ReadAll(conn)
+		<-done
+	})
+	config := testProxyConfig(t, target, "engineering")
+	config.ListenerConfig.HalfCloseTimeout = 100 * time.Millisecond
+	proxy := startTestProxy(t, config)
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return proxy.sessions.count() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+}
+
 func Test_CannotCloseAlreadyClosed(t *testing.T) {
 	proxy := setupTestProxy(t, "localhost:0", "")
 	assert.Error(t, proxy.Close())
@@ -81,6 +235,10 @@ func Test_CannotServeIfAlreadyServing(t *testing.T) {
 }
 
 func setupTestProxy(t *testing.T, target string, authorizedGroup string) *Proxy {
+	return startTestProxy(t, testProxyConfig(t, target, authorizedGroup))
+}
+
+func testProxyConfig(t *testing.T, target string, authorizedGroup string) *Config {
 	targets := []string{target}
 	loadBalancer, err := NewLeastConnectionBalancer(targets)
 	require.NoError(t, err)
@@ -106,6 +264,11 @@ func setupTestProxy(t *testing.T, target string, authorizedGroup string) *Proxy
 		},
 		Logger: slog.Default(),
 	}
+
+	return config
+}
+
+func startTestProxy(t *testing.T, config *Config) *Proxy {
 	proxy, err := New(config)
 	require.NoError(t, err)
 
@@ -132,7 +295,7 @@ func setupEchoServer(t *testing.T) *echoServer {
 	return echoSrv
 }
 
-func clientTlsConfig(t *testing.T, user string) *tls.Config {
+func clientTlsConfig(t testing.TB, user string) *tls.Config {
 	pool := x509.NewCertPool()
 	caData, err := os.ReadFile(certificatePath("ca.pem"))
 	require.NoError(t, err)
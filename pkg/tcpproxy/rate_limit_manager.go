@@ -1,38 +1,66 @@
 package tcpproxy
 
 import (
+	"errors"
+	"io/fs"
 	"log/slog"
+	"slices"
 	"sync"
 	"time"
 )
 
-// RateLimitManager wraps many RateLimiters and provides mechanisms for getting per-client RateLimiters.
+// RateLimitManager wraps many Limiters and provides mechanisms for getting per-client Limiters.
 type RateLimitManager struct {
-	defaultCapacity int
-	defaultFillRate time.Duration
-	logger          *slog.Logger
-	rateLimiters    map[string]*RateLimiter
-	mutex           sync.RWMutex
+	config       RateLimitConfig
+	logger       *slog.Logger
+	rateLimiters map[string]Limiter
+	mutex        sync.RWMutex
+
+	shutdownC chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
-// NewRateLimitManager returns a configured RateLimitManager.
+// NewRateLimitManager returns a RateLimitManager using the token bucket algorithm.
 func NewRateLimitManager(capacity int, fillRate time.Duration, logger *slog.Logger) *RateLimitManager {
-	return &RateLimitManager{
-		defaultCapacity: capacity,
-		defaultFillRate: fillRate,
-		logger:          logger,
-		rateLimiters:    make(map[string]*RateLimiter),
-		mutex:           sync.RWMutex{},
+	return NewRateLimitManagerFromConfig(&RateLimitConfig{Capacity: capacity, FillRate: fillRate}, logger)
+}
+
+// NewRateLimitManagerFromConfig returns a RateLimitManager using the algorithm selected in a RateLimitConfig. If a
+// StatePath is configured, state is restored from it and saved periodically until Close. A missing or unusable
+// snapshot is logged and the RateLimitManager starts fresh.
+func NewRateLimitManagerFromConfig(conf *RateLimitConfig, logger *slog.Logger) *RateLimitManager {
+	r := &RateLimitManager{
+		config:       *conf,
+		logger:       logger,
+		rateLimiters: make(map[string]Limiter),
+		mutex:        sync.RWMutex{},
+		shutdownC:    make(chan struct{}),
+	}
+
+	if r.config.StatePath != "" {
+		if err := r.LoadState(r.config.StatePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("ignoring rate limit state", "path", r.config.StatePath, "error", err)
+		}
+
+		interval := r.config.StateInterval
+		if interval == 0 {
+			interval = defaultRateLimitStateInterval
+		}
+		r.wg.Add(1)
+		go r.persistState(r.config.StatePath, interval)
 	}
+
+	return r
 }
 
-// RateLimiterFor returns, or creates, a RateLimiter for a given client string.
-func (r *RateLimitManager) RateLimiterFor(client string) *RateLimiter {
-	var rateLimiter *RateLimiter
+// RateLimiterFor returns, or creates, a Limiter for a given client string.
+func (r *RateLimitManager) RateLimiterFor(client string) Limiter {
+	var rateLimiter Limiter
 
 	r.mutex.Lock()
 	if r.rateLimiters[client] == nil {
-		rateLimiter = NewRateLimiter(int64(r.defaultCapacity), r.defaultFillRate)
+		rateLimiter = newLimiter(&r.config)
 		r.rateLimiters[client] = rateLimiter
 	} else {
 		rateLimiter = r.rateLimiters[client]
@@ -42,9 +70,109 @@ func (r *RateLimitManager) RateLimiterFor(client string) *RateLimiter {
 	return rateLimiter
 }
 
-// Close calls Close() on all known RateLimiters. RateLimiters can only be closed once, however this
-// func will handle if a RateLimiter is already closed.
+// ConnectionAllowed implements RateLimitStore by consulting the in-memory Limiter for a given client. It never
+// returns an error.
+func (r *RateLimitManager) ConnectionAllowed(client string) (bool, error) {
+	return r.RateLimiterFor(client).ConnectionAllowed(), nil
+}
+
+// RateLimitState is a point-in-time view of a single client's rate limit.
+type RateLimitState struct {
+	Client    string             `json:"client"`
+	Algorithm RateLimitAlgorithm `json:"algorithm"`
+	Capacity  int                `json:"capacity"`
+	// Remaining is how many connections the client could open right now.
+	Remaining int `json:"remaining"`
+	// RetryAfter is how long until the client may connect again, if it is currently limited.
+	RetryAfter time.Duration `json:"retry_after"`
+}
+
+// State returns the current rate limit state of a client. False is returned if the client has no Limiter yet,
+// meaning it has the full Capacity available.
+func (r *RateLimitManager) State(client string) (RateLimitState, bool) {
+	state := RateLimitState{
+		Client:    client,
+		Algorithm: r.algorithm(),
+		Capacity:  r.config.Capacity,
+		Remaining: r.config.Capacity,
+	}
+
+	r.mutex.RLock()
+	limiter, ok := r.rateLimiters[client]
+	r.mutex.RUnlock()
+	if !ok {
+		return state, false
+	}
+
+	if inspectable, ok := limiter.(inspectableLimiter); ok {
+		state.Remaining = inspectable.remaining()
+		state.RetryAfter = inspectable.retryAfter()
+	}
+
+	return state, true
+}
+
+// States returns the current rate limit state of every client with a Limiter, ordered by client.
+func (r *RateLimitManager) States() []RateLimitState {
+	r.mutex.RLock()
+	clients := make([]string, 0, len(r.rateLimiters))
+	for client := range r.rateLimiters {
+		clients = append(clients, client)
+	}
+	r.mutex.RUnlock()
+	slices.Sort(clients)
+
+	states := make([]RateLimitState, 0, len(clients))
+	for _, client := range clients {
+		// Clients reset since the list was taken are skipped.
+		if state, ok := r.State(client); ok {
+			states = append(states, state)
+		}
+	}
+
+	return states
+}
+
+// Reset discards a client's Limiter, restoring its full Capacity. It returns false if the client had no Limiter.
+func (r *RateLimitManager) Reset(client string) bool {
+	r.mutex.Lock()
+	limiter, ok := r.rateLimiters[client]
+	delete(r.rateLimiters, client)
+	r.mutex.Unlock()
+
+	if ok {
+		if err := limiter.Close(); err != nil {
+			r.logger.Warn("error closing rate limiter", "error", err)
+		}
+	}
+
+	return ok
+}
+
+// RetryAfter estimates how long a client must wait before its next connection would be allowed. Zero is returned
+// if the client is not currently limited or the Limiter cannot estimate it.
+func (r *RateLimitManager) RetryAfter(client string) time.Duration {
+	if limiter, ok := r.RateLimiterFor(client).(retryAfterLimiter); ok {
+		return limiter.retryAfter()
+	}
+
+	return 0
+}
+
+// Close calls Close() on all known Limiters. RateLimiters can only be closed once, however this
+// func will handle if a RateLimiter is already closed. If a StatePath is configured, a final snapshot is saved first.
 func (r *RateLimitManager) Close() {
+	r.closeOnce.Do(func() {
+		close(r.shutdownC)
+		r.wg.Wait()
+
+		if r.config.StatePath != "" {
+			if err := r.SaveState(r.config.StatePath); err != nil {
+				r.logger.Warn("error saving rate limit state", "error", err)
+			}
+		}
+	})
+
 	r.mutex.RLock()
 	for _, rateLimiter := range r.rateLimiters {
 		if rateLimiter != nil {
@@ -17,3 +17,46 @@ func TestNewRateLimitManager(t *testing.T) {
 	// Ensure we clean up goroutines for the manager and any child RateLimiters
 	rlm.Close()
 }
+
+func TestNewRateLimitManagerFromConfig(t *testing.T) {
+	rlm := NewRateLimitManagerFromConfig(&RateLimitConfig{
+		Algorithm: RateLimitAlgorithmSlidingWindowLog,
+		Capacity:  1,
+		Window:    time.Minute,
+	}, slog.Default())
+	defer rlm.Close()
+
+	assert.IsType(t, &SlidingWindowLogLimiter{}, rlm.RateLimiterFor("user1"))
+
+	allowed, err := rlm.ConnectionAllowed("user1")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = rlm.ConnectionAllowed("user1")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestRateLimitConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&RateLimitConfig{Capacity: 1, FillRate: time.Second}).validate())
+	assert.NoError(t, (&RateLimitConfig{Algorithm: RateLimitAlgorithmGCRA, Capacity: 1, FillRate: time.Second}).validate())
+	assert.Error(t, (&RateLimitConfig{Algorithm: RateLimitAlgorithmSlidingWindowCounter, Capacity: 1}).validate())
+	assert.Error(t, (&RateLimitConfig{Algorithm: "leaky", Capacity: 1, FillRate: time.Second}).validate())
+	assert.Error(t, (&RateLimitConfig{FillRate: time.Second}).validate())
+}
+
+func TestRateLimitManager_States(t *testing.T) {
+	rlm := NewRateLimitManager(2, time.Minute, slog.Default())
+	defer rlm.Close()
+
+	for _, client := range []string{"user2", "user1", "user2"} {
+		allowed, _ := rlm.ConnectionAllowed(client)
+		assert.True(t, allowed)
+	}
+
+	states := rlm.States()
+	assert.Len(t, states, 2)
+	assert.Equal(t, "user1", states[0].Client)
+	assert.Equal(t, 1, states[0].Remaining)
+	assert.Equal(t, "user2", states[1].Client)
+	assert.Equal(t, 0, states[1].Remaining)
+}
@@ -0,0 +1,241 @@
+package tcpproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// rateLimitSnapshotVersion is bumped whenever the snapshot format changes incompatibly. Snapshots with any other
+// version are ignored.
+const rateLimitSnapshotVersion = 1
+
+// defaultRateLimitStateInterval is how often state is saved when RateLimitConfig.StateInterval is unset.
+const defaultRateLimitStateInterval = 1 * time.Minute
+
+// rateLimitSnapshotFile is the on-disk envelope. The checksum covers the raw payload so that truncated or modified
+// files are detected before any state is restored.
+type rateLimitSnapshotFile struct {
+	Version  int             `json:"version"`
+	Checksum uint32          `json:"checksum"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+type rateLimitSnapshot struct {
+	SavedAt   time.Time               `json:"saved_at"`
+	Algorithm RateLimitAlgorithm      `json:"algorithm"`
+	Limiters  map[string]limiterState `json:"limiters"`
+}
+
+// limiterState is the persisted state of a single Limiter. Only the fields relevant to the algorithm are set.
+// Absolute timestamps are stored where possible, so that elapsed wall time is accounted for on restore.
+type limiterState struct {
+	Tokens             int64       `json:"tokens,omitempty"`
+	Log                []time.Time `json:"log,omitempty"`
+	WindowStart        time.Time   `json:"window_start,omitempty"`
+	CurrentCount       int         `json:"current_count,omitempty"`
+	PreviousCount      int         `json:"previous_count,omitempty"`
+	TheoreticalArrival time.Time   `json:"theoretical_arrival,omitempty"`
+}
+
+// persistentLimiter is implemented by Limiters whose state can survive a restart.
+type persistentLimiter interface {
+	saveState() limiterState
+	// loadState restores state saved at savedAt, accounting for any time elapsed since.
+	loadState(state limiterState, savedAt time.Time)
+}
+
+// SaveState writes a snapshot of all per-client Limiters to path. The file is written to a temporary file and
+// renamed into place, so a crash while saving never leaves a partial snapshot behind.
+func (r *RateLimitManager) SaveState(path string) error {
+	snapshot := rateLimitSnapshot{
+		SavedAt:   time.Now(),
+		Algorithm: r.algorithm(),
+		Limiters:  make(map[string]limiterState),
+	}
+	r.mutex.RLock()
+	for client, limiter := range r.rateLimiters {
+		if persistent, ok := limiter.(persistentLimiter); ok {
+			snapshot.Limiters[client] = persistent.saveState()
+		}
+	}
+	r.mutex.RUnlock()
+
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rateLimitSnapshotFile{
+		Version:  rateLimitSnapshotVersion,
+		Checksum: crc32.ChecksumIEEE(payload),
+		Payload:  payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and renames it into place, so readers
+// see either the old or the new contents in full.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadState restores per-client Limiters from a snapshot at path. Snapshots that are missing, corrupt, from another
+// version or for another algorithm return an error and leave the RateLimitManager untouched.
+func (r *RateLimitManager) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file rateLimitSnapshotFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("corrupt rate limit snapshot: %w", err)
+	}
+	if file.Version != rateLimitSnapshotVersion {
+		return fmt.Errorf("unsupported rate limit snapshot version %d", file.Version)
+	}
+	if crc32.ChecksumIEEE(file.Payload) != file.Checksum {
+		return errors.New("corrupt rate limit snapshot: checksum mismatch")
+	}
+
+	var snapshot rateLimitSnapshot
+	if err = json.Unmarshal(file.Payload, &snapshot); err != nil {
+		return fmt.Errorf("corrupt rate limit snapshot: %w", err)
+	}
+	if snapshot.Algorithm != r.algorithm() {
+		return fmt.Errorf("rate limit snapshot is for algorithm %q, not %q", snapshot.Algorithm, r.algorithm())
+	}
+
+	for client, state := range snapshot.Limiters {
+		if persistent, ok := r.RateLimiterFor(client).(persistentLimiter); ok {
+			persistent.loadState(state, snapshot.SavedAt)
+		}
+	}
+
+	return nil
+}
+
+// persistState periodically saves state until the RateLimitManager is closed.
+func (r *RateLimitManager) persistState(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-r.shutdownC:
+			ticker.Stop()
+			r.wg.Done()
+			return
+		case <-ticker.C:
+			if err := r.SaveState(path); err != nil {
+				r.logger.Warn("error saving rate limit state", "error", err)
+			}
+		}
+	}
+}
+
+func (r *RateLimitManager) algorithm() RateLimitAlgorithm {
+	if r.config.Algorithm == "" {
+		return RateLimitAlgorithmTokenBucket
+	}
+
+	return r.config.Algorithm
+}
+
+func (r *RateLimiter) saveState() limiterState {
+	return limiterState{Tokens: r.tokens.Load()}
+}
+
+func (r *RateLimiter) loadState(state limiterState, savedAt time.Time) {
+	tokens := state.Tokens
+	if elapsed := time.Since(savedAt); elapsed > 0 {
+		tokens += int64(elapsed / r.fillRate * tokenFillRate)
+	}
+	r.tokens.Store(max(0, min(r.capacity, tokens)))
+}
+
+func (s *SlidingWindowLogLimiter) saveState() limiterState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return limiterState{Log: append([]time.Time(nil), s.log...)}
+}
+
+func (s *SlidingWindowLogLimiter) loadState(state limiterState, _ time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Keep at most the newest capacity entries; expired entries are dropped on the next check.
+	log := state.Log
+	if len(log) > s.capacity {
+		log = log[len(log)-s.capacity:]
+	}
+	s.log = append(s.log[:0], log...)
+}
+
+func (s *SlidingWindowCounterLimiter) saveState() limiterState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return limiterState{
+		WindowStart:   s.currentStart,
+		CurrentCount:  s.currentCount,
+		PreviousCount: s.previousCount,
+	}
+}
+
+func (s *SlidingWindowCounterLimiter) loadState(state limiterState, _ time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// A window start in the future can only come from clock skew, so fall back to a fresh window.
+	if state.WindowStart.After(s.now()) {
+		return
+	}
+	s.currentStart = state.WindowStart
+	s.currentCount = state.CurrentCount
+	s.previousCount = state.PreviousCount
+}
+
+func (g *GCRALimiter) saveState() limiterState {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return limiterState{TheoreticalArrival: g.theoreticalArrival}
+}
+
+func (g *GCRALimiter) loadState(state limiterState, _ time.Time) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// Never restore a theoretical arrival beyond the burst tolerance, which would lock the client out.
+	limit := g.now().Add(g.burstTolerance + g.emissionInterval)
+	if state.TheoreticalArrival.After(limit) {
+		state.TheoreticalArrival = limit
+	}
+	g.theoreticalArrival = state.TheoreticalArrival
+}
@@ -0,0 +1,127 @@
+package tcpproxy
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitManager_StateSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	conf := &RateLimitConfig{Capacity: 2, FillRate: time.Hour, StatePath: path}
+
+	rlm := NewRateLimitManagerFromConfig(conf, slog.Default())
+	for i := 0; i < 2; i++ {
+		allowed, err := rlm.ConnectionAllowed("user1")
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	rlm.Close()
+
+	// After a restart, user1 is still out of tokens while user2 is unaffected.
+	rlm = NewRateLimitManagerFromConfig(conf, slog.Default())
+	defer rlm.Close()
+	allowed, _ := rlm.ConnectionAllowed("user1")
+	assert.False(t, allowed)
+	allowed, _ = rlm.ConnectionAllowed("user2")
+	assert.True(t, allowed)
+}
+
+func TestRateLimitManager_LoadStateAccountsForElapsedTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	writeSnapshot(t, path, rateLimitSnapshotVersion, rateLimitSnapshot{
+		SavedAt:   time.Now().Add(-90 * time.Second),
+		Algorithm: RateLimitAlgorithmTokenBucket,
+		Limiters:  map[string]limiterState{"user1": {Tokens: 0}},
+	})
+
+	rlm := NewRateLimitManager(5, time.Minute, slog.Default())
+	defer rlm.Close()
+	require.NoError(t, rlm.LoadState(path))
+
+	// One full FillRate elapsed while the proxy was down, so exactly one token was added back.
+	assert.Equal(t, int64(1), rlm.RateLimiterFor("user1").(*RateLimiter).tokens.Load())
+}
+
+func TestRateLimitManager_LoadStateRejectsBadSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	rlm := NewRateLimitManager(5, time.Minute, slog.Default())
+	defer rlm.Close()
+
+	snapshot := rateLimitSnapshot{
+		SavedAt:   time.Now(),
+		Algorithm: RateLimitAlgorithmTokenBucket,
+		Limiters:  map[string]limiterState{"user1": {Tokens: 0}},
+	}
+
+	garbage := filepath.Join(dir, "garbage.json")
+	require.NoError(t, os.WriteFile(garbage, []byte("{\"version\":1,\"payl"), 0o600))
+	assert.Error(t, rlm.LoadState(garbage))
+
+	tampered := filepath.Join(dir, "tampered.json")
+	writeSnapshot(t, tampered, rateLimitSnapshotVersion, snapshot)
+	data, err := os.ReadFile(tampered)
+	require.NoError(t, err)
+	var file rateLimitSnapshotFile
+	require.NoError(t, json.Unmarshal(data, &file))
+	file.Checksum++
+	data, err = json.Marshal(file)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tampered, data, 0o600))
+	assert.Error(t, rlm.LoadState(tampered))
+
+	future := filepath.Join(dir, "future.json")
+	writeSnapshot(t, future, rateLimitSnapshotVersion+1, snapshot)
+	assert.Error(t, rlm.LoadState(future))
+
+	snapshot.Algorithm = RateLimitAlgorithmGCRA
+	other := filepath.Join(dir, "other.json")
+	writeSnapshot(t, other, rateLimitSnapshotVersion, snapshot)
+	assert.Error(t, rlm.LoadState(other))
+
+	// None of the rejected snapshots touched user1's state.
+	assert.Equal(t, int64(5), rlm.RateLimiterFor("user1").(*RateLimiter).tokens.Load())
+
+	// A manager configured with a corrupt StatePath still starts.
+	corrupt := NewRateLimitManagerFromConfig(&RateLimitConfig{Capacity: 1, FillRate: time.Minute, StatePath: garbage}, slog.Default())
+	allowed, err := corrupt.ConnectionAllowed("user1")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	corrupt.Close()
+}
+
+func TestRateLimitManager_SlidingWindowStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	conf := &RateLimitConfig{Algorithm: RateLimitAlgorithmSlidingWindowLog, Capacity: 1, Window: time.Hour}
+
+	rlm := NewRateLimitManagerFromConfig(conf, slog.Default())
+	allowed, _ := rlm.ConnectionAllowed("user1")
+	assert.True(t, allowed)
+	require.NoError(t, rlm.SaveState(path))
+	rlm.Close()
+
+	rlm = NewRateLimitManagerFromConfig(conf, slog.Default())
+	defer rlm.Close()
+	require.NoError(t, rlm.LoadState(path))
+	allowed, _ = rlm.ConnectionAllowed("user1")
+	assert.False(t, allowed)
+}
+
+func writeSnapshot(t *testing.T, path string, version int, snapshot rateLimitSnapshot) {
+	payload, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+	data, err := json.Marshal(rateLimitSnapshotFile{
+		Version:  version,
+		Checksum: crc32.ChecksumIEEE(payload),
+		Payload:  payload,
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
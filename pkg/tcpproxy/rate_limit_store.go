@@ -0,0 +1,18 @@
+package tcpproxy
+
+import "time"
+
+// RateLimitStore is the backing storage used to track per-client rate limits. The in-memory RateLimitManager is
+// used by default, while a shared store such as RedisRateLimitStore allows limits to be enforced across replicas.
+type RateLimitStore interface {
+	// ConnectionAllowed consumes a token for the given client if one is available. An error is returned if the
+	// store could not be consulted, in which case the caller decides whether to fail open or closed.
+	ConnectionAllowed(client string) (bool, error)
+	// Close releases any resources held by the store.
+	Close()
+}
+
+// retryAfterStore is implemented by RateLimitStores that can estimate when a rate limited client may retry.
+type retryAfterStore interface {
+	RetryAfter(client string) time.Duration
+}
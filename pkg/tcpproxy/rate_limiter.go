@@ -62,6 +62,21 @@ func (r *RateLimiter) ConnectionAllowed() bool {
 	return false
 }
 
+// remaining returns the tokens currently in the bucket.
+func (r *RateLimiter) remaining() int {
+	return int(r.tokens.Load())
+}
+
+// retryAfter returns the FillRate when the bucket is empty. The exact time of the next tick is not tracked, so this
+// is an upper bound.
+func (r *RateLimiter) retryAfter() time.Duration {
+	if r.tokens.Load() > 0 {
+		return 0
+	}
+
+	return r.fillRate
+}
+
 func (r *RateLimiter) fillTokens() {
 	ticker := time.NewTicker(r.fillRate)
 	for {
@@ -71,8 +86,9 @@ func (r *RateLimiter) fillTokens() {
 			r.wg.Done()
 			return
 		case <-ticker.C:
+			// An empty bucket is refilled too, otherwise a client that used all its tokens would be locked out.
 			tokens := r.tokens.Load()
-			if tokens != 0 && tokens < r.capacity {
+			if tokens < r.capacity {
 				r.tokens.Add(tokenFillRate)
 			}
 		}
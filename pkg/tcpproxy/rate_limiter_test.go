@@ -23,3 +23,20 @@ func TestRateLimiter_ConnectionAllowed(t *testing.T) {
 	require.NoError(t, rl.Close())
 	assert.Error(t, rl.Close())
 }
+
+func TestRateLimiter_RefillsEmptyBucket(t *testing.T) {
+	rl := NewRateLimiter(1, 10*time.Millisecond)
+	defer func() { _ = rl.Close() }()
+
+	// Drain the bucket, then it must be refilled rather than stay empty.
+	assert.True(t, rl.ConnectionAllowed())
+	assert.False(t, rl.ConnectionAllowed())
+	assert.Eventually(t, rl.ConnectionAllowed, time.Second, 5*time.Millisecond)
+
+	// The same holds for a bucket restored from a snapshot that saved it empty.
+	restored := NewRateLimiter(1, 10*time.Millisecond)
+	defer func() { _ = restored.Close() }()
+	restored.loadState(limiterState{Tokens: 0}, time.Now())
+	assert.Equal(t, 0, restored.remaining())
+	assert.Eventually(t, restored.ConnectionAllowed, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,254 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisTokenBucketScript atomically refills and consumes a token from a bucket stored as a hash. The server clock
+// is used so that replicas with skewed clocks still agree on refill timing.
+const redisTokenBucketScript = `
+local capacity = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil then
+  tokens = capacity
+  ts = now
+end
+local refill = math.floor((now - ts) / interval)
+if refill > 0 then
+  tokens = math.min(capacity, tokens + refill)
+  ts = ts + refill * interval
+end
+if tokens >= capacity then
+  ts = now
+end
+local allowed = 0
+if tokens > 0 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', ts)
+redis.call('PEXPIRE', KEYS[1], capacity * interval)
+return allowed
+`
+
+// defaultRedisTimeout is used for dialing and each round trip when RedisRateLimitStoreConfig.Timeout is unset.
+const defaultRedisTimeout = 1 * time.Second
+
+// RedisRateLimitStoreConfig is the configuration for connecting a RedisRateLimitStore to a server speaking the
+// Redis protocol.
+type RedisRateLimitStoreConfig struct {
+	// Address is the network address of the server, for example, "redis:6379".
+	Address string
+	// Password is sent with AUTH after connecting, if set.
+	Password string
+	// KeyPrefix is prepended to each client's bucket key. Defaults to "tcpproxy:ratelimit:".
+	KeyPrefix string
+	// Timeout bounds dialing and each command round trip. Defaults to 1 second.
+	Timeout time.Duration
+}
+
+// RedisRateLimitStore is a RateLimitStore that keeps token buckets in a server speaking the Redis protocol, so that
+// many proxy replicas share the same per-client limits.
+type RedisRateLimitStore struct {
+	capacity int
+	fillRate time.Duration
+	config   RedisRateLimitStoreConfig
+
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+}
+
+// NewRedisRateLimitStore returns a RedisRateLimitStore using a token bucket of the given capacity, adding one token
+// every fillRate. The connection is established lazily and re-established after any failure.
+func NewRedisRateLimitStore(conf *RedisRateLimitStoreConfig, capacity int, fillRate time.Duration) (*RedisRateLimitStore, error) {
+	if conf == nil || conf.Address == "" {
+		return nil, errors.New("redis rate limit store requires an Address")
+	}
+	if fillRate < time.Millisecond {
+		return nil, errors.New("redis rate limit store requires a FillRate of at least 1ms")
+	}
+
+	config := *conf
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = "tcpproxy:ratelimit:"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultRedisTimeout
+	}
+
+	return &RedisRateLimitStore{
+		capacity: capacity,
+		fillRate: fillRate,
+		config:   config,
+	}, nil
+}
+
+// ConnectionAllowed atomically consumes a token from the client's shared bucket.
+func (r *RedisRateLimitStore) ConnectionAllowed(client string) (bool, error) {
+	reply, err := r.do(
+		"EVAL",
+		redisTokenBucketScript,
+		"1",
+		r.config.KeyPrefix+client,
+		strconv.Itoa(r.capacity),
+		strconv.FormatInt(r.fillRate.Milliseconds(), 10),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	allowed, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+
+	return allowed == 1, nil
+}
+
+// Close closes the connection to the server, if one is open.
+func (r *RedisRateLimitStore) Close() {
+	r.mutex.Lock()
+	r.disconnect()
+	r.mutex.Unlock()
+}
+
+// do sends a single command and reads its reply, reconnecting first if needed. Any error tears down the connection
+// so the next command starts from a clean state.
+func (r *RedisRateLimitStore) do(args ...string) (any, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.conn == nil {
+		if err := r.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := r.roundTrip(args...)
+	if err != nil {
+		r.disconnect()
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func (r *RedisRateLimitStore) connect() error {
+	conn, err := net.DialTimeout("tcp", r.config.Address, r.config.Timeout)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+
+	if r.config.Password != "" {
+		if _, err = r.roundTrip("AUTH", r.config.Password); err != nil {
+			r.disconnect()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RedisRateLimitStore) disconnect() {
+	if r.conn != nil {
+		_ = r.conn.Close()
+		r.conn = nil
+		r.reader = nil
+	}
+}
+
+func (r *RedisRateLimitStore) roundTrip(args ...string) (any, error) {
+	if err := r.conn.SetDeadline(time.Now().Add(r.config.Timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := r.conn.Write(encodeRESPCommand(args...)); err != nil {
+		return nil, err
+	}
+
+	reply, err := readRESP(r.reader)
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, ok := reply.(error); ok {
+		return nil, replyErr
+	}
+
+	return reply, nil
+}
+
+// encodeRESPCommand encodes a command as a RESP array of bulk strings.
+func encodeRESPCommand(args ...string) []byte {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+
+	return buf
+}
+
+// readRESP reads a single RESP value. Simple and bulk strings are returned as string, integers as int64, arrays as
+// []any, nil bulk strings and arrays as nil, and error replies as an error value.
+func readRESP(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed RESP line %q", line)
+	}
+	prefix, payload := line[0], line[1:len(line)-2]
+
+	switch prefix {
+	case '+':
+		return payload, nil
+	case '-':
+		return errors.New(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		values := make([]any, count)
+		for i := range values {
+			if values[i], err = readRESP(reader); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unknown RESP type %q", prefix)
+	}
+}
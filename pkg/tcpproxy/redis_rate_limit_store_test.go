@@ -0,0 +1,83 @@
+package tcpproxy
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestRedisRateLimitStore_SharedAcrossReplicas(t *testing.T) {
+	server, err := newRedisServer("secret")
+	require.NoError(t, err)
+	defer server.close()
+
+	// Two stores stand in for two proxy replicas sharing one bucket per client.
+	conf := &RedisRateLimitStoreConfig{Address: server.address(), Password: "secret"}
+	replica1, err := NewRedisRateLimitStore(conf, 2, 1*time.Minute)
+	require.NoError(t, err)
+	defer replica1.Close()
+	replica2, err := NewRedisRateLimitStore(conf, 2, 1*time.Minute)
+	require.NoError(t, err)
+	defer replica2.Close()
+
+	for _, store := range []*RedisRateLimitStore{replica1, replica2} {
+		allowed, err := store.ConnectionAllowed("user1")
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	}
+
+	// The shared bucket is now empty for user1, regardless of which replica asks.
+	allowed, err := replica1.ConnectionAllowed("user1")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	// Other clients have their own bucket.
+	allowed, err = replica2.ConnectionAllowed("user2")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+}
+
+func TestRedisRateLimitStore_WrongPassword(t *testing.T) {
+	server, err := newRedisServer("secret")
+	require.NoError(t, err)
+	defer server.close()
+
+	store, err := NewRedisRateLimitStore(&RedisRateLimitStoreConfig{Address: server.address(), Password: "wrong"}, 1, time.Second)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.ConnectionAllowed("user1")
+	assert.Error(t, err)
+}
+
+func TestRedisRateLimitStore_Unreachable(t *testing.T) {
+	server, err := newRedisServer("")
+	require.NoError(t, err)
+	store, err := NewRedisRateLimitStore(
+		&RedisRateLimitStoreConfig{Address: server.address(), Timeout: 100 * time.Millisecond},
+		1,
+		time.Second,
+	)
+	require.NoError(t, err)
+	defer store.Close()
+	require.NoError(t, server.close())
+
+	_, err = store.ConnectionAllowed("user1")
+	assert.Error(t, err)
+
+	// The proxy decides the outcome based on FailOpen.
+	proxy := &Proxy{logger: slog.Default(), rateLimitStore: store, tracer: noop.NewTracerProvider().Tracer("")}
+	assert.False(t, proxy.rateLimitAllowed(context.Background(), "user1"))
+	proxy.rateLimitFailOpen = true
+	assert.True(t, proxy.rateLimitAllowed(context.Background(), "user1"))
+}
+
+func TestNewRedisRateLimitStore_RequiresAddress(t *testing.T) {
+	_, err := NewRedisRateLimitStore(&RedisRateLimitStoreConfig{}, 1, time.Second)
+	assert.Error(t, err)
+}
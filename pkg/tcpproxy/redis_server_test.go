@@ -0,0 +1,131 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisServer is an in-process stand-in for a server speaking the Redis protocol. It understands just enough to
+// back a RedisRateLimitStore: PING, AUTH and EVAL of the token bucket script, which it emulates natively.
+type redisServer struct {
+	password string
+	listener net.Listener
+	buckets  map[string]*redisBucket
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+}
+
+type redisBucket struct {
+	tokens int64
+	ts     time.Time
+}
+
+func newRedisServer(password string) (*redisServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create listener, err: %w", err)
+	}
+
+	r := &redisServer{
+		password: password,
+		listener: listener,
+		buckets:  make(map[string]*redisBucket),
+	}
+	r.wg.Add(1)
+	go r.serve()
+
+	return r, nil
+}
+
+func (r *redisServer) address() string {
+	return r.listener.Addr().String()
+}
+
+func (r *redisServer) close() error {
+	err := r.listener.Close()
+	r.wg.Wait()
+	return err
+}
+
+func (r *redisServer) serve() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handleConnection(conn)
+	}
+}
+
+func (r *redisServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		value, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		args, ok := value.([]any)
+		if !ok || len(args) == 0 {
+			_, _ = conn.Write([]byte("-ERR protocol error\r\n"))
+			return
+		}
+
+		command := strings.ToUpper(args[0].(string))
+		switch {
+		case command == "AUTH":
+			if len(args) == 2 && args[1] == r.password {
+				authenticated = true
+				_, _ = conn.Write([]byte("+OK\r\n"))
+			} else {
+				_, _ = conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+			}
+		case !authenticated:
+			_, _ = conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+		case command == "PING":
+			_, _ = conn.Write([]byte("+PONG\r\n"))
+		case command == "EVAL" && len(args) == 6 && args[1] == redisTokenBucketScript:
+			capacity, _ := strconv.ParseInt(args[4].(string), 10, 64)
+			interval, _ := strconv.ParseInt(args[5].(string), 10, 64)
+			allowed := r.takeToken(args[3].(string), capacity, time.Duration(interval)*time.Millisecond)
+			_, _ = conn.Write([]byte(fmt.Sprintf(":%d\r\n", allowed)))
+		default:
+			_, _ = conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+// takeToken mirrors redisTokenBucketScript.
+func (r *redisServer) takeToken(key string, capacity int64, interval time.Duration) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &redisBucket{tokens: capacity, ts: now}
+		r.buckets[key] = bucket
+	}
+
+	refill := int64(now.Sub(bucket.ts) / interval)
+	if refill > 0 {
+		bucket.tokens = min(capacity, bucket.tokens+refill)
+		bucket.ts = bucket.ts.Add(time.Duration(refill) * interval)
+	}
+	if bucket.tokens >= capacity {
+		bucket.ts = now
+	}
+	if bucket.tokens > 0 {
+		bucket.tokens--
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,156 @@
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rejectionWriteTimeout bounds how long writing a rejection banner may take, so that a client that never reads
+// cannot keep its connection open.
+const rejectionWriteTimeout = 1 * time.Second
+
+// DefaultRejectionBanner is the banner template used when ListenerConfig.RejectionBanner is unset.
+const DefaultRejectionBanner = "ERROR {code} {reason}\n"
+
+// RejectionMode selects what a refused client is told before its connection is closed.
+type RejectionMode string
+
+const (
+	// RejectionModeSilent closes refused connections without explanation. This is the default.
+	RejectionModeSilent RejectionMode = "silent"
+	// RejectionModeTLSAlert fails the TLS handshake with a bad_certificate alert when the certificate identity is
+	// invalid or not in an authorized group. Rate limits are only checked once the client has proven possession of
+	// its key, after the handshake, so rate limited clients are sent the banner instead.
+	RejectionModeTLSAlert RejectionMode = "tls_alert"
+	// RejectionModeBanner completes the TLS handshake and sends a short plaintext banner before closing.
+	RejectionModeBanner RejectionMode = "banner"
+)
+
+// RejectionReason is a stable code identifying why a connection was refused.
+type RejectionReason string
+
+const (
+	// RejectionReasonInvalidIdentity is used when the client certificate CN is not in the format "user@group".
+	RejectionReasonInvalidIdentity RejectionReason = "invalid_identity"
+	// RejectionReasonUnauthorized is used when the client's group is not in the AuthorizedGroups.
+	RejectionReasonUnauthorized RejectionReason = "unauthorized"
+	// RejectionReasonRateLimited is used when the client has exceeded its rate limit.
+	RejectionReasonRateLimited RejectionReason = "rate_limited"
+	// RejectionReasonVetoed is used when the Observer refused the connection in OnAuthorize.
+	RejectionReasonVetoed RejectionReason = "vetoed"
+	// RejectionReasonSourceNotAllowed is used when a passthrough client is not in the route's AllowedSources.
+	RejectionReasonSourceNotAllowed RejectionReason = "source_not_allowed"
+)
+
+// message returns a short human-readable explanation of the RejectionReason.
+func (r RejectionReason) message() string {
+	switch r {
+	case RejectionReasonInvalidIdentity:
+		return "certificate identity is not in the format user@group"
+	case RejectionReasonUnauthorized:
+		return "group is not authorized for this upstream"
+	case RejectionReasonRateLimited:
+		return "rate limit exceeded"
+	case RejectionReasonVetoed:
+		return "connection refused by policy"
+	case RejectionReasonSourceNotAllowed:
+		return "source address is not allowed"
+	default:
+		return "connection refused"
+	}
+}
+
+// identityFromCertificate extracts the user and group stored in a certificate's CN, in the format "user@group".
+func identityFromCertificate(cert *x509.Certificate) (user string, group string, ok bool) {
+	if cert == nil {
+		return "", "", false
+	}
+
+	s := strings.Split(cert.Subject.CommonName, "@")
+	if len(s) != 2 {
+		return "", "", false
+	}
+
+	return s[0], s[1], true
+}
+
+// rejectionError is returned by verifyConnection to fail the handshake, so that the reason can be recovered from
+// the handshake error.
+type rejectionError struct {
+	reason RejectionReason
+	user   string
+	group  string
+}
+
+func (e *rejectionError) Error() string {
+	return e.reason.message()
+}
+
+// verifyConnection is installed as tls.Config.VerifyConnection in RejectionModeTLSAlert, so that clients outside
+// the AuthorizedGroups fail the handshake with an alert instead of being closed silently afterwards.
+func (p *Proxy) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return &rejectionError{reason: RejectionReasonInvalidIdentity}
+	}
+
+	user, group, ok := identityFromCertificate(state.PeerCertificates[0])
+	if !ok {
+		return &rejectionError{reason: RejectionReasonInvalidIdentity}
+	}
+	if !slices.Contains(p.upstreamConfig.AuthorizedGroups, group) {
+		return &rejectionError{reason: RejectionReasonUnauthorized, user: user, group: group}
+	}
+
+	return nil
+}
+
+// reject tells the client why it was refused, according to the listener's RejectionMode, then closes the
+// connection. user is used to look up a retry-after hint for rate limited clients.
+func (p *Proxy) reject(conn net.Conn, reason RejectionReason, user string) {
+	mode := p.listenerConfig.RejectionMode
+	if mode == RejectionModeBanner || (mode == RejectionModeTLSAlert && reason == RejectionReasonRateLimited) {
+		var retryAfter time.Duration
+		if reason == RejectionReasonRateLimited {
+			if store, ok := p.rateLimitStore.(retryAfterStore); ok {
+				retryAfter = store.RetryAfter(user)
+			}
+		}
+
+		banner := p.rejectionBanner(reason, retryAfter)
+		_ = conn.SetWriteDeadline(time.Now().Add(rejectionWriteTimeout))
+		if _, err := conn.Write([]byte(banner)); err != nil {
+			p.logger.Debug("could not send rejection banner", slog.String("error", err.Error()))
+		}
+	}
+
+	_ = conn.Close()
+}
+
+// rejectionBanner renders the banner template. The placeholders {code}, {reason} and {retry_after} are replaced
+// with the RejectionReason, a human-readable message and the retry-after hint in whole seconds. For rate limited
+// clients with a known hint, the message itself also carries the hint.
+func (p *Proxy) rejectionBanner(reason RejectionReason, retryAfter time.Duration) string {
+	template := p.listenerConfig.RejectionBanner
+	if template == "" {
+		template = DefaultRejectionBanner
+	}
+
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	message := reason.message()
+	if seconds > 0 {
+		message += ", retry after " + strconv.FormatInt(seconds, 10) + "s"
+	}
+
+	return strings.NewReplacer(
+		"{code}", string(reason),
+		"{reason}", message,
+		"{retry_after}", strconv.FormatInt(seconds, 10),
+	).Replace(template)
+}
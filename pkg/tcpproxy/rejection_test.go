@@ -0,0 +1,60 @@
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxy_RejectionBanner(t *testing.T) {
+	proxy := &Proxy{listenerConfig: &ListenerConfig{}}
+	assert.Equal(
+		t,
+		"ERROR rate_limited rate limit exceeded, retry after 3s\n",
+		proxy.rejectionBanner(RejectionReasonRateLimited, 2500*time.Millisecond),
+	)
+	assert.Equal(
+		t,
+		"ERROR unauthorized group is not authorized for this upstream\n",
+		proxy.rejectionBanner(RejectionReasonUnauthorized, 0),
+	)
+
+	proxy.listenerConfig.RejectionBanner = "-{code} retry={retry_after}\r\n"
+	assert.Equal(t, "-rate_limited retry=60\r\n", proxy.rejectionBanner(RejectionReasonRateLimited, time.Minute))
+}
+
+func TestProxy_VerifyConnection(t *testing.T) {
+	proxy := &Proxy{upstreamConfig: &UpstreamConfig{AuthorizedGroups: []string{"engineering"}}}
+	state := func(cn string) tls.ConnectionState {
+		return tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}},
+		}
+	}
+
+	assert.NoError(t, proxy.verifyConnection(state("user1@engineering")))
+	assert.Equal(t,
+		&rejectionError{reason: RejectionReasonUnauthorized, user: "user2", group: "administrators"},
+		proxy.verifyConnection(state("user2@administrators")),
+	)
+	assert.Equal(t, &rejectionError{reason: RejectionReasonInvalidIdentity}, proxy.verifyConnection(state("user1")))
+	assert.Equal(t, &rejectionError{reason: RejectionReasonInvalidIdentity}, proxy.verifyConnection(tls.ConnectionState{}))
+}
+
+func TestRateLimitManager_RetryAfter(t *testing.T) {
+	rlm := NewRateLimitManagerFromConfig(&RateLimitConfig{
+		Algorithm: RateLimitAlgorithmGCRA,
+		Capacity:  1,
+		FillRate:  time.Minute,
+	}, slog.Default())
+	defer rlm.Close()
+
+	assert.Zero(t, rlm.RetryAfter("user1"))
+	allowed, _ := rlm.ConnectionAllowed("user1")
+	assert.True(t, allowed)
+	assert.InDelta(t, time.Minute, rlm.RetryAfter("user1"), float64(time.Second))
+}
@@ -0,0 +1,208 @@
+package tcpproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSessionNotFound is returned when terminating a session that is not registered.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionInfo is a point-in-time view of a proxied session.
+type SessionInfo struct {
+	ID            string    `json:"id"`
+	User          string    `json:"user"`
+	Group         string    `json:"group"`
+	ClientAddress string    `json:"client_address"`
+	Upstream      string    `json:"upstream"`
+	StartTime     time.Time `json:"start_time"`
+	// BytesIn is the count of bytes copied from the client to the upstream.
+	BytesIn int64 `json:"bytes_in"`
+	// BytesOut is the count of bytes copied from the upstream to the client.
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// session is a live proxied connection, tracked so it can be listed and terminated.
+type session struct {
+	id            string
+	user          string
+	group         string
+	clientAddress string
+	upstream      string
+	startTime     time.Time
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	// closeReason and closeErr record why the session ended, set once by whichever side finishes first.
+	closeOnce   sync.Once
+	closeReason CloseReason
+	closeErr    error
+
+	clientConn net.Conn
+	targetConn net.Conn
+}
+
+func newSession(
+	id string, user string, group string, clientConn net.Conn, targetConn net.Conn, upstream string,
+) *session {
+	return &session{
+		id:            id,
+		user:          user,
+		group:         group,
+		clientAddress: clientConn.RemoteAddr().String(),
+		upstream:      upstream,
+		startTime:     time.Now(),
+		clientConn:    clientConn,
+		targetConn:    targetConn,
+	}
+}
+
+// info returns a SessionInfo snapshot of the session.
+func (s *session) info() SessionInfo {
+	return SessionInfo{
+		ID:            s.id,
+		User:          s.user,
+		Group:         s.group,
+		ClientAddress: s.clientAddress,
+		Upstream:      s.upstream,
+		StartTime:     s.startTime,
+		BytesIn:       s.bytesIn.Load(),
+		BytesOut:      s.bytesOut.Load(),
+	}
+}
+
+// finish records why the session is ending. Only the first call has any effect.
+func (s *session) finish(reason CloseReason, err error) {
+	s.closeOnce.Do(func() {
+		s.closeReason, s.closeErr = reason, err
+	})
+}
+
+// terminate closes both legs of the session, causing its data transfer to end.
+func (s *session) terminate() {
+	s.finish(CloseReasonTerminated, nil)
+	_ = s.clientConn.Close()
+	_ = s.targetConn.Close()
+}
+
+// sessionRegistry tracks all live sessions of a Proxy.
+type sessionRegistry struct {
+	sessions map[string]*session
+	mutex    sync.RWMutex
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*session)}
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mutex.Lock()
+	r.sessions[s.id] = s
+	r.mutex.Unlock()
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mutex.Lock()
+	delete(r.sessions, s.id)
+	r.mutex.Unlock()
+}
+
+// count returns the number of live sessions.
+func (r *sessionRegistry) count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.sessions)
+}
+
+// list returns all sessions matching the filters, oldest first. Empty filters match everything.
+func (r *sessionRegistry) list(user string, upstream string) []SessionInfo {
+	r.mutex.RLock()
+	infos := make([]SessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		if (user == "" || s.user == user) && (upstream == "" || s.upstream == upstream) {
+			infos = append(infos, s.info())
+		}
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.Before(infos[j].StartTime)
+	})
+
+	return infos
+}
+
+// terminate closes the session with the given ID.
+func (r *sessionRegistry) terminate(id string) error {
+	r.mutex.RLock()
+	s, ok := r.sessions[id]
+	r.mutex.RUnlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	s.terminate()
+
+	return nil
+}
+
+// terminateUser closes all sessions of a user, returning how many were terminated.
+func (r *sessionRegistry) terminateUser(user string) int {
+	var matched []*session
+	r.mutex.RLock()
+	for _, s := range r.sessions {
+		if s.user == user {
+			matched = append(matched, s)
+		}
+	}
+	r.mutex.RUnlock()
+
+	for _, s := range matched {
+		s.terminate()
+	}
+
+	return len(matched)
+}
+
+// countingWriter counts bytes successfully written to the underlying io.Writer.
+type countingWriter struct {
+	writer  io.Writer
+	counter *atomic.Int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.writer.Write(b)
+	c.counter.Add(int64(n))
+
+	return n, err
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Sessions returns all live sessions, optionally filtered by user and upstream address.
+func (p *Proxy) Sessions(user string, upstream string) []SessionInfo {
+	return p.sessions.list(user, upstream)
+}
+
+// TerminateSession closes a live session by ID. ErrSessionNotFound is returned if no such session exists.
+func (p *Proxy) TerminateSession(id string) error {
+	return p.sessions.terminate(id)
+}
+
+// TerminateUserSessions closes all live sessions of a user, returning how many were terminated.
+func (p *Proxy) TerminateUserSessions(user string) int {
+	return p.sessions.terminateUser(user)
+}
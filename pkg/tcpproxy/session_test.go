@@ -0,0 +1,53 @@
+package tcpproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionRegistry_ListAndTerminate(t *testing.T) {
+	registry := newSessionRegistry()
+
+	user1Client, user1Peer := net.Pipe()
+	user1Target, _ := net.Pipe()
+	user1 := newSession(newSessionID(), "user1", "engineering", user1Client, user1Target, "10.0.0.1:80")
+	registry.add(user1)
+
+	user2Client, _ := net.Pipe()
+	user2Target, _ := net.Pipe()
+	user2 := newSession(newSessionID(), "user2", "engineering", user2Client, user2Target, "10.0.0.2:80")
+	registry.add(user2)
+
+	assert.Len(t, registry.list("", ""), 2)
+	require.Len(t, registry.list("user1", ""), 1)
+	assert.Equal(t, user1.id, registry.list("user1", "")[0].ID)
+	assert.Len(t, registry.list("", "10.0.0.2:80"), 1)
+	assert.Empty(t, registry.list("user1", "10.0.0.2:80"))
+
+	// Terminating closes both legs of the session.
+	require.NoError(t, registry.terminate(user1.id))
+	_, err := user1Peer.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.ErrorIs(t, registry.terminate("missing"), ErrSessionNotFound)
+
+	assert.Equal(t, 1, registry.terminateUser("user2"))
+	assert.Equal(t, 0, registry.terminateUser("user3"))
+
+	registry.remove(user1)
+	registry.remove(user2)
+	assert.Empty(t, registry.list("", ""))
+}
+
+func TestCountingWriter(t *testing.T) {
+	clientConn, targetConn := net.Pipe()
+	session := newSession(newSessionID(), "user1", "engineering", clientConn, targetConn, "10.0.0.1:80")
+	writer := &countingWriter{writer: io.Discard, counter: &session.bytesIn}
+
+	_, err := writer.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), session.info().BytesIn)
+}
@@ -0,0 +1,174 @@
+package tcpproxy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// SlidingWindowLogLimiter allows at most capacity connections in any rolling window, for example "100 connections
+// per rolling minute". It keeps the timestamp of each allowed connection within the window, so it is exact but uses
+// memory proportional to capacity.
+type SlidingWindowLogLimiter struct {
+	capacity int
+	window   time.Duration
+	now      func() time.Time
+
+	log   []time.Time
+	mutex sync.Mutex
+}
+
+// NewSlidingWindowLogLimiter returns a SlidingWindowLogLimiter allowing capacity connections per rolling window.
+func NewSlidingWindowLogLimiter(capacity int, window time.Duration) *SlidingWindowLogLimiter {
+	return newSlidingWindowLogLimiter(capacity, window, time.Now)
+}
+
+func newSlidingWindowLogLimiter(capacity int, window time.Duration, now func() time.Time) *SlidingWindowLogLimiter {
+	return &SlidingWindowLogLimiter{
+		capacity: capacity,
+		window:   window,
+		now:      now,
+		log:      make([]time.Time, 0, capacity),
+	}
+}
+
+// ConnectionAllowed returns true and records the connection if fewer than capacity connections were allowed in
+// the last window.
+func (s *SlidingWindowLogLimiter) ConnectionAllowed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	cutoff := now.Add(-s.window)
+	expired := 0
+	for expired < len(s.log) && !s.log[expired].After(cutoff) {
+		expired++
+	}
+	s.log = append(s.log[:0], s.log[expired:]...)
+
+	if len(s.log) >= s.capacity {
+		return false
+	}
+	s.log = append(s.log, now)
+
+	return true
+}
+
+// remaining returns how many more connections the current rolling window allows.
+func (s *SlidingWindowLogLimiter) remaining() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cutoff := s.now().Add(-s.window)
+	active := 0
+	for _, t := range s.log {
+		if t.After(cutoff) {
+			active++
+		}
+	}
+
+	return max(0, s.capacity-active)
+}
+
+// retryAfter returns how long until the oldest connection in a full window expires.
+func (s *SlidingWindowLogLimiter) retryAfter() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.log) < s.capacity {
+		return 0
+	}
+
+	return max(0, s.log[0].Add(s.window).Sub(s.now()))
+}
+
+// Close is a no-op, as a SlidingWindowLogLimiter holds no background resources.
+func (s *SlidingWindowLogLimiter) Close() error {
+	return nil
+}
+
+// SlidingWindowCounterLimiter approximates a rolling window using counters for the current and previous fixed
+// windows, weighting the previous count by how much of it still overlaps the rolling window. It uses constant
+// memory per client.
+type SlidingWindowCounterLimiter struct {
+	capacity int
+	window   time.Duration
+	now      func() time.Time
+
+	currentStart  time.Time
+	currentCount  int
+	previousCount int
+	mutex         sync.Mutex
+}
+
+// NewSlidingWindowCounterLimiter returns a SlidingWindowCounterLimiter allowing approximately capacity connections
+// per rolling window.
+func NewSlidingWindowCounterLimiter(capacity int, window time.Duration) *SlidingWindowCounterLimiter {
+	return newSlidingWindowCounterLimiter(capacity, window, time.Now)
+}
+
+func newSlidingWindowCounterLimiter(capacity int, window time.Duration, now func() time.Time) *SlidingWindowCounterLimiter {
+	return &SlidingWindowCounterLimiter{
+		capacity:     capacity,
+		window:       window,
+		now:          now,
+		currentStart: now(),
+	}
+}
+
+// ConnectionAllowed returns true and records the connection if the weighted count of connections in the rolling
+// window is below capacity.
+func (s *SlidingWindowCounterLimiter) ConnectionAllowed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	if elapsed := now.Sub(s.currentStart); elapsed >= s.window {
+		windows := elapsed / s.window
+		if windows == 1 {
+			s.previousCount = s.currentCount
+		} else {
+			s.previousCount = 0
+		}
+		s.currentCount = 0
+		s.currentStart = s.currentStart.Add(windows * s.window)
+	}
+
+	overlap := float64(s.window-now.Sub(s.currentStart)) / float64(s.window)
+	if float64(s.previousCount)*overlap+float64(s.currentCount) >= float64(s.capacity) {
+		return false
+	}
+	s.currentCount++
+
+	return true
+}
+
+// remaining returns how many more connections the weighted rolling window allows, ignoring any window rollover
+// that a new connection would trigger.
+func (s *SlidingWindowCounterLimiter) remaining() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	overlap := max(0, float64(s.window-s.now().Sub(s.currentStart))/float64(s.window))
+	used := float64(s.previousCount)*overlap + float64(s.currentCount)
+
+	return max(0, s.capacity-int(math.Ceil(used)))
+}
+
+// retryAfter returns how long until the current window ends when the limit has been reached. Connections may be
+// allowed sooner, as the previous window's weight decays.
+func (s *SlidingWindowCounterLimiter) retryAfter() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.currentCount < s.capacity && s.previousCount == 0 {
+		return 0
+	}
+
+	return max(0, s.currentStart.Add(s.window).Sub(s.now()))
+}
+
+// Close is a no-op, as a SlidingWindowCounterLimiter holds no background resources.
+func (s *SlidingWindowCounterLimiter) Close() error {
+	return nil
+}
@@ -0,0 +1,56 @@
+package tcpproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlidingWindowLogLimiter_ConnectionAllowed(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newSlidingWindowLogLimiter(3, time.Minute, clock.Now)
+
+	assert.True(t, limiter.ConnectionAllowed())
+	clock.Advance(20 * time.Second)
+	assert.True(t, limiter.ConnectionAllowed())
+	assert.True(t, limiter.ConnectionAllowed())
+	assert.False(t, limiter.ConnectionAllowed())
+
+	// The first connection leaves the rolling window after one minute, freeing exactly one slot.
+	clock.Advance(40 * time.Second)
+	assert.True(t, limiter.ConnectionAllowed())
+	assert.False(t, limiter.ConnectionAllowed())
+
+	// Once the whole window has passed, the full capacity is available again.
+	clock.Advance(time.Minute)
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.ConnectionAllowed())
+	}
+	assert.False(t, limiter.ConnectionAllowed())
+	assert.NoError(t, limiter.Close())
+}
+
+func TestSlidingWindowCounterLimiter_ConnectionAllowed(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newSlidingWindowCounterLimiter(4, time.Minute, clock.Now)
+
+	for i := 0; i < 4; i++ {
+		assert.True(t, limiter.ConnectionAllowed())
+	}
+	assert.False(t, limiter.ConnectionAllowed())
+
+	// Halfway into the next window, half of the previous window's count still applies.
+	clock.Advance(90 * time.Second)
+	assert.True(t, limiter.ConnectionAllowed())
+	assert.True(t, limiter.ConnectionAllowed())
+	assert.False(t, limiter.ConnectionAllowed())
+
+	// Skipping more than a full window forgets all previous connections.
+	clock.Advance(3 * time.Minute)
+	for i := 0; i < 4; i++ {
+		assert.True(t, limiter.ConnectionAllowed())
+	}
+	assert.False(t, limiter.ConnectionAllowed())
+	assert.NoError(t, limiter.Close())
+}
@@ -0,0 +1,173 @@
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultKeepAliveIdle, defaultKeepAliveInterval and defaultKeepAliveCount match Go's own keepalive settings,
+	// and are used for any keepalive option left unset when another is set.
+	defaultKeepAliveIdle     = 15 * time.Second
+	defaultKeepAliveInterval = 15 * time.Second
+	defaultKeepAliveCount    = 9
+	// maxDSCP is the largest Differentiated Services code point, which is 6 bits.
+	maxDSCP = 63
+)
+
+// SocketOptions are TCP socket options for accepted or dialed connections. Unset options keep Go's and the kernel's
+// defaults. Options other than NoDelay are only supported on Linux.
+//
+// Options are applied when sockets are created, and accepted connections inherit those of the listening socket.
+// Options the kernel rejects are reported when the proxy starts.
+type SocketOptions struct {
+	// KeepAliveIdle is how long a connection is idle before keepalive probes are sent (TCP_KEEPIDLE).
+	KeepAliveIdle time.Duration
+	// KeepAliveInterval is how long to wait between unanswered keepalive probes (TCP_KEEPINTVL).
+	KeepAliveInterval time.Duration
+	// KeepAliveCount is how many unanswered keepalive probes are sent before the connection is closed
+	// (TCP_KEEPCNT). If any keepalive option is set, the others default to 15 seconds, 15 seconds and 9 probes.
+	KeepAliveCount int
+
+	// NoDelay sets TCP_NODELAY, sending small writes without waiting to coalesce them. Go enables it by default.
+	NoDelay *bool
+
+	// ReceiveBufferSize and SendBufferSize are the sizes of the kernel's socket buffers in bytes (SO_RCVBUF and
+	// SO_SNDBUF).
+	ReceiveBufferSize int
+	SendBufferSize    int
+
+	// UserTimeout is how long sent data may remain unacknowledged before the connection is closed
+	// (TCP_USER_TIMEOUT).
+	UserTimeout time.Duration
+
+	// DSCP is the Differentiated Services code point marking outgoing packets, from 0 to 63, for example 46 for
+	// expedited forwarding (IP_TOS or IPV6_TCLASS).
+	DSCP int
+
+	// Mark is the firewall mark of outgoing packets, for policy routing (SO_MARK). It requires CAP_NET_ADMIN.
+	Mark int
+}
+
+func (o *SocketOptions) validate() error {
+	for _, d := range []time.Duration{o.KeepAliveIdle, o.KeepAliveInterval} {
+		if d < 0 || (d > 0 && d < time.Second) {
+			return errors.New("socket keepalive durations must be at least 1 second")
+		}
+	}
+	if o.KeepAliveCount < 0 {
+		return errors.New("socket KeepAliveCount cannot be negative")
+	}
+	if o.ReceiveBufferSize < 0 || o.SendBufferSize < 0 {
+		return errors.New("socket buffer sizes cannot be negative")
+	}
+	if o.UserTimeout < 0 || (o.UserTimeout > 0 && o.UserTimeout < time.Millisecond) {
+		return errors.New("socket UserTimeout must be at least 1 millisecond")
+	}
+	if o.DSCP < 0 || o.DSCP > maxDSCP {
+		return errors.New("socket DSCP must be between 0 and 63")
+	}
+	if o.Mark < 0 {
+		return errors.New("socket Mark cannot be negative")
+	}
+
+	return nil
+}
+
+// keepAliveSet reports whether any keepalive option is set, in which case keepalive is configured by the options
+// instead of by Go.
+func (o *SocketOptions) keepAliveSet() bool {
+	return o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0
+}
+
+// keepAlive returns the keepalive idle time, interval and count, with defaults for those left unset.
+func (o *SocketOptions) keepAlive() (time.Duration, time.Duration, int) {
+	idle, interval, count := o.KeepAliveIdle, o.KeepAliveInterval, o.KeepAliveCount
+	if idle == 0 {
+		idle = defaultKeepAliveIdle
+	}
+	if interval == 0 {
+		interval = defaultKeepAliveInterval
+	}
+	if count == 0 {
+		count = defaultKeepAliveCount
+	}
+
+	return idle, interval, count
+}
+
+// goKeepAlive returns the keepalive period for Go to configure, which is negative to leave the socket alone when
+// the options configure keepalive themselves.
+func (o *SocketOptions) goKeepAlive() time.Duration {
+	if o.keepAliveSet() {
+		return -1
+	}
+
+	return 0
+}
+
+// control applies the options to a socket before it is bound or connected. Sockets other than TCP, such as Unix
+// sockets, are left alone.
+func (o *SocketOptions) control(network string, _ string, c syscall.RawConn) error {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = o.setSockopts(fd, network)
+	}); controlErr != nil {
+		return controlErr
+	}
+
+	return err
+}
+
+// listenConfig returns a net.ListenConfig applying the options, which may be nil, to the listening socket.
+func (o *SocketOptions) listenConfig() *net.ListenConfig {
+	if o == nil {
+		return &net.ListenConfig{}
+	}
+
+	return &net.ListenConfig{Control: o.control, KeepAlive: o.goKeepAlive()}
+}
+
+// dialer returns a net.Dialer with the given timeout, applying the options, which may be nil, to dialed sockets.
+func (o *SocketOptions) dialer(timeout time.Duration) *net.Dialer {
+	if o == nil {
+		return &net.Dialer{Timeout: timeout}
+	}
+
+	return &net.Dialer{Timeout: timeout, Control: o.control, KeepAlive: o.goKeepAlive()}
+}
+
+// configure applies the options Go overrides once a connection is established, which is only NoDelay.
+func (o *SocketOptions) configure(conn net.Conn) error {
+	if o == nil || o.NoDelay == nil {
+		return nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	return tcpConn.SetNoDelay(*o.NoDelay)
+}
+
+// probe creates a socket with the options applied, so that options the kernel rejects are reported before any
+// connection is dialed with them.
+func (o *SocketOptions) probe() error {
+	if o == nil {
+		return nil
+	}
+	listener, err := o.listenConfig().Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	return listener.Close()
+}
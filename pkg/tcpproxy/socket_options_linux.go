@@ -0,0 +1,53 @@
+//go:build linux
+
+package tcpproxy
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT, which the syscall package does not define on every architecture.
+const tcpUserTimeout = 0x12
+
+// setSockopts sets the options on the socket fd, returning an error naming every option the kernel rejected.
+func (o *SocketOptions) setSockopts(fd uintptr, network string) error {
+	var errs []error
+	set := func(name string, level int, option int, value int) {
+		if err := syscall.SetsockoptInt(int(fd), level, option, value); err != nil {
+			errs = append(errs, fmt.Errorf("setting %s to %d: %w", name, value, err))
+		}
+	}
+
+	if o.keepAliveSet() {
+		idle, interval, count := o.keepAlive()
+		set("SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+		set("TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, int(idle/time.Second))
+		set("TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, int(interval/time.Second))
+		set("TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+	}
+	if o.ReceiveBufferSize > 0 {
+		set("SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.ReceiveBufferSize)
+	}
+	if o.SendBufferSize > 0 {
+		set("SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBufferSize)
+	}
+	if o.UserTimeout > 0 {
+		set("TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, tcpUserTimeout, int(o.UserTimeout/time.Millisecond))
+	}
+	if o.DSCP > 0 {
+		// The code point is the upper 6 bits of the traffic class.
+		if network == "tcp6" {
+			set("IPV6_TCLASS", syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, o.DSCP<<2)
+		} else {
+			set("IP_TOS", syscall.IPPROTO_IP, syscall.IP_TOS, o.DSCP<<2)
+		}
+	}
+	if o.Mark > 0 {
+		set("SO_MARK", syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark)
+	}
+
+	return errors.Join(errs...)
+}
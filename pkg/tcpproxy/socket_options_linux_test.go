@@ -0,0 +1,75 @@
+package tcpproxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getSockopt reads an integer socket option from conn.
+func getSockopt(t *testing.T, conn net.Conn, level int, option int) int {
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var value int
+	var sockoptErr error
+	require.NoError(t, rawConn.Control(func(fd uintptr) {
+		value, sockoptErr = syscall.GetsockoptInt(int(fd), level, option)
+	}))
+	require.NoError(t, sockoptErr)
+
+	return value
+}
+
+func TestSocketOptions_Applied(t *testing.T) {
+	options := &SocketOptions{
+		KeepAliveIdle:     30 * time.Second,
+		KeepAliveInterval: 5 * time.Second,
+		KeepAliveCount:    3,
+		UserTimeout:       10 * time.Second,
+		DSCP:              46,
+	}
+	// Setting a mark requires CAP_NET_ADMIN.
+	if os.Geteuid() == 0 {
+		options.Mark = 7
+	}
+	listener, err := options.listenConfig().Listen(context.Background(), "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	dialed, err := options.dialer(time.Second).Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = dialed.Close() }()
+	accepted, err := listener.Accept()
+	require.NoError(t, err)
+	defer func() { _ = accepted.Close() }()
+
+	// Accepted connections inherit the options of the listening socket.
+	for _, conn := range []net.Conn{dialed, accepted} {
+		assert.Equal(t, 1, getSockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+		assert.Equal(t, 30, getSockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+		assert.Equal(t, 5, getSockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL))
+		assert.Equal(t, 3, getSockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT))
+		assert.Equal(t, 10000, getSockopt(t, conn, syscall.IPPROTO_TCP, tcpUserTimeout))
+		assert.Equal(t, 46<<2, getSockopt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS))
+		assert.Equal(t, options.Mark, getSockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_MARK))
+	}
+}
+
+func Test_ProxyReportsRejectedSocketOptions(t *testing.T) {
+	// The kernel allows at most 127 keepalive probes.
+	config := testProxyConfig(t, "localhost:0", "engineering")
+	config.UpstreamConfig.SocketOptions = &SocketOptions{KeepAliveCount: 200}
+	_, err := New(config)
+	assert.ErrorContains(t, err, "setting TCP_KEEPCNT to 200")
+
+	config = testProxyConfig(t, "localhost:0", "engineering")
+	config.ListenerConfig.SocketOptions = &SocketOptions{KeepAliveIdle: 24 * time.Hour}
+	_, err = New(config)
+	assert.ErrorContains(t, err, "setting TCP_KEEPIDLE to 86400")
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package tcpproxy
+
+import "errors"
+
+// setSockopts is unsupported, so only NoDelay, which is set through the net package, can be used.
+func (o *SocketOptions) setSockopts(uintptr, string) error {
+	if *o == (SocketOptions{NoDelay: o.NoDelay}) {
+		return nil
+	}
+
+	return errors.New("socket options other than NoDelay are not supported on this platform")
+}
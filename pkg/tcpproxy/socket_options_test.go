@@ -0,0 +1,77 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketOptions_Validate(t *testing.T) {
+	valid := SocketOptions{
+		KeepAliveIdle:     30 * time.Second,
+		KeepAliveInterval: 5 * time.Second,
+		KeepAliveCount:    3,
+		ReceiveBufferSize: 1 << 20,
+		SendBufferSize:    1 << 20,
+		UserTimeout:       10 * time.Second,
+		DSCP:              46,
+		Mark:              7,
+	}
+	assert.NoError(t, valid.validate())
+	assert.NoError(t, (&SocketOptions{}).validate())
+
+	tests := map[string]func(options *SocketOptions){
+		"sub-second keepalive": func(options *SocketOptions) { options.KeepAliveIdle = 500 * time.Millisecond },
+		"negative interval":    func(options *SocketOptions) { options.KeepAliveInterval = -time.Second },
+		"negative count":       func(options *SocketOptions) { options.KeepAliveCount = -1 },
+		"negative buffer":      func(options *SocketOptions) { options.SendBufferSize = -1 },
+		"sub-ms user timeout":  func(options *SocketOptions) { options.UserTimeout = time.Microsecond },
+		"DSCP out of range":    func(options *SocketOptions) { options.DSCP = 64 },
+		"negative mark":        func(options *SocketOptions) { options.Mark = -1 },
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			options := valid
+			modify(&options)
+			assert.Error(t, options.validate())
+		})
+	}
+}
+
+func TestSocketOptions_KeepAlive(t *testing.T) {
+	// Go configures keepalive unless an option is set, in which case unset options take Go's defaults.
+	var options SocketOptions
+	assert.Equal(t, time.Duration(0), options.goKeepAlive())
+
+	options.KeepAliveCount = 3
+	assert.Equal(t, time.Duration(-1), options.goKeepAlive())
+	idle, interval, count := options.keepAlive()
+	assert.Equal(t, defaultKeepAliveIdle, idle)
+	assert.Equal(t, defaultKeepAliveInterval, interval)
+	assert.Equal(t, 3, count)
+}
+
+func Test_ProxyAppliesSocketOptions(t *testing.T) {
+	echoSrv := setupEchoServer(t)
+	noDelay := false
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.ListenerConfig.SocketOptions = &SocketOptions{NoDelay: &noDelay}
+	config.UpstreamConfig.SocketOptions = &SocketOptions{NoDelay: &noDelay}
+	proxy := startTestProxy(t, config)
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello world\n", string(line))
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
@@ -0,0 +1,107 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProxyStatus is a point-in-time view of a running Proxy.
+type ProxyStatus struct {
+	Address   string           `json:"address"`
+	Serving   bool             `json:"serving"`
+	Ready     bool             `json:"ready"`
+	StartTime time.Time        `json:"start_time"`
+	Sessions  int              `json:"sessions"`
+	Upstreams []UpstreamStatus `json:"upstreams"`
+}
+
+// UpstreamStatus is a point-in-time view of a single Upstream.
+type UpstreamStatus struct {
+	// Route is the name of the passthrough route the upstream belongs to, or empty for the UpstreamConfig targets.
+	Route       string `json:"route,omitempty"`
+	Address     string `json:"address"`
+	Connections int    `json:"connections"`
+	Weight      int    `json:"weight"`
+	Draining    bool   `json:"draining"`
+	// IdleConnections is the number of pre-warmed connections open to the upstream.
+	IdleConnections int `json:"idle_connections"`
+}
+
+// EffectiveConfig is the configuration a Proxy is running with, in a form suitable for display.
+type EffectiveConfig struct {
+	ListenerConfig        *ListenerConfig        `json:"listener"`
+	UpstreamConfig        *UpstreamConfig        `json:"upstream"`
+	RateLimitConfig       *RateLimitConfig       `json:"rate_limit"`
+	RateLimitStore        string                 `json:"rate_limit_store"`
+	ConnectionLimitConfig *ConnectionLimitConfig `json:"connection_limit,omitempty"`
+	AdminConfig           *AdminConfig           `json:"admin,omitempty"`
+	AccessLogConfig       *AccessLogConfig       `json:"access_log,omitempty"`
+	AuditLogConfig        *AuditLogConfig        `json:"audit_log,omitempty"`
+	TracingConfig         *TracingConfig         `json:"tracing,omitempty"`
+	HooksConfig           *HooksConfig           `json:"hooks,omitempty"`
+	HealthConfig          *HealthConfig          `json:"health,omitempty"`
+	CaptureConfig         *CaptureConfig         `json:"capture,omitempty"`
+	PassthroughConfig     *PassthroughConfig     `json:"passthrough,omitempty"`
+	UDPConfig             *UDPConfig             `json:"udp,omitempty"`
+}
+
+// Status returns the current state of the Proxy and its upstreams.
+func (p *Proxy) Status() ProxyStatus {
+	return ProxyStatus{
+		Address:   p.Address(),
+		Serving:   p.serving.Load(),
+		Ready:     p.Readiness().Ready,
+		StartTime: p.startTime,
+		Sessions:  p.sessions.count(),
+		Upstreams: p.Upstreams(),
+	}
+}
+
+// Upstreams returns the current state of each upstream in the LoadBalancer, followed by those of each passthrough
+// route.
+func (p *Proxy) Upstreams() []UpstreamStatus {
+	upstreams := upstreamStatuses("", p.pool)
+	for _, route := range p.passthrough {
+		upstreams = append(upstreams, upstreamStatuses(route.name, route.pool)...)
+	}
+
+	return upstreams
+}
+
+// upstreamStatuses returns the current state of each upstream in pool, labelled with route.
+func upstreamStatuses(route string, pool *upstreamPool) []UpstreamStatus {
+	var upstreams []UpstreamStatus
+	for _, upstream := range pool.loadBalancer.FetchUpstreams() {
+		upstreams = append(upstreams, UpstreamStatus{
+			Route:       route,
+			Address:     upstream.Address,
+			Connections: upstream.Connections(),
+			Weight:      upstream.Weight(),
+			Draining:    upstream.Draining(),
+
+			IdleConnections: pool.prewarm.idle(upstream.Address),
+		})
+	}
+
+	return upstreams
+}
+
+// EffectiveConfig returns the configuration the Proxy is running with.
+func (p *Proxy) EffectiveConfig() EffectiveConfig {
+	return EffectiveConfig{
+		ListenerConfig:        p.config.ListenerConfig,
+		UpstreamConfig:        p.config.UpstreamConfig,
+		RateLimitConfig:       p.config.RateLimitConfig,
+		RateLimitStore:        fmt.Sprintf("%T", p.rateLimitStore),
+		ConnectionLimitConfig: p.config.ConnectionLimitConfig,
+		AdminConfig:           p.config.AdminConfig,
+		AccessLogConfig:       p.config.AccessLogConfig,
+		AuditLogConfig:        p.config.AuditLogConfig,
+		TracingConfig:         p.config.TracingConfig,
+		HooksConfig:           p.config.HooksConfig,
+		HealthConfig:          p.config.HealthConfig,
+		CaptureConfig:         p.config.CaptureConfig,
+		PassthroughConfig:     p.config.PassthroughConfig,
+		UDPConfig:             p.config.UDPConfig,
+	}
+}
@@ -0,0 +1,157 @@
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	// tracerName is the instrumentation scope spans are reported under.
+	tracerName = "github.com/joshbranham/tcp-proxy/pkg/tcpproxy"
+	// defaultTracingServiceName is the service.name spans are exported with.
+	defaultTracingServiceName = "tcp-proxy"
+	// tracingShutdownTimeout bounds how long Close waits for buffered spans to be exported.
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+// Span attribute keys set by the proxy, in addition to the OpenTelemetry semantic conventions.
+const (
+	attributeGroup            = attribute.Key("tcpproxy.group")
+	attributeSessionID        = attribute.Key("tcpproxy.session_id")
+	attributeRejectionReason  = attribute.Key("tcpproxy.rejection_reason")
+	attributeCloseReason      = attribute.Key("tcpproxy.close_reason")
+	attributeBytesIn          = attribute.Key("tcpproxy.bytes_in")
+	attributeBytesOut         = attribute.Key("tcpproxy.bytes_out")
+	attributeRateLimited      = attribute.Key("tcpproxy.rate_limited")
+	attributePassthroughRoute = attribute.Key("tcpproxy.passthrough_route")
+)
+
+// TracingConfig is the configuration for exporting OpenTelemetry traces of each connection, with spans for the
+// TLS handshake, authorization, rate limit check, upstream selection, dial and data transfer.
+type TracingConfig struct {
+	// Endpoint is the host:port of an OTLP/HTTP collector, for example "localhost:4318".
+	Endpoint string
+	// URLPath overrides the path traces are sent to. Defaults to "/v1/traces".
+	URLPath string
+	// Insecure sends traces over plain HTTP instead of HTTPS.
+	Insecure bool
+	// ServiceName is reported as the service.name resource attribute. Defaults to "tcp-proxy".
+	ServiceName string
+	// SampleRatio is the fraction of connections traced, between 0 and 1, where 0 traces none. Defaults to 1,
+	// tracing every connection, when nil.
+	SampleRatio *float64
+
+	// TracerProvider optionally overrides the exporter configured above, for example to share a provider with the
+	// rest of an application. The Proxy does not shut it down.
+	TracerProvider trace.TracerProvider `json:"-"`
+}
+
+func (c *TracingConfig) validate() error {
+	if c.TracerProvider != nil {
+		return nil
+	}
+	if c.Endpoint == "" {
+		return errors.New("tracing config does not contain an Endpoint")
+	}
+	if c.SampleRatio != nil && (*c.SampleRatio < 0 || *c.SampleRatio > 1) {
+		return errors.New("tracing SampleRatio must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// newTracerProvider constructs a TracerProvider exporting to the configured collector, along with a function
+// flushing and stopping it.
+func newTracerProvider(conf *TracingConfig) (trace.TracerProvider, func(context.Context) error, error) {
+	if conf == nil {
+		return noop.NewTracerProvider(), nil, nil
+	}
+	if conf.TracerProvider != nil {
+		return conf.TracerProvider, nil, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.Endpoint)}
+	if conf.URLPath != "" {
+		options = append(options, otlptracehttp.WithURLPath(conf.URLPath))
+	}
+	if conf.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	// The exporter connects lazily, so creating it does not fail if the collector is unavailable.
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serviceName, ratio := conf.ServiceName, 1.0
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	if conf.SampleRatio != nil {
+		ratio = *conf.SampleRatio
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+
+	return provider, provider.Shutdown, nil
+}
+
+// shutdownTracing flushes any buffered spans, if the Proxy owns its TracerProvider.
+func (p *Proxy) shutdownTracing() {
+	if p.tracingShutdown == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := p.tracingShutdown(ctx); err != nil {
+		p.logger.Error("shutting down tracing", slog.String("error", err.Error()))
+	}
+}
+
+// endSpan ends a span, marking it failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceHandler is a slog.Handler adding the trace and span IDs of the span in a record's context, so that logs
+// can be correlated with traces.
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, record slog.Record) error {
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", spanContext.TraceID().String()),
+			slog.String("span_id", spanContext.SpanID().String()),
+		)
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,182 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// traceCollector is an in-process OTLP/HTTP collector, keeping every span it receives.
+type traceCollector struct {
+	server *httptest.Server
+	spans  []*tracepb.Span
+	mutex  sync.Mutex
+}
+
+func newTraceCollector(t *testing.T) *traceCollector {
+	c := &traceCollector{}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		request := &collectortrace.ExportTraceServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, request))
+
+		c.mutex.Lock()
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				c.spans = append(c.spans, scopeSpans.Spans...)
+			}
+		}
+		c.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		response, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+		_, _ = w.Write(response)
+	}))
+
+	return c
+}
+
+// span returns the received span with the given name, or nil.
+func (c *traceCollector) span(name string) *tracepb.Span {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, span := range c.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+
+	return nil
+}
+
+// spanAttribute returns the value of a span attribute, or nil.
+func spanAttribute(span *tracepb.Span, key string) *commonpb.AnyValue {
+	for _, attribute := range span.Attributes {
+		if attribute.Key == key {
+			return attribute.Value
+		}
+	}
+
+	return nil
+}
+
+func Test_ProxyExportsTraces(t *testing.T) {
+	collector := newTraceCollector(t)
+	defer collector.server.Close()
+
+	echoSrv := setupEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	sink := newRecordingSink()
+	config.AccessLogConfig = &AccessLogConfig{Sink: sink}
+	config.TracingConfig = &TracingConfig{
+		Endpoint: strings.TrimPrefix(collector.server.URL, "http://"),
+		Insecure: true,
+	}
+	proxy := startTestProxy(t, config)
+
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	assert.Equal(t, 1, proxy.TerminateUserSessions("user1"))
+
+	// The access log is written once the connection's spans have ended.
+	select {
+	case <-sink.records:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not close")
+	}
+
+	// Closing the proxy flushes buffered spans to the collector.
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+
+	accept := collector.span("accept")
+	require.NotNil(t, accept)
+	assert.Equal(t, "user1", spanAttribute(accept, "enduser.id").GetStringValue())
+	assert.Equal(t, "engineering", spanAttribute(accept, "tcpproxy.group").GetStringValue())
+	assert.Equal(t, "terminated", spanAttribute(accept, "tcpproxy.close_reason").GetStringValue())
+
+	for _, name := range []string{
+		"tls.handshake", "authorize", "rate_limit.check", "upstream.select", "upstream.dial", "data.transfer",
+	} {
+		span := collector.span(name)
+		require.NotNil(t, span, name)
+		assert.Equal(t, accept.TraceId, span.TraceId, name)
+	}
+	assert.Equal(t, "1.3", spanAttribute(collector.span("tls.handshake"), "tls.protocol.version").GetStringValue())
+	rateLimited := spanAttribute(collector.span("rate_limit.check"), "tcpproxy.rate_limited")
+	require.NotNil(t, rateLimited)
+	assert.False(t, rateLimited.GetBoolValue())
+	assert.Equal(t,
+		echoSrv.listener.Addr().String(),
+		spanAttribute(collector.span("upstream.dial"), "server.address").GetStringValue(),
+	)
+	assert.Equal(t, int64(12), spanAttribute(collector.span("data.transfer"), "tcpproxy.bytes_in").GetIntValue())
+}
+
+func TestTraceHandler(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := slog.New(traceHandler{slog.NewJSONHandler(&buffer, nil)})
+	provider := sdktrace.NewTracerProvider()
+	defer func() { _ = provider.Shutdown(context.Background()) }()
+
+	ctx, span := provider.Tracer("test").Start(context.Background(), "test")
+	logger.With("user", "user1").InfoContext(ctx, "traced")
+	span.End()
+	assert.Contains(t, buffer.String(), `"trace_id":"`+span.SpanContext().TraceID().String()+`"`)
+	assert.Contains(t, buffer.String(), `"span_id":"`+span.SpanContext().SpanID().String()+`"`)
+
+	// Records without a span are left alone.
+	buffer.Reset()
+	logger.Info("untraced")
+	assert.NotContains(t, buffer.String(), "trace_id")
+}
+
+func TestTracingConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&TracingConfig{Endpoint: "localhost:4318"}).validate())
+	assert.Error(t, (&TracingConfig{}).validate())
+	ratio := 2.0
+	assert.Error(t, (&TracingConfig{Endpoint: "localhost:4318", SampleRatio: &ratio}).validate())
+	ratio = 0
+	assert.NoError(t, (&TracingConfig{Endpoint: "localhost:4318", SampleRatio: &ratio}).validate())
+}
+
+func TestNewTracerProvider_SampleRatio(t *testing.T) {
+	sampled := func(conf *TracingConfig) bool {
+		provider, shutdown, err := newTracerProvider(conf)
+		require.NoError(t, err)
+		defer func() { _ = shutdown(context.Background()) }()
+
+		_, span := provider.Tracer("test").Start(context.Background(), "test")
+		defer span.End()
+		return span.SpanContext().IsSampled()
+	}
+
+	// Every connection is traced by default, and none with a ratio of 0.
+	assert.True(t, sampled(&TracingConfig{Endpoint: "localhost:4318"}))
+	ratio := 0.0
+	assert.False(t, sampled(&TracingConfig{Endpoint: "localhost:4318", SampleRatio: &ratio}))
+}
@@ -0,0 +1,115 @@
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// copyBufferSize is the size of the buffers data is copied through in user space, large enough for several
+	// TLS records of the maximum size.
+	copyBufferSize = 64 * 1024
+	// spliceChunkSize is how much data is spliced between sockets before a session's byte counter is updated.
+	spliceChunkSize = 1024 * 1024
+)
+
+// copyBuffers holds the buffers used to copy data, so that sessions do not allocate their own.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, copyBufferSize)
+		return &buffer
+	},
+}
+
+// wrappedConn is a connection wrapping a socket, which may hold data already read from the socket but not yet
+// returned by Read.
+type wrappedConn interface {
+	// unwrap writes the held data to w, then returns the wrapped connection, which can be read from directly.
+	unwrap(w io.Writer) (int64, net.Conn, error)
+}
+
+// transfer copies from src to dst until src reaches EOF or an error occurs, returning the number of bytes copied.
+//
+// When dst is a countingWriter of a TCP socket, and src is a TCP or Unix socket once unwrapped, such as on
+// plaintext and passthrough legs, data is moved between the sockets with splice on Linux, without being copied
+// through user space. Otherwise, for example when either leg is TLS or the session is captured, data is copied
+// through a pooled buffer.
+func transfer(dst io.Writer, src net.Conn) (int64, error) {
+	if counting, ok := dst.(*countingWriter); ok {
+		if socket, ok := counting.writer.(*net.TCPConn); ok {
+			return splice(socket, counting.counter, src)
+		}
+	}
+
+	return copyBuffered(dst, src)
+}
+
+// closeWrite shuts down the writing side of conn, so that its peer reads EOF while it can still send data back.
+// TLS connections send a close_notify alert before their socket is shut down.
+func closeWrite(conn net.Conn) error {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		if err := c.CloseWrite(); err != nil {
+			return err
+		}
+		return closeWrite(c.NetConn())
+	case *passthroughConn:
+		return closeWrite(c.Conn)
+	case *proxyProtocolConn:
+		return closeWrite(c.Conn)
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	default:
+		return errors.ErrUnsupported
+	}
+}
+
+// splice copies from src to the dst socket, adding the bytes written to counter as they are copied.
+func splice(dst *net.TCPConn, counter *atomic.Int64, src net.Conn) (int64, error) {
+	var written int64
+	for {
+		wrapped, ok := src.(wrappedConn)
+		if !ok {
+			break
+		}
+		n, unwrapped, err := wrapped.unwrap(dst)
+		counter.Add(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		src = unwrapped
+	}
+
+	switch src.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		n, err := copyBuffered(&countingWriter{writer: dst, counter: counter}, src)
+		return written + n, err
+	}
+
+	// Splice in chunks, so the counter shows progress on long-lived sessions. A chunk copying nothing is EOF.
+	chunk := &io.LimitedReader{R: src}
+	for {
+		chunk.N = spliceChunkSize
+		n, err := dst.ReadFrom(chunk)
+		counter.Add(n)
+		written += n
+		if err != nil || n == 0 {
+			return written, err
+		}
+	}
+}
+
+// copyBuffered copies from src to dst through a pooled buffer.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buffer)
+
+	// Hide any WriterTo or ReaderFrom implementations, which would allocate a buffer of their own.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buffer)
+}
@@ -0,0 +1,190 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// benchmarkTransferSize is how much data each benchmark iteration transfers, as a session of its own.
+const benchmarkTransferSize = 16 * 1024 * 1024
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	defer func() { _ = listener.Close() }()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(tb, err)
+	server, err := listener.Accept()
+	require.NoError(tb, err)
+
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// transferThrough transfers what is written to a source connection, wrapped by wrap, to a destination connection,
+// returning the data received on the other end of the destination, and how much transfer reported copying.
+func transferThrough(t *testing.T, dst func(*net.TCPConn) io.Writer, wrap func(net.Conn) net.Conn) (string, int64) {
+	srcPeer, src := tcpPair(t)
+	dstConn, dstPeer := tcpPair(t)
+	defer func() { _ = dstPeer.Close() }()
+
+	go func() {
+		_, _ = srcPeer.Write([]byte("world"))
+		_ = srcPeer.Close()
+	}()
+	n, err := transfer(dst(dstConn), wrap(src))
+	require.NoError(t, err)
+	require.NoError(t, src.Close())
+	require.NoError(t, dstConn.Close())
+	received, err := io.ReadAll(dstPeer)
+	require.NoError(t, err)
+
+	return string(received), n
+}
+
+func TestTransfer(t *testing.T) {
+	var counter atomic.Int64
+	counting := func(conn *net.TCPConn) io.Writer {
+		return &countingWriter{writer: conn, counter: &counter}
+	}
+	wraps := map[string]func(net.Conn) net.Conn{
+		"passthrough": func(conn net.Conn) net.Conn {
+			return &passthroughConn{Conn: conn, buffered: bytes.NewBufferString("hello ")}
+		},
+		"PROXY protocol": func(conn net.Conn) net.Conn {
+			reader := bufio.NewReader(io.MultiReader(strings.NewReader("hello "), conn))
+			_, _ = reader.Peek(len("hello "))
+			return &proxyProtocolConn{Conn: conn, reader: reader}
+		},
+		"passthrough after PROXY protocol": func(conn net.Conn) net.Conn {
+			reader := bufio.NewReader(io.MultiReader(strings.NewReader("lo "), conn))
+			_, _ = reader.Peek(len("lo "))
+			return &passthroughConn{
+				Conn:     &proxyProtocolConn{Conn: conn, reader: reader},
+				buffered: bytes.NewBufferString("hel"),
+			}
+		},
+	}
+	for name, wrap := range wraps {
+		t.Run(name, func(t *testing.T) {
+			counter.Store(0)
+			// Data buffered by the wrappers is sent before the spliced data.
+			received, n := transferThrough(t, counting, wrap)
+			assert.Equal(t, "hello world", received)
+			assert.Equal(t, int64(len("hello world")), n)
+			assert.Equal(t, n, counter.Load())
+		})
+	}
+
+	t.Run("buffered", func(t *testing.T) {
+		// Writers other than a countingWriter of a TCP socket, such as a capture, are copied to through a buffer.
+		var captured bytes.Buffer
+		received, n := transferThrough(t, func(conn *net.TCPConn) io.Writer {
+			return io.MultiWriter(conn, &captured)
+		}, func(conn net.Conn) net.Conn { return conn })
+		assert.Equal(t, "world", received)
+		assert.Equal(t, "world", captured.String())
+		assert.Equal(t, int64(len("world")), n)
+	})
+}
+
+// benchmarkSource returns a connection to transfer from, and a connection whose writes are read from it.
+func benchmarkSource(b *testing.B, useTLS bool) (net.Conn, net.Conn) {
+	srcPeer, src := tcpPair(b)
+	if !useTLS {
+		return src, srcPeer
+	}
+
+	serverConfig, err := serverTLSConfig(certificatePath("ca.pem"), certificatePath("tcp-proxy.pem"),
+		certificatePath("tcp-proxy.key"))
+	require.NoError(b, err)
+	clientConfig := clientTlsConfig(b, "user1")
+	clientConfig.ServerName = "localhost"
+	server, client := tls.Server(src, serverConfig), tls.Client(srcPeer, clientConfig)
+	handshakeErr := make(chan error, 1)
+	go func() {
+		handshakeErr <- client.Handshake()
+	}()
+	require.NoError(b, server.Handshake())
+	require.NoError(b, <-handshakeErr)
+
+	return server, client
+}
+
+// benchmarkTransfer measures copying sessions of benchmarkTransferSize bytes from a plaintext or TLS connection to a
+// plaintext one, as on the client to upstream leg of a session, reporting allocations and bytes allocated per GB
+// transferred.
+func benchmarkTransfer(b *testing.B, copyFunc func(io.Writer, net.Conn) (int64, error), useTLS bool) {
+	payload := make([]byte, copyBufferSize)
+	var mallocs, allocated uint64
+	var stats runtime.MemStats
+	b.SetBytes(benchmarkTransferSize)
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		src, writer := benchmarkSource(b, useTLS)
+		dst, dstPeer := tcpPair(b)
+		go func() {
+			for written := 0; written < benchmarkTransferSize; written += len(payload) {
+				if _, err := writer.Write(payload); err != nil {
+					break
+				}
+			}
+			_ = writer.Close()
+		}()
+		sinkDone := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(io.Discard, dstPeer)
+			close(sinkDone)
+		}()
+
+		var counter atomic.Int64
+		runtime.ReadMemStats(&stats)
+		mallocsBefore, allocatedBefore := stats.Mallocs, stats.TotalAlloc
+		b.StartTimer()
+		n, err := copyFunc(&countingWriter{writer: dst, counter: &counter}, src)
+		b.StopTimer()
+		runtime.ReadMemStats(&stats)
+		mallocs += stats.Mallocs - mallocsBefore
+		allocated += stats.TotalAlloc - allocatedBefore
+		require.NoError(b, err)
+		require.Equal(b, int64(benchmarkTransferSize), n)
+
+		_ = dst.Close()
+		<-sinkDone
+		_ = dstPeer.Close()
+		_ = src.Close()
+	}
+
+	gigabytes := float64(b.N) * benchmarkTransferSize / 1e9
+	b.ReportMetric(float64(mallocs)/gigabytes, "allocs/GB")
+	b.ReportMetric(float64(allocated)/gigabytes, "B/GB")
+}
+
+// BenchmarkTransfer compares transfer with the io.Copy it replaced, for plaintext and TLS sources.
+func BenchmarkTransfer(b *testing.B) {
+	copyFuncs := []struct {
+		name     string
+		copyFunc func(io.Writer, net.Conn) (int64, error)
+	}{
+		{"io.Copy", func(dst io.Writer, src net.Conn) (int64, error) { return io.Copy(dst, src) }},
+		{"transfer", transfer},
+	}
+	for _, leg := range []string{"plaintext", "tls"} {
+		for _, c := range copyFuncs {
+			b.Run(leg+"/"+c.name, func(b *testing.B) {
+				benchmarkTransfer(b, c.copyFunc, leg == "tls")
+			})
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package tcpproxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultUDPIdleTimeout is how long a UDP flow may see no packets in either direction before it expires.
+	defaultUDPIdleTimeout = 30 * time.Second
+	// defaultUDPMaxFlows is how many UDP flows may exist at once before packets from new sources are dropped.
+	defaultUDPMaxFlows = 10000
+	// udpMaxPacketSize is the largest UDP payload.
+	udpMaxPacketSize = 65535
+)
+
+// UDPConfig is the configuration for proxying UDP datagrams, for example to DNS or syslog services. Each client
+// address is a flow, assigned to the upstream with the fewest flows when its first packet arrives, and replies are
+// relayed back until the flow is idle for IdleTimeout.
+//
+// UDP clients cannot be authenticated with certificates, so only clients from AllowedSources are proxied.
+type UDPConfig struct {
+	// ListenerAddr is the address UDP datagrams are received on, for example, ":5353".
+	ListenerAddr string
+	// Targets is a list of upstream UDP network addresses.
+	Targets []string
+
+	// AllowedSources lists the CIDRs clients may send from, for example "10.0.0.0/8". Packets from other sources
+	// are dropped.
+	AllowedSources []string
+
+	// IdleTimeout is how long a flow may see no packets in either direction before it expires. Defaults to
+	// 30 seconds.
+	IdleTimeout time.Duration
+	// MaxFlows is how many flows may exist at once. Packets starting new flows beyond it are dropped. Defaults
+	// to 10000.
+	MaxFlows int
+
+	// PacketCapacity is the maximum burst of packets accepted from a single source. Zero disables the limit.
+	PacketCapacity int
+	// PacketFillRate is how often 1 packet is added back to each source's budget.
+	PacketFillRate time.Duration
+}
+
+func (c *UDPConfig) validate() error {
+	if c.ListenerAddr == "" {
+		return errors.New("UDP config does not contain a ListenerAddr")
+	}
+	if len(c.Targets) == 0 {
+		return errors.New("UDP config does not contain any Targets")
+	}
+	if len(c.AllowedSources) == 0 {
+		return errors.New("UDP config does not contain any AllowedSources")
+	}
+	if _, err := parseCIDRs(c.AllowedSources); err != nil {
+		return fmt.Errorf("invalid UDP AllowedSources: %w", err)
+	}
+	if c.IdleTimeout < 0 {
+		return errors.New("UDP IdleTimeout cannot be negative")
+	}
+	if c.MaxFlows < 0 {
+		return errors.New("UDP MaxFlows cannot be negative")
+	}
+	if c.PacketCapacity < 0 {
+		return errors.New("UDP PacketCapacity cannot be negative")
+	}
+	if c.PacketCapacity > 0 && c.PacketFillRate <= 0 {
+		return errors.New("UDP PacketFillRate must be positive")
+	}
+
+	return nil
+}
+
+// UDPFlowInfo is a point-in-time view of a UDP flow.
+type UDPFlowInfo struct {
+	Client     string    `json:"client"`
+	Upstream   string    `json:"upstream"`
+	StartTime  time.Time `json:"start_time"`
+	LastActive time.Time `json:"last_active"`
+	// PacketsIn and BytesIn count datagrams from the client to the upstream.
+	PacketsIn int64 `json:"packets_in"`
+	BytesIn   int64 `json:"bytes_in"`
+	// PacketsOut and BytesOut count datagrams from the upstream back to the client.
+	PacketsOut int64 `json:"packets_out"`
+	BytesOut   int64 `json:"bytes_out"`
+}
+
+// udpFlow relays the datagrams of a single client through a connected socket to its upstream.
+type udpFlow struct {
+	client    netip.AddrPort
+	upstream  *Upstream
+	conn      *net.UDPConn
+	startTime time.Time
+
+	lastActive atomic.Int64
+	packetsIn  atomic.Int64
+	bytesIn    atomic.Int64
+	packetsOut atomic.Int64
+	bytesOut   atomic.Int64
+}
+
+// touch records activity on the flow, postponing its expiry.
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+// lastActiveTime returns when a packet last passed through the flow in either direction.
+func (f *udpFlow) lastActiveTime() time.Time {
+	return time.Unix(0, f.lastActive.Load())
+}
+
+func (f *udpFlow) info() UDPFlowInfo {
+	return UDPFlowInfo{
+		Client:     f.client.String(),
+		Upstream:   f.upstream.Address,
+		StartTime:  f.startTime,
+		LastActive: f.lastActiveTime(),
+		PacketsIn:  f.packetsIn.Load(),
+		BytesIn:    f.bytesIn.Load(),
+		PacketsOut: f.packetsOut.Load(),
+		BytesOut:   f.bytesOut.Load(),
+	}
+}
+
+// udpProxy proxies the datagrams received on a UDP socket to upstreams, tracking a flow per client address.
+type udpProxy struct {
+	conn           *net.UDPConn
+	loadBalancer   *LeastConnectionBalancer
+	allowedSources []netip.Prefix
+	limiter        *connectionLimiter
+	idleTimeout    time.Duration
+	maxFlows       int
+	logger         *slog.Logger
+
+	flows  map[netip.AddrPort]*udpFlow
+	closed bool
+	mutex  sync.Mutex
+	wg     sync.WaitGroup
+}
+
+// newUDPProxy listens for the UDP datagrams described by a validated UDPConfig, which may be nil.
+func newUDPProxy(conf *UDPConfig, logger *slog.Logger) (*udpProxy, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	loadBalancer, err := NewLeastConnectionBalancer(conf.Targets)
+	if err != nil {
+		return nil, err
+	}
+	address, err := net.ResolveUDPAddr("udp", conf.ListenerAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &udpProxy{
+		conn:         conn,
+		loadBalancer: loadBalancer,
+		idleTimeout:  conf.IdleTimeout,
+		maxFlows:     conf.MaxFlows,
+		logger:       logger,
+		flows:        make(map[netip.AddrPort]*udpFlow),
+	}
+	// The CIDRs were already parsed by Validate, so this cannot fail.
+	u.allowedSources, _ = parseCIDRs(conf.AllowedSources)
+	if u.idleTimeout == 0 {
+		u.idleTimeout = defaultUDPIdleTimeout
+	}
+	if u.maxFlows == 0 {
+		u.maxFlows = defaultUDPMaxFlows
+	}
+	if conf.PacketCapacity > 0 {
+		u.limiter = newConnectionLimiter(ConnectionLimitConfig{
+			SourceCapacity: conf.PacketCapacity,
+			SourceFillRate: conf.PacketFillRate,
+		}, time.Now)
+	}
+
+	return u, nil
+}
+
+// address returns the address the UDP socket is listening on.
+func (u *udpProxy) address() string {
+	return u.conn.LocalAddr().String()
+}
+
+// serve relays datagrams from clients to their flow's upstream until close is called.
+func (u *udpProxy) serve() {
+	buffer := make([]byte, udpMaxPacketSize)
+	for {
+		n, client, err := u.conn.ReadFromUDPAddrPort(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			u.logger.Debug("reading UDP datagram", slog.String("error", err.Error()))
+			continue
+		}
+
+		clientAddr := net.UDPAddrFromAddrPort(client)
+		if !prefixesContain(u.allowedSources, clientAddr) {
+			u.logger.Debug("UDP source is not allowed, dropping", slog.String("client", client.String()))
+			continue
+		}
+		if u.limiter != nil && !u.limiter.allow(clientAddr) {
+			u.logger.Debug("UDP packet rate limit exceeded, dropping", slog.String("client", client.String()))
+			continue
+		}
+
+		flow, err := u.flow(client)
+		if err != nil {
+			u.logger.Warn("could not start UDP flow, dropping", slog.String("client", client.String()),
+				slog.String("error", err.Error()))
+			continue
+		}
+		if _, err = flow.conn.Write(buffer[:n]); err != nil {
+			u.logger.Debug("writing UDP datagram to upstream", slog.String("error", err.Error()))
+			continue
+		}
+		flow.packetsIn.Add(1)
+		flow.bytesIn.Add(int64(n))
+		flow.touch()
+	}
+}
+
+// flow returns the flow of a client, starting one with the least loaded upstream if it has none.
+func (u *udpProxy) flow(client netip.AddrPort) (*udpFlow, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if flow, ok := u.flows[client]; ok {
+		return flow, nil
+	}
+	if u.closed {
+		return nil, net.ErrClosed
+	}
+	if len(u.flows) >= u.maxFlows {
+		return nil, errors.New("too many UDP flows")
+	}
+
+	upstream := u.loadBalancer.FetchUpstream()
+	if upstream == nil {
+		return nil, errors.New("no upstream available, all upstreams are draining")
+	}
+	conn, err := net.DialTimeout("udp", upstream.Address, DialTimeout)
+	if err != nil {
+		upstream.Release()
+		return nil, err
+	}
+
+	flow := &udpFlow{client: client, upstream: upstream, conn: conn.(*net.UDPConn), startTime: time.Now()}
+	flow.touch()
+	u.flows[client] = flow
+	u.wg.Add(1)
+	go u.relay(flow)
+	u.logger.Debug(
+		"UDP flow started",
+		slog.String("client", client.String()),
+		slog.String("upstream", upstream.Address),
+	)
+
+	return flow, nil
+}
+
+// relay sends the upstream's replies back to the flow's client, until the flow has been idle for the
+// idleTimeout or the upstream socket fails.
+func (u *udpProxy) relay(flow *udpFlow) {
+	defer u.wg.Done()
+	defer u.remove(flow)
+
+	buffer := make([]byte, udpMaxPacketSize)
+	for {
+		_ = flow.conn.SetReadDeadline(flow.lastActiveTime().Add(u.idleTimeout))
+		n, err := flow.conn.Read(buffer)
+		if err != nil {
+			// Packets from the client may have arrived since the deadline was set.
+			if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(flow.lastActiveTime()) < u.idleTimeout {
+				continue
+			}
+			return
+		}
+
+		if _, err = u.conn.WriteToUDPAddrPort(buffer[:n], flow.client); err != nil {
+			u.logger.Debug("writing UDP datagram to client", slog.String("error", err.Error()))
+			continue
+		}
+		flow.packetsOut.Add(1)
+		flow.bytesOut.Add(int64(n))
+		flow.touch()
+	}
+}
+
+// remove ends a flow, releasing its upstream.
+func (u *udpProxy) remove(flow *udpFlow) {
+	u.mutex.Lock()
+	delete(u.flows, flow.client)
+	u.mutex.Unlock()
+
+	_ = flow.conn.Close()
+	flow.upstream.Release()
+	u.logger.Debug("UDP flow ended", slog.String("client", flow.client.String()))
+}
+
+// list returns every flow, oldest first.
+func (u *udpProxy) list() []UDPFlowInfo {
+	u.mutex.Lock()
+	infos := make([]UDPFlowInfo, 0, len(u.flows))
+	for _, flow := range u.flows {
+		infos = append(infos, flow.info())
+	}
+	u.mutex.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.Before(infos[j].StartTime)
+	})
+
+	return infos
+}
+
+// close stops receiving datagrams and ends every flow.
+func (u *udpProxy) close() error {
+	err := u.conn.Close()
+
+	u.mutex.Lock()
+	u.closed = true
+	for _, flow := range u.flows {
+		_ = flow.conn.Close()
+	}
+	u.mutex.Unlock()
+	u.wg.Wait()
+
+	return err
+}
+
+// UDPAddress returns the address the proxy receives UDP datagrams on, or an empty string if UDP is not configured.
+func (p *Proxy) UDPAddress() string {
+	if p.udp == nil {
+		return ""
+	}
+
+	return p.udp.address()
+}
+
+// UDPFlows returns the current UDP flows, oldest first.
+func (p *Proxy) UDPFlows() []UDPFlowInfo {
+	if p.udp == nil {
+		return []UDPFlowInfo{}
+	}
+
+	return p.udp.list()
+}
@@ -0,0 +1,171 @@
+package tcpproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupUDPEchoServer starts a UDP server echoing every datagram back to its sender, until the test ends.
+func setupUDPEchoServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buffer := make([]byte, udpMaxPacketSize)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDPAddrPort(buffer[:n], addr)
+		}
+	}()
+
+	return conn
+}
+
+// udpExchange sends a datagram on conn, returning the reply or an error if none arrives in time.
+func udpExchange(t *testing.T, conn *net.UDPConn, message string) (string, error) {
+	_, err := conn.Write([]byte(message))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+	buffer := make([]byte, udpMaxPacketSize)
+	n, err := conn.Read(buffer)
+
+	return string(buffer[:n]), err
+}
+
+func testUDPProxy(t *testing.T, conf *UDPConfig) *Proxy {
+	echoSrv := setupEchoServer(t)
+	t.Cleanup(func() { _ = echoSrv.close() })
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.UDPConfig = conf
+
+	return startTestProxy(t, config)
+}
+
+func dialUDP(t *testing.T, address string) *net.UDPConn {
+	conn, err := net.Dial("udp", address)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn.(*net.UDPConn)
+}
+
+func TestUDPConfig_Validate(t *testing.T) {
+	valid := UDPConfig{ListenerAddr: ":5353", Targets: []string{"10.0.0.1:53"}, AllowedSources: []string{"10.0.0.0/8"}}
+	assert.NoError(t, valid.validate())
+
+	tests := map[string]func(conf *UDPConfig){
+		"no listener":      func(conf *UDPConfig) { conf.ListenerAddr = "" },
+		"no targets":       func(conf *UDPConfig) { conf.Targets = nil },
+		"no sources":       func(conf *UDPConfig) { conf.AllowedSources = nil },
+		"invalid source":   func(conf *UDPConfig) { conf.AllowedSources = []string{"10.0.0.0/33"} },
+		"negative timeout": func(conf *UDPConfig) { conf.IdleTimeout = -time.Second },
+		"negative flows":   func(conf *UDPConfig) { conf.MaxFlows = -1 },
+		"no fill rate":     func(conf *UDPConfig) { conf.PacketCapacity = 10 },
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			conf := valid
+			modify(&conf)
+			assert.Error(t, conf.validate())
+		})
+	}
+}
+
+func Test_ProxyProxiesUDP(t *testing.T) {
+	first, second := setupUDPEchoServer(t), setupUDPEchoServer(t)
+	proxy := testUDPProxy(t, &UDPConfig{
+		ListenerAddr:   "127.0.0.1:0",
+		Targets:        []string{first.LocalAddr().String(), second.LocalAddr().String()},
+		AllowedSources: []string{"127.0.0.0/8"},
+		IdleTimeout:    200 * time.Millisecond,
+	})
+
+	client1, client2 := dialUDP(t, proxy.UDPAddress()), dialUDP(t, proxy.UDPAddress())
+	for _, client := range []*net.UDPConn{client1, client2, client1} {
+		reply, err := udpExchange(t, client, "ping")
+		require.NoError(t, err)
+		assert.Equal(t, "ping", reply)
+	}
+
+	// Each client is a flow, and flows are balanced across the upstreams. Counters are updated once a datagram has
+	// been relayed, which may be after the client has received it.
+	var flows []UDPFlowInfo
+	require.Eventually(t, func() bool {
+		flows = proxy.UDPFlows()
+		return len(flows) == 2 && flows[0].PacketsIn == 2 && flows[0].PacketsOut == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, client1.LocalAddr().String(), flows[0].Client)
+	assert.Equal(t, int64(8), flows[0].BytesOut)
+	assert.NotEqual(t, flows[0].Upstream, flows[1].Upstream)
+
+	// Idle flows expire, releasing their upstream.
+	require.Eventually(t, func() bool {
+		return len(proxy.UDPFlows()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, upstream := range proxy.udp.loadBalancer.FetchUpstreams() {
+		assert.Equal(t, 0, upstream.Connections())
+	}
+
+	assert.NoError(t, proxy.Close())
+}
+
+func Test_ProxyLimitsUDPSources(t *testing.T) {
+	echo := setupUDPEchoServer(t)
+	proxy := testUDPProxy(t, &UDPConfig{
+		ListenerAddr:   "127.0.0.1:0",
+		Targets:        []string{echo.LocalAddr().String()},
+		AllowedSources: []string{"127.0.0.0/8"},
+		PacketCapacity: 2,
+		PacketFillRate: time.Hour,
+	})
+
+	client := dialUDP(t, proxy.UDPAddress())
+	for i := 0; i < 2; i++ {
+		_, err := udpExchange(t, client, "ping")
+		require.NoError(t, err)
+	}
+	_, err := udpExchange(t, client, "ping")
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Equal(t, int64(2), proxy.UDPFlows()[0].PacketsIn)
+
+	assert.NoError(t, proxy.Close())
+}
+
+func Test_ProxyDropsUDPFromDisallowedSources(t *testing.T) {
+	echo := setupUDPEchoServer(t)
+	proxy := testUDPProxy(t, &UDPConfig{
+		ListenerAddr:   "127.0.0.1:0",
+		Targets:        []string{echo.LocalAddr().String()},
+		AllowedSources: []string{"10.0.0.0/8"},
+	})
+
+	_, err := udpExchange(t, dialUDP(t, proxy.UDPAddress()), "ping")
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Empty(t, proxy.UDPFlows())
+
+	assert.NoError(t, proxy.Close())
+}
+
+func TestAdminServer_UDPFlows(t *testing.T) {
+	a, _ := newTestAdminServer()
+
+	recorder := adminRequest(a, http.MethodGet, "/udp/flows", "admin@administrators")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var flows []UDPFlowInfo
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &flows))
+	assert.Empty(t, flows)
+	assert.Equal(t, http.StatusMethodNotAllowed,
+		adminRequest(a, http.MethodPost, "/udp/flows", "admin@administrators").Code)
+}
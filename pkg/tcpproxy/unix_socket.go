@@ -0,0 +1,255 @@
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// unixTargetPrefix marks targets that are Unix sockets, for example "unix:///run/app.sock".
+	unixTargetPrefix = "unix://"
+	// defaultUnixSocketMode is the permissions of the listener's socket file when UnixSocketConfig.Mode is unset.
+	defaultUnixSocketMode = 0o660
+)
+
+// UnixSocketConfig is the configuration for accepting connections on a Unix socket, for clients on the same host
+// such as sidecars. Connections are not encrypted, and clients are identified by the user and primary group of
+// their process, read from the socket's peer credentials, in place of a certificate.
+type UnixSocketConfig struct {
+	// Path is where the socket file is created. A stale socket left behind by a previous process is removed first.
+	Path string
+	// Mode is the permissions of the socket file. Clients need write permission to connect. Defaults to 0660.
+	Mode fs.FileMode
+	// Owner and Group optionally change the ownership of the socket file, as names or numeric IDs.
+	Owner string
+	Group string
+}
+
+func (c *UnixSocketConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("unix socket config does not contain a Path")
+	}
+	if c.Mode&^fs.ModePerm != 0 {
+		return fmt.Errorf("unix socket Mode %v may only contain permission bits", c.Mode)
+	}
+
+	return nil
+}
+
+// listenUnixSocket creates the socket file described by conf, with its permissions and ownership applied.
+func listenUnixSocket(conf *UnixSocketConfig) (*unixSocketListener, error) {
+	uid, gid := -1, -1
+	var err error
+	if conf.Owner != "" {
+		if uid, err = lookupID(conf.Owner, osuser.Lookup, func(u *osuser.User) string { return u.Uid }); err != nil {
+			return nil, fmt.Errorf("unix socket owner: %w", err)
+		}
+	}
+	if conf.Group != "" {
+		if gid, err = lookupID(conf.Group, osuser.LookupGroup, func(g *osuser.Group) string { return g.Gid }); err != nil {
+			return nil, fmt.Errorf("unix socket group: %w", err)
+		}
+	}
+
+	mode := conf.Mode
+	if mode == 0 {
+		mode = defaultUnixSocketMode
+	}
+
+	return listenPrivateUnix(conf.Path, func(path string) error {
+		if err := os.Chmod(path, mode); err != nil || (uid == -1 && gid == -1) {
+			return err
+		}
+		return os.Chown(path, uid, gid)
+	})
+}
+
+// unixSocketListener is a Unix socket listener that was moved into place after being created, which removes its
+// socket file when closed.
+type unixSocketListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixSocketListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.UnixListener.Close()
+	if removeErr := os.Remove(l.path); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) && err == nil {
+		err = removeErr
+	}
+
+	return err
+}
+
+// listenPrivateUnix listens on a Unix socket at path, which no other user can connect to before prepare has applied
+// its permissions. The socket is created in a private directory beside path and renamed into place afterwards,
+// since the permissions of a new socket file otherwise depend on the umask until it is changed. A stale socket left
+// behind by a previous process is replaced.
+func listenPrivateUnix(path string, prepare func(path string) error) (*unixSocketListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".tcp-proxy-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tempPath := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tempPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is moved, so it is removed from its final path by unixSocketListener instead.
+	listener.SetUnlinkOnClose(false)
+	if err = prepare(tempPath); err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	return &unixSocketListener{UnixListener: listener, path: path}, nil
+}
+
+// lookupID resolves a user or group given by name or numeric ID to its numeric ID.
+func lookupID[T any](name string, lookup func(string) (T, error), id func(T) string) (int, error) {
+	if numeric, err := strconv.Atoi(name); err == nil {
+		return numeric, nil
+	}
+	found, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(id(found))
+}
+
+// peerCredentials identifies the process on the other end of a Unix socket.
+type peerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// identity maps the credentials to the name of their user and primary group, falling back to the numeric IDs if
+// they have no name.
+func (c peerCredentials) identity() (string, string) {
+	userName, groupName := strconv.FormatUint(uint64(c.UID), 10), strconv.FormatUint(uint64(c.GID), 10)
+	if u, err := osuser.LookupId(userName); err == nil {
+		userName = u.Username
+	}
+	if g, err := osuser.LookupGroupId(groupName); err == nil {
+		groupName = g.Name
+	}
+
+	return userName, groupName
+}
+
+// unixPeerAddr is the address of a client connected over a Unix socket, which is its process.
+type unixPeerAddr struct {
+	credentials peerCredentials
+}
+
+func (a unixPeerAddr) Network() string {
+	return "unix"
+}
+
+func (a unixPeerAddr) String() string {
+	return fmt.Sprintf("pid=%d,uid=%d", a.credentials.PID, a.credentials.UID)
+}
+
+// unixPeerConn is a connection accepted on the Unix socket listener, reporting its peer's process as its address.
+type unixPeerConn struct {
+	*net.UnixConn
+	credentials peerCredentials
+}
+
+// unwrap returns the underlying connection, as nothing is buffered.
+func (c *unixPeerConn) unwrap(io.Writer) (int64, net.Conn, error) {
+	return 0, c.UnixConn, nil
+}
+
+func (c *unixPeerConn) RemoteAddr() net.Addr {
+	return unixPeerAddr{credentials: c.credentials}
+}
+
+// serveUnix accepts connections on the Unix socket listener until it is closed. Each connection is authorized by
+// its peer credentials and proxied in a goroutine tracked by wg.
+func (p *Proxy) serveUnix(wg *sync.WaitGroup) {
+	for {
+		conn, err := p.unixListener.AcceptUnix()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.serveUnixConnection(conn)
+		}()
+	}
+}
+
+// serveUnixConnection authorizes a connection on the Unix socket listener by its peer credentials and proxies it,
+// or rejects it, returning once it is closed.
+func (p *Proxy) serveUnixConnection(conn *net.UnixConn) {
+	credentials, err := readPeerCredentials(conn)
+	if err != nil {
+		p.logger.Warn("could not read peer credentials, closing", slog.String("error", err.Error()))
+		_ = conn.Close()
+		return
+	}
+	peerConn := &unixPeerConn{UnixConn: conn, credentials: credentials}
+	clientAddress := peerConn.RemoteAddr().String()
+	p.hooks.notify(func(o Observer) {
+		o.OnAccept(AcceptEvent{ClientAddress: clientAddress, Time: time.Now()})
+	})
+
+	ctx, span := p.tracer.Start(context.Background(), "accept", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.ClientAddress(clientAddress)))
+	user, group, reason := p.peerAuthorized(ctx, peerConn)
+	p.auditDecision(peerConn, auditDecisionFor(reason), user, group, nil)
+	span.SetAttributes(semconv.EnduserID(user), attributeGroup.String(group))
+	p.dispatch(ctx, peerConn, user, group, reason)
+}
+
+// peerAuthorized identifies a client on the Unix socket listener by its peer credentials, then authorizes it like a
+// client presenting a certificate for that user and group.
+func (p *Proxy) peerAuthorized(ctx context.Context, conn *unixPeerConn) (string, string, RejectionReason) {
+	ctx, span := p.tracer.Start(ctx, "authorize")
+	defer span.End()
+
+	user, group := conn.credentials.identity()
+
+	return user, group, p.identityAuthorized(ctx, conn, user, group, nil)
+}
+
+// targetNetwork splits a target into the network and address to dial, so that "unix:///run/app.sock" is dialed as
+// a Unix socket, and anything else over TCP.
+func targetNetwork(target string) (string, string) {
+	if path, ok := strings.CutPrefix(target, unixTargetPrefix); ok {
+		return "unix", path
+	}
+
+	return "tcp", target
+}
@@ -0,0 +1,173 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupUnixEchoServer starts an echoServer listening on a Unix socket, returning it and its target address.
+func setupUnixEchoServer(t *testing.T) (*echoServer, string) {
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	echoSrv := newEchoServer(path)
+	echoSrv.listener = listener
+	go func() {
+		err := echoSrv.serve()
+		require.NoError(t, err)
+	}()
+
+	return echoSrv, unixTargetPrefix + path
+}
+
+func TestUnixSocketConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&UnixSocketConfig{Path: "proxy.sock", Mode: 0o600}).validate())
+	assert.Error(t, (&UnixSocketConfig{}).validate())
+	assert.Error(t, (&UnixSocketConfig{Path: "proxy.sock", Mode: os.ModeSetuid | 0o600}).validate())
+}
+
+func TestTargetNetwork(t *testing.T) {
+	network, address := targetNetwork("unix:///run/app.sock")
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/run/app.sock", address)
+
+	network, address = targetNetwork("localhost:9000")
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "localhost:9000", address)
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	// A stale file at the path is replaced.
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	listener, err := listenUnixSocket(&UnixSocketConfig{
+		Path:  path,
+		Mode:  0o640,
+		Owner: strconv.Itoa(os.Getuid()),
+		Group: strconv.Itoa(os.Getgid()),
+	})
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSocket, info.Mode().Type())
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	assert.Equal(t, path, listener.Addr().String())
+	// The private directory the socket was created in is gone.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Closing the listener removes the socket file.
+	require.NoError(t, listener.Close())
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = listenUnixSocket(&UnixSocketConfig{Path: path, Owner: "no-such-user-exists"})
+	assert.ErrorContains(t, err, "unix socket owner")
+}
+
+func TestListenPrivateUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	listener, err := listenPrivateUnix(path, func(tempPath string) error {
+		// Until the socket is moved into place, only the owner can reach it.
+		info, err := os.Stat(filepath.Dir(tempPath))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+		_, err = os.Stat(path)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		return nil
+	})
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+
+	// A failure to prepare the socket leaves nothing behind.
+	failedPath := filepath.Join(t.TempDir(), "failed.sock")
+	_, err = listenPrivateUnix(failedPath, func(string) error { return os.ErrPermission })
+	assert.ErrorIs(t, err, os.ErrPermission)
+	entries, err := os.ReadDir(filepath.Dir(failedPath))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func Test_ProxyServesUnixSocketClients(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	echoSrv, target := setupUnixEchoServer(t)
+	user, group := peerCredentials{UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}.identity()
+	config := testProxyConfig(t, target, group)
+	socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+	config.ListenerConfig.UnixSocket = &UnixSocketConfig{Path: socketPath}
+	sink := newRecordingSink()
+	config.AccessLogConfig = &AccessLogConfig{Sink: sink}
+	proxy := startTestProxy(t, config)
+
+	// The client is identified by its process's user and group, and proxied to the Unix socket target.
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello world\n", string(line))
+
+	sessions := proxy.Sessions(user, "")
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "pid="+strconv.Itoa(os.Getpid())+",uid="+strconv.Itoa(os.Getuid()), sessions[0].ClientAddress)
+	assert.Equal(t, 1, proxy.TerminateUserSessions(user))
+	select {
+	case record := <-sink.records:
+		assert.Equal(t, user, record.User)
+		assert.Equal(t, group, record.Group)
+		assert.Equal(t, target, record.Upstream)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not close")
+	}
+	assert.NoError(t, conn.Close())
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+	_, err = os.Stat(socketPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func Test_ProxyRefusesUnauthorizedUnixSocketClients(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	echoSrv, target := setupUnixEchoServer(t)
+	config := testProxyConfig(t, target, "engineering")
+	socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+	config.ListenerConfig.UnixSocket = &UnixSocketConfig{Path: socketPath}
+	config.ListenerConfig.RejectionMode = RejectionModeBanner
+	proxy := startTestProxy(t, config)
+
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	banner, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(banner), "ERROR unauthorized"), string(banner))
+	assert.NoError(t, conn.Close())
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
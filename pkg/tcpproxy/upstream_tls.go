@@ -0,0 +1,105 @@
+package tcpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// UpstreamTLSConfig is the configuration for originating TLS to upstreams, so that traffic leaving the proxy is
+// encrypted. The paths are to PEM files, and are re-read by Reload like the listener's TLS material.
+type UpstreamTLSConfig struct {
+	// CA is a bundle of CAs trusted to sign upstream certificates. Defaults to the system roots.
+	CA string
+	// ServerName is verified against upstream certificates, and sent as SNI. Defaults to the host of each target.
+	ServerName string
+
+	// Certificate and PrivateKey optionally present a client certificate to upstreams requiring mTLS.
+	Certificate string
+	PrivateKey  string
+
+	// MinVersion is the minimum TLS version accepted from upstreams, for example tls.VersionTLS13. Defaults to
+	// tls.VersionTLS12.
+	MinVersion uint16
+}
+
+func (c *UpstreamTLSConfig) validate() error {
+	if (c.Certificate == "") != (c.PrivateKey == "") {
+		return errors.New("upstream TLS config must set both or neither of Certificate and PrivateKey")
+	}
+	if c.MinVersion != 0 && (c.MinVersion < tls.VersionTLS10 || c.MinVersion > tls.VersionTLS13) {
+		return fmt.Errorf("unknown upstream TLS MinVersion %#04x", c.MinVersion)
+	}
+
+	return nil
+}
+
+// UpstreamTLSConfig loads the TLS configuration for connecting to upstreams, or returns nil if the UpstreamConfig
+// does not enable TLS.
+func (c *Config) UpstreamTLSConfig() (*tls.Config, error) {
+	conf := c.UpstreamConfig.TLS
+	if conf == nil {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: conf.ServerName,
+		MinVersion: conf.MinVersion,
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	if conf.CA != "" {
+		caData, err := os.ReadFile(conf.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in upstream CA %s", conf.CA)
+		}
+	}
+	if conf.Certificate != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Certificate, conf.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// originateTLS runs a TLS handshake with the upstream at address over conn, if upstream TLS is configured and
+// used by pool. The handshake must complete within DialTimeout. conn is closed if the handshake fails.
+func (p *Proxy) originateTLS(pool *upstreamPool, conn net.Conn, address string) (net.Conn, error) {
+	tlsConfig := p.upstreamTLSConfig.Load()
+	if tlsConfig == nil || !pool.originateTLS {
+		return conn, nil
+	}
+
+	if tlsConfig.ServerName == "" {
+		// Unix socket targets have no host, so need a ServerName to be configured.
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("upstream TLS ServerName is required for target %s: %w", address, err)
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("TLS handshake with upstream: %w", err)
+	}
+
+	return tlsConn, nil
+}
@@ -0,0 +1,141 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTLSEchoServer starts an echoServer that requires clients to present a certificate signed by the test CA.
+func setupTLSEchoServer(t *testing.T) *echoServer {
+	tlsConfig, err := serverTLSConfig(certificatePath("ca.pem"), certificatePath("tcp-proxy.pem"),
+		certificatePath("tcp-proxy.key"))
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	echoSrv := newEchoServer(listener.Addr().String())
+	echoSrv.listener = tls.NewListener(listener, tlsConfig)
+	go func() {
+		err := echoSrv.serve()
+		require.NoError(t, err)
+	}()
+
+	return echoSrv
+}
+
+func TestUpstreamTLSConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&UpstreamTLSConfig{}).validate())
+	assert.NoError(t, (&UpstreamTLSConfig{Certificate: "user1.pem", PrivateKey: "user1.key"}).validate())
+	assert.Error(t, (&UpstreamTLSConfig{Certificate: "user1.pem"}).validate())
+	assert.NoError(t, (&UpstreamTLSConfig{MinVersion: tls.VersionTLS13}).validate())
+	assert.Error(t, (&UpstreamTLSConfig{MinVersion: 0x0200}).validate())
+}
+
+func TestConfig_UpstreamTLSConfig(t *testing.T) {
+	config := testProxyConfig(t, "127.0.0.1:9000", "engineering")
+	tlsConfig, err := config.UpstreamTLSConfig()
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	config.UpstreamConfig.TLS = &UpstreamTLSConfig{CA: certificatePath("ca.pem")}
+	tlsConfig, err = config.UpstreamTLSConfig()
+	require.NoError(t, err)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Empty(t, tlsConfig.Certificates)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+
+	config.UpstreamConfig.TLS.CA = certificatePath("tcp-proxy.key")
+	_, err = config.UpstreamTLSConfig()
+	assert.ErrorContains(t, err, "no certificates found")
+}
+
+func Test_ProxyOriginatesTLSToUpstreams(t *testing.T) {
+	echoSrv := setupTLSEchoServer(t)
+	config := testProxyConfig(t, echoSrv.listener.Addr().String(), "engineering")
+	config.UpstreamConfig.TLS = &UpstreamTLSConfig{
+		CA:          certificatePath("ca.pem"),
+		Certificate: certificatePath("user2.pem"),
+		PrivateKey:  certificatePath("user2.key"),
+		MinVersion:  tls.VersionTLS13,
+	}
+	sink := newRecordingSink()
+	config.AccessLogConfig = &AccessLogConfig{Sink: sink}
+	proxy := startTestProxy(t, config)
+
+	echoThroughProxy(t, proxy, "user1", "hello world\n")
+	select {
+	case record := <-sink.records:
+		assert.Equal(t, CloseReasonTerminated, record.CloseReason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not close")
+	}
+
+	// A failed reload keeps the previous configuration.
+	config.UpstreamConfig.TLS.Certificate = certificatePath("missing.pem")
+	assert.Error(t, proxy.Reload())
+	echoThroughProxy(t, proxy, "user1", "hello world\n")
+	<-sink.records
+
+	// Reloading applies to new upstream connections, which now fail to verify the upstream's certificate.
+	config.UpstreamConfig.TLS.Certificate = certificatePath("user2.pem")
+	config.UpstreamConfig.TLS.ServerName = "upstream.example.com"
+	require.NoError(t, proxy.Reload())
+	conn, err := tls.Dial("tcp", proxy.Address(), clientTlsConfig(t, "user1"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadBytes('\n')
+	assert.Error(t, err)
+	select {
+	case record := <-sink.records:
+		assert.Equal(t, CloseReasonDialFailed, record.CloseReason)
+		assert.Contains(t, record.Error, "TLS handshake with upstream")
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not close")
+	}
+	assert.NoError(t, conn.Close())
+
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, echoSrv.close())
+}
+
+func TestProxy_OriginateTLS(t *testing.T) {
+	echoSrv := setupTLSEchoServer(t)
+	defer func() { _ = echoSrv.close() }()
+	address := echoSrv.listener.Addr().String()
+	proxy := &Proxy{}
+	pool := &upstreamPool{originateTLS: true}
+
+	// Without upstream TLS, connections are returned as they are.
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	originated, err := proxy.originateTLS(pool, conn, address)
+	require.NoError(t, err)
+	assert.Equal(t, conn, originated)
+	assert.NoError(t, conn.Close())
+
+	// The server name defaults to the target's host, which is in the upstream certificate.
+	config := testProxyConfig(t, address, "engineering")
+	config.UpstreamConfig.TLS = &UpstreamTLSConfig{CA: certificatePath("ca.pem")}
+	tlsConfig, err := config.UpstreamTLSConfig()
+	require.NoError(t, err)
+	proxy.upstreamTLSConfig.Store(tlsConfig)
+	conn, err = net.Dial("tcp", address)
+	require.NoError(t, err)
+	originated, err = proxy.originateTLS(pool, conn, address)
+	require.NoError(t, err)
+	assert.NotEmpty(t, originated.(*tls.Conn).ConnectionState().VerifiedChains)
+	assert.NoError(t, originated.Close())
+
+	// Upstreams signed by another CA are refused.
+	tlsConfig.RootCAs = nil
+	conn, err = net.Dial("tcp", address)
+	require.NoError(t, err)
+	_, err = proxy.originateTLS(pool, conn, address)
+	var verifyErr *tls.CertificateVerificationError
+	assert.ErrorAs(t, err, &verifyErr)
+}